@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/google/shlex"
+	"github.com/xpy123993/yukino-net/libraries/util"
+)
+
+// commandActivator starts and stops on-demand services with shell commands.
+type commandActivator struct {
+	services map[string]util.OnDemandService
+
+	mu        sync.Mutex
+	processes map[string]*exec.Cmd
+}
+
+func newCommandActivator(services map[string]util.OnDemandService) *commandActivator {
+	return &commandActivator{
+		services:  services,
+		processes: make(map[string]*exec.Cmd),
+	}
+}
+
+func createActivationCommand(Command string, Channel string) (*exec.Cmd, error) {
+	commandSeq, err := shlex.Split(Command)
+	if err != nil {
+		return nil, err
+	}
+	if len(commandSeq) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+	cmd := exec.Command(commandSeq[0], commandSeq[1:]...)
+	cmd.Env = append(os.Environ(), "YUKINO_CHANNEL="+Channel)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd, nil
+}
+
+func (activator *commandActivator) Activate(channel string) bool {
+	service, exists := activator.services[channel]
+	if !exists {
+		return false
+	}
+	activator.mu.Lock()
+	previous, running := activator.processes[channel]
+	activator.mu.Unlock()
+	if running {
+		// The previous process is not serving the channel anymore.
+		previous.Process.Kill()
+	}
+	cmd, err := createActivationCommand(service.Start, channel)
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		log.Printf("failed to start on-demand service `%s`: %v", channel, err)
+		return false
+	}
+	activator.mu.Lock()
+	activator.processes[channel] = cmd
+	activator.mu.Unlock()
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			log.Printf("on-demand service `%s` exits with error: %v", channel, err)
+		}
+		activator.mu.Lock()
+		if activator.processes[channel] == cmd {
+			delete(activator.processes, channel)
+		}
+		activator.mu.Unlock()
+	}()
+	return true
+}
+
+func (activator *commandActivator) Deactivate(channel string) {
+	service := activator.services[channel]
+	if len(service.Stop) > 0 {
+		cmd, err := createActivationCommand(service.Stop, channel)
+		if err == nil {
+			err = cmd.Run()
+		}
+		if err != nil {
+			log.Printf("failed to stop on-demand service `%s`: %v", channel, err)
+		}
+		return
+	}
+	activator.mu.Lock()
+	cmd, exists := activator.processes[channel]
+	activator.mu.Unlock()
+	if exists {
+		cmd.Process.Kill()
+	}
+}
@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/xpy123993/yukino-net/libraries/util"
+)
+
+func cmdPublish(ConfigFile []string, Channel string, Message []byte) error {
+	client, err := util.CreateClientFromConfig(ConfigFile)
+	if err != nil {
+		return err
+	}
+	publisher, err := client.Publish(Channel)
+	if err != nil {
+		return err
+	}
+	defer publisher.Close()
+	if Message == nil {
+		if Message, err = io.ReadAll(os.Stdin); err != nil {
+			return err
+		}
+	}
+	return publisher.Send(Message)
+}
+
+func cmdSubscribe(ConfigFile []string, Channel string) error {
+	client, err := util.CreateClientFromConfig(ConfigFile)
+	if err != nil {
+		return err
+	}
+	subscriber, err := client.Subscribe(Channel)
+	if err != nil {
+		return err
+	}
+	defer subscriber.Close()
+	log.Printf("Subscribed to broadcast channel `%s`", Channel)
+	for {
+		message, err := subscriber.Receive()
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(message))
+	}
+}
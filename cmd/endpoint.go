@@ -10,8 +10,10 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/xpy123993/yukino-net/libraries/router"
 	"github.com/xpy123993/yukino-net/libraries/task"
 	"github.com/xpy123993/yukino-net/libraries/util"
 	"golang.org/x/crypto/argon2"
@@ -25,6 +27,7 @@ func cmdInvokeEndpointService(ctx context.Context, ConfigFile []string, Channel,
 			Command:  Command,
 			Deadline: time.Now().Add(timeout),
 		},
+		TraceID: router.NewTraceID(),
 	}
 	if len(PrivateKey) > 0 {
 		if base64.RawURLEncoding.DecodedLen(len(PrivateKey)) != 64 {
@@ -42,9 +45,10 @@ func cmdInvokeEndpointService(ctx context.Context, ConfigFile []string, Channel,
 	if err != nil {
 		return "", err
 	}
-	conn, err := client.Dial(Channel)
+	log.Printf("[trace %s] Invoking command `%s` on channel `%s`", request.TraceID, Command, Channel)
+	conn, err := client.DialWithOption(Channel, router.DialOption{TraceID: request.TraceID})
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("[trace %s] %v", request.TraceID, err)
 	}
 	defer conn.Close()
 	if err := request.Encode(conn); err != nil {
@@ -60,33 +64,52 @@ func cmdInvokeEndpointService(ctx context.Context, ConfigFile []string, Channel,
 	return string(response.Data), nil
 }
 
-func cmdStartEndpointService(ctx context.Context, ConfigFile []string, Channel string, ACL []string, BaseCommand string) error {
-	listener, err := util.CreateListenerFromConfig(ConfigFile, Channel)
+// createListener listens on `Channel`, replacing the active listener with the same identity if `Takeover` is set.
+func createListener(ConfigFile []string, Channel string, Takeover bool) (*router.Listener, error) {
+	if Takeover {
+		return util.CreateTakeoverListenerFromConfig(ConfigFile, Channel)
+	}
+	return util.CreateListenerFromConfig(ConfigFile, Channel)
+}
+
+func cmdStartEndpointService(ctx context.Context, ConfigFile []string, Channel string, ACL []string, BaseCommand string, Takeover bool) error {
+	listener, err := createListener(ConfigFile, Channel, Takeover)
 	if err != nil {
 		return fmt.Errorf("failed to listen on channel: %v", err)
 	}
 	serverContext := task.CreateServerContext(ACL, 4, task.CreateShellCommandInterpreter(BaseCommand))
+	handlers := sync.WaitGroup{}
+	defer handlers.Wait()
 	for ctx.Err() == nil {
 		conn, err := listener.Accept()
 		if err != nil {
 			return err
 		}
+		handlers.Add(1)
 		go func(client net.Conn) {
+			defer handlers.Done()
 			defer conn.Close()
+			traceID := ""
+			if routerConn, ok := client.(*router.Conn); ok {
+				traceID = routerConn.TraceID()
+			}
 			request := &task.Request{}
 			if err := request.Decode(client); err != nil {
-				log.Printf("received invalid reuqest: %v", err)
+				log.Printf("[trace %s] received invalid reuqest: %v", traceID, err)
 				return
 			}
-			log.Printf("Requesting command: %s", request.Command.Command)
+			if len(request.TraceID) > 0 && request.TraceID != traceID {
+				log.Printf("[trace %s] request carries trace ID %s", traceID, request.TraceID)
+			}
+			log.Printf("[trace %s] Requesting command: %s", traceID, request.Command.Command)
 			response := task.FullFillRequest(&serverContext, request)
 			if err := response.Encode(client); err != nil {
-				log.Printf("failed to respond to client: %v", err)
+				log.Printf("[trace %s] failed to respond to client: %v", traceID, err)
 			}
 			if response.IsError {
-				log.Printf("Command returns error: %s", response.ErrorMessage)
+				log.Printf("[trace %s] Command returns error: %s", traceID, response.ErrorMessage)
 			} else if len(response.Data) > 0 {
-				log.Printf("Result: %s", string(response.Data))
+				log.Printf("[trace %s] Result: %s", traceID, string(response.Data))
 			}
 		}(conn)
 	}
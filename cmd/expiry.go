@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/xpy123993/yukino-net/libraries/util"
+)
+
+// tokenMetrics are the metrics of the token file, accessed atomically and served by serveMetrics.
+var tokenMetrics struct {
+	// Number of keys in the token file.
+	keys int64
+	// Number of keys expiring within the warning horizon.
+	expiringKeys int64
+	// Number of expired keys removed from the token file.
+	removedKeys int64
+}
+
+// runExpiryMonitor checks the token file with `monitor` every `interval` and updates tokenMetrics, forever.
+func runExpiryMonitor(monitor *util.ExpiryMonitor, interval time.Duration) {
+	for {
+		stats := monitor.Check()
+		atomic.StoreInt64(&tokenMetrics.keys, int64(stats.Keys))
+		atomic.StoreInt64(&tokenMetrics.expiringKeys, int64(stats.ExpiringKeys))
+		atomic.AddInt64(&tokenMetrics.removedKeys, int64(stats.RemovedKeys))
+		time.Sleep(interval)
+	}
+}
+
+// serveMetrics serves the metrics in JSON on http://[address]/metrics.
+func serveMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int64{
+			"token_keys":          atomic.LoadInt64(&tokenMetrics.keys),
+			"token_expiring_keys": atomic.LoadInt64(&tokenMetrics.expiringKeys),
+			"token_removed_keys":  atomic.LoadInt64(&tokenMetrics.removedKeys),
+		})
+	})
+	log.Printf("Serving metrics at http://%s/metrics", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		log.Printf("failed to serve metrics: %v", err)
+	}
+}
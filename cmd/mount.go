@@ -1,26 +1,28 @@
 package cmd
 
 import (
-	"context"
-	"io"
+	"fmt"
 	"log"
 	"net"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/xpy123993/yukino-net/libraries/common"
 	"github.com/xpy123993/yukino-net/libraries/router"
 	"github.com/xpy123993/yukino-net/libraries/util"
 )
 
+// serviceMetadataKey is the dial metadata key to select the service behind a mounted channel.
+const serviceMetadataKey = "service"
+
 func bridge(peerA, peerB net.Conn) {
-	ctx, cancelFn := context.WithCancel(context.Background())
-	go func() { io.Copy(peerA, peerB); cancelFn() }()
-	go func() { io.Copy(peerB, peerA); cancelFn() }()
-	<-ctx.Done()
+	common.Bridge(peerA, peerB, common.BridgeOption{HalfCloseTimeout: router.DefaultHalfCloseTimeout})
 }
 
-func handleBridge(routerClient *router.Client, channel string, client net.Conn) {
+func handleBridge(routerClient *router.Client, channel string, metadata map[string]string, client net.Conn) {
 	defer client.Close()
-	conn, err := routerClient.Dial(channel)
+	conn, err := routerClient.DialWithMetadata(channel, metadata)
 	if err != nil {
 		log.Print(err.Error())
 		return
@@ -33,7 +35,7 @@ func handleBridge(routerClient *router.Client, channel string, client net.Conn)
 	bridge(conn, client)
 }
 
-func mountLocal(ConfigFile []string, Channel, LocalAddr string) error {
+func mountLocal(ConfigFile []string, Channel, LocalAddr, Service string) error {
 	listener, err := net.Listen("tcp", LocalAddr)
 	if err != nil {
 		return err
@@ -42,30 +44,73 @@ func mountLocal(ConfigFile []string, Channel, LocalAddr string) error {
 	if err != nil {
 		return err
 	}
+	var metadata map[string]string
+	if len(Service) > 0 {
+		metadata = map[string]string{serviceMetadataKey: Service}
+	}
 	log.Printf("Mounting channel `%s` on local address %s", Channel, LocalAddr)
 	for {
 		client, err := listener.Accept()
 		if err != nil {
 			continue
 		}
-		go handleBridge(routerClient, Channel, client)
+		go handleBridge(routerClient, Channel, metadata, client)
+	}
+}
+
+// parseRoutes parses a list of `service=address` into a map.
+func parseRoutes(Routes []string) (map[string]string, error) {
+	routes := make(map[string]string)
+	for _, route := range Routes {
+		parts := strings.SplitN(route, "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return nil, fmt.Errorf("invalid route `%s`, should be in the format of service=address", route)
+		}
+		routes[parts[0]] = parts[1]
 	}
+	return routes, nil
 }
 
-func mountRemote(ConfigFile []string, Channel, RemoteAddr string) error {
-	listener, err := util.CreateListenerFromConfig(ConfigFile, Channel)
+// mountRemote forwards bridged connections on `Channel` to local addresses.
+// Connections carrying a service name in metadata are forwarded to the address in `Routes`, others to `RemoteAddr`.
+// An empty `RemoteAddr` rejects connections without a routable service.
+func mountRemote(ConfigFile []string, Channel, RemoteAddr string, Routes []string, Takeover bool) error {
+	routes, err := parseRoutes(Routes)
+	if err != nil {
+		return err
+	}
+	listener, err := createListener(ConfigFile, Channel, Takeover)
 	if err != nil {
 		return err
 	}
 	log.Printf("Mounting channel `%s` on remote address %s", Channel, RemoteAddr)
+	for service, address := range routes {
+		log.Printf("Routing service `%s` on channel `%s` to %s", service, Channel, address)
+	}
+	bridges := sync.WaitGroup{}
+	defer bridges.Wait()
 	for {
 		client, err := listener.Accept()
 		if err != nil {
-			continue
+			return err
 		}
+		bridges.Add(1)
 		go func(conn net.Conn) {
+			defer bridges.Done()
 			defer conn.Close()
-			peer, err := net.Dial("tcp", RemoteAddr)
+			address := RemoteAddr
+			service, hasService := "", false
+			if routerConn, ok := conn.(*router.Conn); ok {
+				service, hasService = routerConn.Metadata()[serviceMetadataKey]
+			}
+			if hasService {
+				address = routes[service]
+			}
+			if len(address) == 0 {
+				log.Printf("rejected connection on channel `%s`: no route for service `%s`", Channel, service)
+				return
+			}
+			peer, err := net.Dial("tcp", address)
 			if err != nil {
 				return
 			}
@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path"
+	"time"
+
+	"github.com/xpy123993/yukino-net/libraries/common"
+)
+
+// crlFileName is the name of the CRL maintained in the CA folder.
+const crlFileName = "ca.crl"
+
+func loadCertificateFile(CertFile string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(CertFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("cannot decode %s", CertFile)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// cmdRevokeCertificate adds certificates in `CertFiles` and hex serial numbers in `Serials` into the CRL of the CA,
+// then signs the CRL again with a validity of `Validity`. With nothing to revoke, the CRL is only renewed.
+func cmdRevokeCertificate(CAFolder string, CertFiles []string, Serials []string, Validity time.Duration) error {
+	caTLSCert, err := tls.LoadX509KeyPair(path.Join(CAFolder, "ca.crt"), path.Join(CAFolder, "ca.key"))
+	if err != nil {
+		return fmt.Errorf("failed to load CA certificates: %v", err)
+	}
+	caCert, err := x509.ParseCertificate(caTLSCert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	signer, ok := caTLSCert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("the CA private key cannot be used for signing")
+	}
+
+	crlFile := path.Join(CAFolder, crlFileName)
+	revoked := []pkix.RevokedCertificate{}
+	if data, err := os.ReadFile(crlFile); err == nil {
+		crl, err := common.ParseCRL(data, caCert)
+		if err != nil {
+			return fmt.Errorf("cannot load existing CRL %s: %v", crlFile, err)
+		}
+		revoked = append(revoked, crl.TBSCertList.RevokedCertificates...)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	visited := make(map[string]bool)
+	for _, entry := range revoked {
+		visited[entry.SerialNumber.String()] = true
+	}
+
+	serials := []*big.Int{}
+	for _, certFile := range CertFiles {
+		certificate, err := loadCertificateFile(certFile)
+		if err != nil {
+			return fmt.Errorf("cannot load certificate %s: %v", certFile, err)
+		}
+		if err := certificate.CheckSignatureFrom(caCert); err != nil {
+			return fmt.Errorf("certificate %s is not issued by the CA: %v", certFile, err)
+		}
+		serials = append(serials, certificate.SerialNumber)
+	}
+	for _, value := range Serials {
+		serial, ok := new(big.Int).SetString(value, 16)
+		if !ok {
+			return fmt.Errorf("invalid serial number %s, expect a hex string", value)
+		}
+		serials = append(serials, serial)
+	}
+	for _, serial := range serials {
+		if visited[serial.String()] {
+			log.Printf("Serial %s is already revoked", serial.Text(16))
+			continue
+		}
+		visited[serial.String()] = true
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: serial, RevocationTime: time.Now()})
+		log.Printf("Revoked: %s", serial.Text(16))
+	}
+
+	data, err := common.CreateCRL(caCert, signer, revoked, Validity)
+	if err != nil {
+		return fmt.Errorf("cannot sign the CRL: %v", err)
+	}
+	// Writes to a temporary file first, so that routers never load a partially written CRL.
+	if err := os.WriteFile(crlFile+".tmp", data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(crlFile+".tmp", crlFile); err != nil {
+		return err
+	}
+	log.Printf("Updated: %s, %d certificate(s) revoked, valid until %v", crlFile, len(revoked), time.Now().Add(Validity).Format(time.RFC3339))
+	return nil
+}
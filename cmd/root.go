@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/xpy123993/yukino-net/libraries/router/keystore"
 )
 
 var rootCmd = &cobra.Command{
@@ -24,11 +25,18 @@ func init() {
 	var rpcTimeout time.Duration
 	var rpcKey string
 	var rpcPubKey []string
+	var takeover bool
+	var mountService string
+	var mountRoutes []string
 	var baseCommand string
 
+	var watchHook string
+
 	var caName string
 	var certName string
 	var certDNSName string
+	var certKeyFile string
+	var tokenSecret string
 
 	var socksCmd = &cobra.Command{
 		Use:   "socks5 [channel]",
@@ -46,17 +54,25 @@ func init() {
 		Long:  "mount will listen on the specified address, and forward all traffic through this address to `channel`.",
 		Args:  cobra.ExactArgs(2),
 		Run: func(cmd *cobra.Command, args []string) {
-			mountLocal(configFile, args[0], args[1])
+			mountLocal(configFile, args[0], args[1], mountService)
 		},
 	}
 
 	var mountRemoteCmd = &cobra.Command{
 		Use:   "remote [channel] [remote address]",
 		Short: "Create a `channel`, which will forward all traffic to `remote address`",
-		Long:  "mount will listen on the specified channel, and forward all traffic through this address to `remote address`.",
-		Args:  cobra.ExactArgs(2),
+		Long: "mount will listen on the specified channel, and forward all traffic through this address to `remote address`. " +
+			"With --route, connections dialed with a service name are forwarded to the address of that service instead, " +
+			"and `remote address` can be omitted to reject connections without a known service.",
+		Args: cobra.RangeArgs(1, 2),
 		Run: func(cmd *cobra.Command, args []string) {
-			mountRemote(configFile, args[0], args[1])
+			remoteAddr := ""
+			if len(args) > 1 {
+				remoteAddr = args[1]
+			}
+			if err := mountRemote(configFile, args[0], remoteAddr, mountRoutes, takeover); err != nil {
+				log.Printf("Mount returns status: %v", err)
+			}
 		},
 	}
 
@@ -86,7 +102,7 @@ func init() {
 		Short: "Create an EndPoint RPC service on `channel`",
 		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			err := cmdStartEndpointService(cmd.Context(), configFile, args[0], rpcPubKey, baseCommand)
+			err := cmdStartEndpointService(cmd.Context(), configFile, args[0], rpcPubKey, baseCommand, takeover)
 			if err != nil {
 				log.Printf("Service returns status: %v", err)
 			}
@@ -144,6 +160,50 @@ func init() {
 		},
 	}
 
+	var watchCmd = &cobra.Command{
+		Use:   "watch [pattern]",
+		Short: "Watch channels matching `pattern` coming online and going offline",
+		Long:  "watch will print an event each time a channel matching the regular expression `pattern` is registered or unregistered on the router. Only channels with invoke permission are reported.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := cmdWatchChannels(configFile, args[0], watchHook); err != nil {
+				log.Printf("Error: %v", err)
+			}
+		},
+	}
+
+	var broadcastCmd = &cobra.Command{
+		Use:   "broadcast [command]",
+		Short: "Command set related to broadcast channels.",
+	}
+
+	var broadcastPublishCmd = &cobra.Command{
+		Use:   "publish [channel] [message]",
+		Short: "Publish `message` to all subscribers of `channel`",
+		Long:  "publish will send `message` to all subscribers of the broadcast `channel`. If `message` is not specified, it will be read from stdin.",
+		Args:  cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			var message []byte
+			if len(args) > 1 {
+				message = []byte(args[1])
+			}
+			if err := cmdPublish(configFile, args[0], message); err != nil {
+				log.Printf("Error: %v", err)
+			}
+		},
+	}
+
+	var broadcastSubscribeCmd = &cobra.Command{
+		Use:   "subscribe [channel]",
+		Short: "Print all messages published to `channel`",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := cmdSubscribe(configFile, args[0]); err != nil {
+				log.Printf("Error: %v", err)
+			}
+		},
+	}
+
 	var certCmd = &cobra.Command{
 		Use:   "cert [command]",
 		Short: "A set of commands related to certificates",
@@ -167,7 +227,7 @@ func init() {
 		Short: "Create a new certificate under output folder",
 		Args:  cobra.ExactArgs(2),
 		Run: func(cmd *cobra.Command, args []string) {
-			err := cmdGenerateCertificate(certName, certDNSName, args[0], args[1])
+			err := cmdGenerateCertificate(certName, certDNSName, args[0], args[1], certKeyFile)
 			if err != nil {
 				log.Printf("Error: %v", err)
 				return
@@ -181,7 +241,7 @@ func init() {
 		Long:  "Add a new permission for the x509 key pair <cert key, cert>, the function will add a new ACL rule into the token file to apply rule invoke/listen on channel.",
 		Args:  cobra.ExactArgs(3),
 		Run: func(cmd *cobra.Command, args []string) {
-			err := cmdAddCertPermission(args[0], args[1], args[2])
+			err := cmdAddCertPermission(args[0], args[1], args[2], tokenSecret)
 			if err != nil {
 				log.Printf("Error: %v", err)
 				return
@@ -189,6 +249,255 @@ func init() {
 		},
 	}
 
+	var tokenName, tokenChannel string
+	var tokenListen, tokenInvoke bool
+	var tokenDuration time.Duration
+	var tokenRoles []string
+	var certNewToken = &cobra.Command{
+		Use:   "new-token [token file]",
+		Short: "Generate a bearer token and register it into the token file",
+		Long:  "Generate a bearer token for clients without certificates. The token should be set as `token` in the client config file.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			err := cmdGenerateBearerToken(args[0], tokenSecret, tokenName, tokenChannel, tokenListen, tokenInvoke, tokenRoles, tokenDuration)
+			if err != nil {
+				log.Printf("Error: %v", err)
+				return
+			}
+		},
+	}
+
+	var roleDescription string
+	var roleRules []string
+	var certSetRole = &cobra.Command{
+		Use:   "set-role [token file] [role name]",
+		Short: "Create or replace a role in the token file",
+		Long:  "Create or replace a named set of rules in the token file. Keys referring to this role via `roles` will use the new rules after the router reloads the token file.",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := cmdSetRole(args[0], tokenSecret, args[1], roleDescription, roleRules); err != nil {
+				log.Printf("Error: %v", err)
+				return
+			}
+		},
+	}
+
+	var revokeSerials []string
+	var crlValidity time.Duration
+	var certRevoke = &cobra.Command{
+		Use:   "revoke [ca folder] [cert file]...",
+		Short: "Revoke certificates issued by the CA",
+		Long:  "Add the certificates into the CRL `ca.crl` in the CA folder and sign it again. Set `crl-file` to this file in the router config to reject revoked certificates, the router reloads it once modified. Run without certificates to renew the CRL before it expires.",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := cmdRevokeCertificate(args[0], args[1:], revokeSerials, crlValidity); err != nil {
+				log.Printf("Error: %v", err)
+				return
+			}
+		},
+	}
+
+	var certMigrateIdentity = &cobra.Command{
+		Use:   "migrate-identity [token file] [cert file]...",
+		Short: "Identify certificates by their public keys in the token file",
+		Long:  "Move the entries of the certificates in the token file from signature identities to public key identities, so that the permissions are kept once the certificates are renewed with `new-cert --key`.",
+		Args:  cobra.MinimumNArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := cmdMigrateIdentity(args[0], tokenSecret, args[1:]); err != nil {
+				log.Printf("Error: %v", err)
+				return
+			}
+		},
+	}
+
+	var newTokenSecret string
+	var decryptTokens bool
+	var certEncryptTokens = &cobra.Command{
+		Use:   "encrypt-tokens [token file]",
+		Short: "Encrypt the token file with a secret",
+		Long:  "Encrypt the token file at rest with a secret, or change its secret. The router unlocks it at startup with `token-file-secret` in the config.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := cmdEncryptKeyStore(args[0], tokenSecret, newTokenSecret, decryptTokens); err != nil {
+				log.Printf("Error: %v", err)
+				return
+			}
+		},
+	}
+
+	var certConvertTokens = &cobra.Command{
+		Use:   "convert-tokens [token file] [output file]",
+		Short: "Copy the token file into another format",
+		Long:  "Copy all keys and roles of the token file into a new file, e.g. `tokens.db` to move a JSON token file into an embedded database updated in place. Encrypted token files stay encrypted, so they cannot be converted into embedded databases.",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := cmdConvertKeyStore(args[0], tokenSecret, args[1]); err != nil {
+				log.Printf("Error: %v", err)
+				return
+			}
+		},
+	}
+
+	var tokenCmd = &cobra.Command{
+		Use:   "token [command]",
+		Short: "A set of commands to manage keys in the token file",
+		Long:  "Manage keys in the token file by their IDs. All commands print JSON, keys are shown by their hashes as stored in the token file.",
+	}
+
+	var tokenListCmd = &cobra.Command{
+		Use:   "list [token file]",
+		Short: "List all keys in the token file",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := cmdListTokens(args[0], tokenSecret); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+		},
+	}
+
+	var expiringWithin string
+	var tokenExpiringCmd = &cobra.Command{
+		Use:   "expiring [token file]",
+		Short: "List keys expiring soon",
+		Long:  "List keys that are not expired yet but expire within --within, sorted by expiration time. Use `token extend` to renew them.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := cmdListExpiringTokens(args[0], tokenSecret, expiringWithin); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+		},
+	}
+
+	var tokenShowCmd = &cobra.Command{
+		Use:   "show [token file] [id]",
+		Short: "Show a key in the token file",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := cmdShowToken(args[0], tokenSecret, args[1]); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+		},
+	}
+
+	var ruleJSON, ruleChannel, ruleListen, ruleInvoke, rulePublish, ruleSubscribe string
+	var ruleSources []string
+	var tokenAddRuleCmd = &cobra.Command{
+		Use:   "add-rule [token file] [id]",
+		Short: "Append a rule to a key",
+		Long:  "Append a rule to a key. On matching channels it takes precedence over earlier rules of the key, even for actions it leaves undefined, and over the roles of the key for actions it allows or denies. The rule is either built from flags or given in JSON with --json.",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			rule, err := buildRule(ruleJSON, ruleChannel, ruleListen, ruleInvoke, rulePublish, ruleSubscribe, ruleSources)
+			if err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			if err := cmdAddTokenRule(args[0], tokenSecret, args[1], rule); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+		},
+	}
+
+	var tokenRemoveRuleCmd = &cobra.Command{
+		Use:   "remove-rule [token file] [id] [index]",
+		Short: "Remove a rule from a key",
+		Long:  "Remove the rule at `index`, starting from 0, of the rules of a key as shown by `token show`. Rules of its roles are not affected.",
+		Args:  cobra.ExactArgs(3),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := cmdRemoveTokenRule(args[0], tokenSecret, args[1], args[2]); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+		},
+	}
+
+	var tokenRevokeCmd = &cobra.Command{
+		Use:   "revoke [token file] [id]",
+		Short: "Remove a key from the token file",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := cmdRevokeToken(args[0], tokenSecret, args[1]); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+		},
+	}
+
+	var extendDuration time.Duration
+	var extendUntil string
+	var tokenExtendCmd = &cobra.Command{
+		Use:   "extend [token file] [id]",
+		Short: "Extend the expiration time of a key",
+		Long:  "Extend the expiration time of a key by --duration from now or its expiration time, whichever is later, or set it to --until.",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			var until time.Time
+			if len(extendUntil) > 0 {
+				var err error
+				if until, err = time.Parse(time.RFC3339, extendUntil); err != nil {
+					log.Fatalf("Error: invalid time: %v", err)
+				}
+			}
+			if err := cmdExtendToken(args[0], tokenSecret, args[1], extendDuration, until); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+		},
+	}
+
+	var tokenRenameCmd = &cobra.Command{
+		Use:   "rename [token file] [id] [new id]",
+		Short: "Change the ID of a key",
+		Args:  cobra.ExactArgs(3),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := cmdRenameToken(args[0], tokenSecret, args[1], args[2]); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+		},
+	}
+
+	var explainCert, explainToken, explainChannel, explainAction, explainSource, explainAt string
+	var explainIdentityOrder []string
+	var tokenExplainCmd = &cobra.Command{
+		Use:   "explain [token file]",
+		Short: "Explain whether a request is allowed by the token file",
+		Long:  "Evaluate a request from the peer with --cert or --token on --channel without a router, and print the rules matching it in order, the decision and its reason.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			var at time.Time
+			if len(explainAt) > 0 {
+				var err error
+				if at, err = time.Parse(time.RFC3339, explainAt); err != nil {
+					log.Fatalf("Error: invalid time: %v", err)
+				}
+			}
+			if err := cmdExplainToken(args[0], tokenSecret, explainCert, explainToken, explainChannel, explainAction, explainSource, at, explainIdentityOrder); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+		},
+	}
+
+	var exportOutput string
+	var tokenExportCmd = &cobra.Command{
+		Use:   "export [token file]",
+		Short: "Export all keys and roles in JSON",
+		Long:  "Export all keys and roles of the token file in JSON without encryption. Only hashes of the keys are exported, the output can be loaded by `token import`.",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := cmdExportTokens(args[0], tokenSecret, exportOutput); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+		},
+	}
+
+	var tokenImportCmd = &cobra.Command{
+		Use:   "import [token file] [input file]",
+		Short: "Import keys and roles exported by `token export`",
+		Long:  "Import keys and roles in `input file`, or stdin if it is `-`, into the token file. Keys with the same hashes and roles with the same names are replaced. Nothing is imported if any entry is invalid.",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := cmdImportTokens(args[0], tokenSecret, args[1]); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+		},
+	}
+
 	var certNewPubKey = &cobra.Command{
 		Use:   "new-pubkey",
 		Short: "Generate a pair of pubkey, used for rpc server side authentication.",
@@ -214,21 +523,83 @@ func init() {
 	endpointCallCmd.Flags().StringVarP(&rpcKey, "master-key", "m", "", "If not empty, a signature will be created for server side authentication.")
 	endpointServerCmd.Flags().StringArrayVarP(&rpcPubKey, "master-key", "m", []string{}, "If not empty, the server will only accept ACL from signed by those keys.")
 	endpointServerCmd.Flags().StringVarP(&baseCommand, "base", "b", "", "If not empty, server will run [base command] <other commands...>")
+	endpointServerCmd.Flags().BoolVar(&takeover, "takeover", false, "Replace the running service on the channel with the same identity, the previous one drains in-flight requests and exits.")
 	endpointCmd.AddCommand(endpointServerCmd)
 	endpointCmd.AddCommand(endpointCallCmd)
 	endpointCmd.AddCommand(endpointWebhookCmd)
 	endpointCmd.AddCommand(endpointWebhookGenToken)
 
+	watchCmd.Flags().StringVarP(&watchHook, "exec", "e", "", "If not empty, run this command on each event with YUKINO_CHANNEL and YUKINO_EVENT (registered/unregistered) set in its environment.")
+
+	broadcastCmd.AddCommand(broadcastPublishCmd)
+	broadcastCmd.AddCommand(broadcastSubscribeCmd)
+
+	mountLocalCmd.Flags().StringVarP(&mountService, "service", "s", "", "If not empty, request this service from the remote mount.")
+	mountRemoteCmd.Flags().StringArrayVarP(&mountRoutes, "route", "r", []string{}, "Allowed service in the format of service=address, e.g. ssh=localhost:22. Can be specified multiple times.")
 	mountCmd.AddCommand(mountLocalCmd)
+	mountRemoteCmd.Flags().BoolVar(&takeover, "takeover", false, "Replace the running mount on the channel with the same identity, the previous one drains in-flight bridges and exits.")
 	mountCmd.AddCommand(mountRemoteCmd)
 
 	certGenCACmd.Flags().StringVarP(&caName, "name", "n", "Yukino Root CA", "The common name on the CA certificate.")
 	certGenCertCmd.Flags().StringVarP(&certName, "name", "n", "Yukino EndPoint", "The common name on the certificate.")
 	certGenCertCmd.Flags().StringVarP(&certDNSName, "dns", "d", "message.yukino.app", "The DNS scope of the certificate.")
+	certGenCertCmd.Flags().StringVarP(&certKeyFile, "key", "k", "", "If not empty, renew the certificate of this private key instead of generating a new one.")
 	certCmd.AddCommand(certNewPubKey)
 	certCmd.AddCommand(certGenCACmd)
 	certCmd.AddCommand(certGenCertCmd)
 	certCmd.AddCommand(certAddPermRule)
+	certNewToken.Flags().StringVarP(&tokenName, "name", "n", "", "The ID of the token, must be unique in the token file.")
+	certNewToken.Flags().StringVar(&tokenChannel, "channel", "", "Channel regular expression to apply the policy.")
+	certNewToken.Flags().BoolVar(&tokenListen, "listen", false, "Allow listening on matched channels.")
+	certNewToken.Flags().BoolVar(&tokenInvoke, "invoke", false, "Allow invoking matched channels.")
+	certNewToken.Flags().DurationVar(&tokenDuration, "duration", 365*24*time.Hour, "The validity duration of the token.")
+	certNewToken.Flags().StringArrayVarP(&tokenRoles, "role", "r", []string{}, "The role of the token, can be specified multiple times. Rules of later roles take precedence.")
+	certNewToken.MarkFlagRequired("name")
+	certCmd.AddCommand(certNewToken)
+	certSetRole.Flags().StringVarP(&roleDescription, "description", "d", "", "The description of the role.")
+	certSetRole.Flags().StringArrayVarP(&roleRules, "rule", "r", []string{}, "Rule in the format of [channel regexp]=[action],... where action is one of listen, invoke, publish and subscribe, prefixed with ! to deny. Can be specified multiple times, later rules take precedence.")
+	certCmd.AddCommand(certSetRole)
+	certRevoke.Flags().StringArrayVarP(&revokeSerials, "serial", "s", []string{}, "Serial number in hex of a certificate to revoke, for certificates without a local copy. Can be specified multiple times.")
+	certRevoke.Flags().DurationVar(&crlValidity, "validity", 365*24*time.Hour, "The duration before the CRL should be renewed.")
+	certCmd.AddCommand(certRevoke)
+	certCmd.AddCommand(certMigrateIdentity)
+	certEncryptTokens.Flags().StringVar(&newTokenSecret, "new-secret", "prompt", "Where to read the new secret: env:NAME, file:PATH or prompt.")
+	certEncryptTokens.Flags().BoolVar(&decryptTokens, "decrypt", false, "Remove the encryption of the token file.")
+	certCmd.AddCommand(certEncryptTokens)
+	certCmd.AddCommand(certConvertTokens)
+	certCmd.PersistentFlags().StringVar(&tokenSecret, "secret", "", "Where to read the secret of an encrypted token file: env:NAME, file:PATH or prompt. Defaults to YUKINO_TOKEN_SECRET if set, or prompt.")
+
+	tokenCmd.AddCommand(tokenListCmd)
+	tokenExpiringCmd.Flags().StringVar(&expiringWithin, "within", "30d", "The duration from now, e.g. 30d or 12h.")
+	tokenCmd.AddCommand(tokenExpiringCmd)
+	tokenCmd.AddCommand(tokenShowCmd)
+	tokenAddRuleCmd.Flags().StringVar(&ruleJSON, "json", "", `The rule in JSON, e.g. {"channel_regexp": "kitchen-.*", "invoke": 1}. Other rule flags are ignored if specified.`)
+	tokenAddRuleCmd.Flags().StringVar(&ruleChannel, "channel", "", "The regular expression of channels the rule applies to.")
+	tokenAddRuleCmd.Flags().StringVar(&ruleListen, "listen", "", "Listen control of the rule: allow or deny. Leave empty to keep it undefined.")
+	tokenAddRuleCmd.Flags().StringVar(&ruleInvoke, "invoke", "", "Invoke control of the rule: allow or deny. Leave empty to keep it undefined.")
+	tokenAddRuleCmd.Flags().StringVar(&rulePublish, "publish", "", "Publish control of the rule: allow or deny. Leave empty to keep it undefined.")
+	tokenAddRuleCmd.Flags().StringVar(&ruleSubscribe, "subscribe", "", "Subscribe control of the rule: allow or deny. Leave empty to keep it undefined.")
+	tokenAddRuleCmd.Flags().StringArrayVar(&ruleSources, "source", []string{}, "Only apply the rule to requests from this IP address or CIDR range. Can be specified multiple times.")
+	tokenCmd.AddCommand(tokenAddRuleCmd)
+	tokenCmd.AddCommand(tokenRemoveRuleCmd)
+	tokenCmd.AddCommand(tokenRevokeCmd)
+	tokenExtendCmd.Flags().DurationVarP(&extendDuration, "duration", "d", 0, "The duration to extend.")
+	tokenExtendCmd.Flags().StringVar(&extendUntil, "until", "", "The new expiration time in RFC3339, e.g. 2025-01-01T00:00:00Z.")
+	tokenCmd.AddCommand(tokenExtendCmd)
+	tokenCmd.AddCommand(tokenRenameCmd)
+	tokenExplainCmd.Flags().StringVar(&explainCert, "cert", "", "The certificate file of the peer.")
+	tokenExplainCmd.Flags().StringVar(&explainToken, "token", "", "The bearer token of the peer.")
+	tokenExplainCmd.Flags().StringVar(&explainChannel, "channel", "", "The requested channel.")
+	tokenExplainCmd.Flags().StringVar(&explainAction, "action", "invoke", "The requested action: invoke, listen, publish or subscribe.")
+	tokenExplainCmd.Flags().StringVar(&explainSource, "source", "", "The IP address of the peer. If not specified, rules with source conditions only apply if they deny the request.")
+	tokenExplainCmd.Flags().StringVar(&explainAt, "at", "", "The time of the request in RFC3339, defaults to now.")
+	tokenExplainCmd.Flags().StringSliceVar(&explainIdentityOrder, "identity-order", keystore.DefaultIdentityOrder, "How the certificate is looked up in the token file, should match `identity-order` of the router config.")
+	tokenExplainCmd.MarkFlagRequired("channel")
+	tokenCmd.AddCommand(tokenExplainCmd)
+	tokenExportCmd.Flags().StringVarP(&exportOutput, "output", "o", "", "Write to this file instead of stdout.")
+	tokenCmd.AddCommand(tokenExportCmd)
+	tokenCmd.AddCommand(tokenImportCmd)
+	tokenCmd.PersistentFlags().StringVar(&tokenSecret, "secret", "", "Where to read the secret of an encrypted token file: env:NAME, file:PATH or prompt. Defaults to YUKINO_TOKEN_SECRET if set, or prompt.")
 
 	generateConfigCmd.Flags().StringVarP(&configTokenPath, "token-path", "t", "", "Only works for router config, if specified, router will load tokens from this filename")
 
@@ -238,6 +609,9 @@ func init() {
 	rootCmd.AddCommand(httpFileCmd)
 	rootCmd.AddCommand(endpointCmd)
 	rootCmd.AddCommand(routerCmd)
+	rootCmd.AddCommand(watchCmd)
+	rootCmd.AddCommand(broadcastCmd)
 	rootCmd.AddCommand(certCmd)
+	rootCmd.AddCommand(tokenCmd)
 	rootCmd.AddCommand(generateConfigCmd)
 }
@@ -1,11 +1,17 @@
 package cmd
 
 import (
+	"crypto/x509"
 	"fmt"
 	"log"
 	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/xpy123993/yukino-net/libraries/common"
 	"github.com/xpy123993/yukino-net/libraries/router"
 	"github.com/xpy123993/yukino-net/libraries/router/keystore"
 	"github.com/xpy123993/yukino-net/libraries/router/proto"
@@ -16,21 +22,47 @@ type tokenAuthority struct {
 	keyStore *keystore.KeyStore
 }
 
-func (auth *tokenAuthority) CheckPermission(frame *router.Frame, token []byte) bool {
+// frameActions maps frame types to the actions checked in the KeyStore.
+var frameActions = map[byte]int{
+	proto.Dial:      keystore.InvokeAction,
+	proto.Bridge:    keystore.ListenAction,
+	proto.Listen:    keystore.ListenAction,
+	proto.Takeover:  keystore.ListenAction,
+	proto.Publish:   keystore.PublishAction,
+	proto.Subscribe: keystore.SubscribeAction,
+}
+
+func (auth *tokenAuthority) CheckPermission(frame *router.Frame, token []byte, remoteAddr net.Addr) bool {
 	if auth.keyStore == nil {
 		return true
 	}
+	if action, ok := frameActions[frame.Type]; ok {
+		return auth.keyStore.CheckPermissionWithContext(action, frame.Payload, token, keystore.RequestContext{RemoteIP: common.AddrIP(remoteAddr)})
+	}
 	switch frame.Type {
-	case proto.Dial:
-		return auth.keyStore.CheckPermission(keystore.InvokeAction, frame.Payload, token)
-	case proto.Bridge:
-		return auth.keyStore.CheckPermission(keystore.ListenAction, frame.Payload, token)
-	case proto.Listen:
-		return auth.keyStore.CheckPermission(keystore.ListenAction, frame.Payload, token)
+	case proto.Watch, proto.Anycast:
+		// Channels are filtered by the router with Invoke ACL, only a valid key is required here.
+		return auth.keyStore.GetSessionKey(token) != nil
 	}
 	return false
 }
 
+func (auth *tokenAuthority) ExplainPermission(frame *router.Frame, token []byte, remoteAddr net.Addr) string {
+	if auth.keyStore == nil {
+		return "no token file, all requests are allowed"
+	}
+	if action, ok := frameActions[frame.Type]; ok {
+		return auth.keyStore.Explain(action, frame.Payload, token, keystore.RequestContext{RemoteIP: common.AddrIP(remoteAddr)}).String()
+	}
+	switch frame.Type {
+	case proto.Watch:
+		return auth.keyStore.ExplainKey("watch", frame.Payload, token).String()
+	case proto.Anycast:
+		return auth.keyStore.ExplainKey("anycast", frame.Payload, token).String()
+	}
+	return fmt.Sprintf("frame type %d is not allowed", frame.Type)
+}
+
 func (auth *tokenAuthority) GetExpirationTime(key []byte) time.Time {
 	if auth.keyStore == nil {
 		return time.Now().Add(24 * time.Hour)
@@ -38,6 +70,39 @@ func (auth *tokenAuthority) GetExpirationTime(key []byte) time.Time {
 	return auth.keyStore.GetExpireTime(key)
 }
 
+func (auth *tokenAuthority) GetBridgeLimits(key []byte) (time.Duration, time.Duration) {
+	if auth.keyStore == nil {
+		return 0, 0
+	}
+	if sessionKey := auth.keyStore.GetSessionKey(key); sessionKey != nil {
+		return time.Duration(sessionKey.BridgeIdleTimeout), time.Duration(sessionKey.BridgeMaxLifetime)
+	}
+	return 0, 0
+}
+
+// parseOptionalDuration parses `value` as a duration, empty string stands for `fallback`.
+func parseOptionalDuration(value string, fallback time.Duration) (time.Duration, error) {
+	if len(value) == 0 {
+		return fallback, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// reloadOnSignal calls `reload` each time the process receives SIGHUP.
+func reloadOnSignal(name string, reload func() error) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if err := reload(); err != nil {
+				log.Printf("failed to reload %s: %v", name, err)
+				continue
+			}
+			log.Printf("%s reloaded", name)
+		}
+	}()
+}
+
 func cmdStartRoute(ConfigFile []string) error {
 	rand.Seed(time.Now().UnixMicro())
 	config, err := util.LoadClientConfig(ConfigFile)
@@ -45,7 +110,7 @@ func cmdStartRoute(ConfigFile []string) error {
 		return err
 	}
 
-	keyStore, err := util.CreateOrLoadKeyStore(config.TokenFile)
+	keyStore, err := util.CreateOrLoadKeyStore(config.TokenFile, config.TokenFileSecret)
 	if err != nil {
 		return fmt.Errorf("failed to initialize KeyStore: %v", err)
 	}
@@ -55,13 +120,128 @@ func cmdStartRoute(ConfigFile []string) error {
 		return fmt.Errorf("failed to load certificate: %v", err)
 	}
 
+	broadcastDelivery := router.DropOnSlowSubscriber
+	switch config.BroadcastDelivery {
+	case "", "drop":
+	case "block":
+		broadcastDelivery = router.BlockOnSlowSubscriber
+	default:
+		return fmt.Errorf("unknown broadcast delivery: %s", config.BroadcastDelivery)
+	}
+	bridgeIdleTimeout, err := parseOptionalDuration(config.BridgeIdleTimeout, router.DefaultBridgeIdleTimeout)
+	if err != nil {
+		return fmt.Errorf("invalid bridge idle timeout: %v", err)
+	}
+	bridgeMaxLifetime, err := parseOptionalDuration(config.BridgeMaxLifetime, 0)
+	if err != nil {
+		return fmt.Errorf("invalid bridge max lifetime: %v", err)
+	}
+	channelReservationTTL, err := parseOptionalDuration(config.ChannelReservationTTL, 0)
+	if err != nil {
+		return fmt.Errorf("invalid channel reservation TTL: %v", err)
+	}
+	activationTimeout, err := parseOptionalDuration(config.ActivationTimeout, router.DefaultActivationTimeout)
+	if err != nil {
+		return fmt.Errorf("invalid activation timeout: %v", err)
+	}
+	activationIdleTimeout, err := parseOptionalDuration(config.ActivationIdleTimeout, 0)
+	if err != nil {
+		return fmt.Errorf("invalid activation idle timeout: %v", err)
+	}
+	handshakeTimeout, err := parseOptionalDuration(config.HandshakeTimeout, router.DefaultHandshakeTimeout)
+	if err != nil {
+		return fmt.Errorf("invalid handshake timeout: %v", err)
+	}
+	authFailureBanDuration, err := parseOptionalDuration(config.AuthFailureBanDuration, router.DefaultAuthFailureBanDuration)
+	if err != nil {
+		return fmt.Errorf("invalid auth failure ban duration: %v", err)
+	}
+	tokenCheckInterval, err := parseOptionalDuration(config.TokenCheckInterval, time.Hour)
+	if err != nil || tokenCheckInterval <= 0 {
+		return fmt.Errorf("invalid token check interval: %s", config.TokenCheckInterval)
+	}
+	var tokenExpiryWarning time.Duration
+	if len(config.TokenExpiryWarning) > 0 {
+		if tokenExpiryWarning, err = util.ParseDuration(config.TokenExpiryWarning); err != nil {
+			return fmt.Errorf("invalid token expiry warning: %v", err)
+		}
+	}
+	maxPendingHandshakes := router.DefaultMaxPendingHandshakes
+	if config.MaxPendingHandshakes > 0 {
+		maxPendingHandshakes = config.MaxPendingHandshakes
+	}
+	acceptBurstPerIP := config.AcceptBurstPerIP
+	if config.AcceptRatePerIP > 0 && acceptBurstPerIP <= 0 {
+		acceptBurstPerIP = int(config.AcceptRatePerIP) + 1
+	}
+	var activator router.Activator
+	if len(config.OnDemandServices) > 0 {
+		activator = newCommandActivator(config.OnDemandServices)
+	}
+	trustedProxies, err := common.ParseCIDRs(config.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("invalid trusted proxies: %v", err)
+	}
+	identityOrder := keystore.DefaultIdentityOrder
+	if len(config.IdentityOrder) > 0 {
+		identityOrder = config.IdentityOrder
+	}
+	if err := keystore.ValidateIdentityOrder(identityOrder); err != nil {
+		return fmt.Errorf("invalid identity order: %v", err)
+	}
+	var certificateKey func(certificate *x509.Certificate) []byte
+	if keyStore != nil {
+		// Without a token file, the router falls back to the certificate signature, which is not checked anyway.
+		certificateKey = func(certificate *x509.Certificate) []byte {
+			return keyStore.ResolveCertificate(certificate, identityOrder)
+		}
+	}
+
 	serviceRouter := router.NewRouter(router.Option{
 		TokenAuthority:            &tokenAuthority{keyStore: keyStore},
 		DialConnectionTimeout:     3 * time.Second,
 		ListenConnectionKeepAlive: 10 * time.Second,
 		TLSConfig:                 tlsConfig,
+		CertificateKey:            certificateKey,
+		Debug:                     config.Debug,
 		ChannelBufferBytes:        4096,
+		BroadcastDelivery:         broadcastDelivery,
+		BroadcastBufferSize:       config.BroadcastBufferSize,
+		MaxMessageBytes:           router.DefaultMaxMessageBytes,
+		BridgeIdleTimeout:         bridgeIdleTimeout,
+		BridgeMaxLifetime:         bridgeMaxLifetime,
+		TrustedProxies:            trustedProxies,
+		ChannelReservationTTL:     channelReservationTTL,
+		Activator:                 activator,
+		ActivationTimeout:         activationTimeout,
+		ActivationIdleTimeout:     activationIdleTimeout,
+		HandshakeTimeout:          handshakeTimeout,
+		MaxPendingHandshakes:      maxPendingHandshakes,
+		AcceptRatePerIP:           config.AcceptRatePerIP,
+		AcceptBurstPerIP:          acceptBurstPerIP,
+		AuthFailureLimit:          config.AuthFailureLimit,
+		AuthFailureBanDuration:    authFailureBanDuration,
+	})
+	if err := serviceRouter.SetRewriteRules(config.RewriteRules); err != nil {
+		return fmt.Errorf("invalid rewrite rules: %v", err)
+	}
+	reloadOnSignal("rewrite rules", func() error {
+		config, err := util.LoadClientConfig(ConfigFile)
+		if err != nil {
+			return err
+		}
+		return serviceRouter.SetRewriteRules(config.RewriteRules)
 	})
+	if keyStore != nil {
+		// Token files can be changed by other processes, e.g. `cert new-token`.
+		reloadOnSignal("token file", keyStore.Reload)
+		if config.TokenCleanUp || len(config.TokenExpiryWarning) > 0 {
+			go runExpiryMonitor(util.NewExpiryMonitor(keyStore, config.TokenCleanUp, tokenExpiryWarning, config.TokenExpiryHook, config.TokenExpiryWebhook), tokenCheckInterval)
+		}
+	}
+	if len(config.MetricsAddress) > 0 {
+		go serveMetrics(config.MetricsAddress)
+	}
 	servingAddress := config.RouterAddress
 	log.Printf("Starting listening on %s", servingAddress)
 	return serviceRouter.ListenAndServe(servingAddress)
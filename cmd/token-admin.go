@@ -0,0 +1,295 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/xpy123993/yukino-net/libraries/router/keystore"
+	"github.com/xpy123993/yukino-net/libraries/util"
+)
+
+// tokenEntry is the output of a key in the token file.
+type tokenEntry struct {
+	// Hashed key, as stored in the token file.
+	Key     string `json:"key"`
+	Expired bool   `json:"expired"`
+	*keystore.SessionKey
+}
+
+func newTokenEntry(hashKey string, property *keystore.SessionKey) tokenEntry {
+	return tokenEntry{Key: hashKey, Expired: property.Expire.Before(time.Now()), SessionKey: property}
+}
+
+// printJSON prints `value` to stdout in JSON, so that the output can be consumed by scripts.
+func printJSON(value interface{}) error {
+	data, err := json.MarshalIndent(value, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// openTokenEntry loads the existing token file and looks up the key named `ID`.
+func openTokenEntry(TokenFile, SecretSource, ID string) (*keystore.KeyStore, string, *keystore.SessionKey, error) {
+	keyStore, err := util.LoadKeyStore(TokenFile, SecretSource)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("failed to initialize KeyStore: %v", err)
+	}
+	hashKey, property, err := keyStore.FindKeyByID(ID)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return keyStore, hashKey, property, nil
+}
+
+// updateTokenEntry applies `update` to the key named `ID` in one transaction and prints the result.
+func updateTokenEntry(TokenFile, SecretSource, ID string, update func(property *keystore.SessionKey) error) error {
+	keyStore, err := util.CreateOrLoadKeyStore(TokenFile, SecretSource)
+	if err != nil {
+		return fmt.Errorf("failed to initialize KeyStore: %v", err)
+	}
+	hashKey, property, err := keyStore.UpdateKeyByID(ID, update)
+	if err != nil {
+		return err
+	}
+	return printJSON(newTokenEntry(hashKey, property))
+}
+
+func cmdListTokens(TokenFile, SecretSource string) error {
+	keyStore, err := util.LoadKeyStore(TokenFile, SecretSource)
+	if err != nil {
+		return fmt.Errorf("failed to initialize KeyStore: %v", err)
+	}
+	entries := []tokenEntry{}
+	for hashKey, property := range keyStore.Keys() {
+		property := property
+		entries = append(entries, newTokenEntry(hashKey, &property))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return printJSON(entries)
+}
+
+// cmdListExpiringTokens prints the keys expiring within `Within`, e.g. `30d`, sorted by expiration time.
+func cmdListExpiringTokens(TokenFile, SecretSource, Within string) error {
+	within, err := util.ParseDuration(Within)
+	if err != nil {
+		return err
+	}
+	keyStore, err := util.LoadKeyStore(TokenFile, SecretSource)
+	if err != nil {
+		return fmt.Errorf("failed to initialize KeyStore: %v", err)
+	}
+	return printJSON(keyStore.ExpiringKeys(within))
+}
+
+func cmdShowToken(TokenFile, SecretSource, ID string) error {
+	_, hashKey, property, err := openTokenEntry(TokenFile, SecretSource, ID)
+	if err != nil {
+		return err
+	}
+	return printJSON(newTokenEntry(hashKey, property))
+}
+
+// parseControl parses `allow` or `deny`, empty string leaves the control undefined.
+func parseControl(value string) (int, error) {
+	switch value {
+	case "":
+		return keystore.UndefinedACL, nil
+	case "allow":
+		return keystore.Allow, nil
+	case "deny":
+		return keystore.Deny, nil
+	}
+	return keystore.UndefinedACL, fmt.Errorf("invalid control %q, expect allow or deny", value)
+}
+
+// buildRule returns the rule in `RuleJSON` if not empty, otherwise builds one from the channel regexp, controls and sources.
+func buildRule(RuleJSON, ChannelRegexp, Listen, Invoke, Publish, Subscribe string, Sources []string) (keystore.ACLRule, error) {
+	rule := keystore.ACLRule{}
+	if len(RuleJSON) > 0 {
+		if err := json.Unmarshal([]byte(RuleJSON), &rule); err != nil {
+			return rule, fmt.Errorf("invalid rule: %v", err)
+		}
+	} else {
+		rule.ChannelRegexp = ChannelRegexp
+		rule.SourceCIDRs = Sources
+		for _, control := range []struct {
+			value  string
+			target *int
+		}{
+			{Listen, &rule.ListenControl},
+			{Invoke, &rule.InvokeControl},
+			{Publish, &rule.PublishControl},
+			{Subscribe, &rule.SubscribeControl},
+		} {
+			parsed, err := parseControl(control.value)
+			if err != nil {
+				return rule, err
+			}
+			*control.target = parsed
+		}
+	}
+	if err := keystore.ValidateRules([]keystore.ACLRule{rule}); err != nil {
+		return rule, err
+	}
+	return rule, nil
+}
+
+func cmdAddTokenRule(TokenFile, SecretSource, ID string, Rule keystore.ACLRule) error {
+	return updateTokenEntry(TokenFile, SecretSource, ID, func(property *keystore.SessionKey) error {
+		property.Rules = append(property.Rules, Rule)
+		return nil
+	})
+}
+
+// cmdRemoveTokenRule removes the rule at `Index` of the key's own rules, as shown by `token show`.
+func cmdRemoveTokenRule(TokenFile, SecretSource, ID, Index string) error {
+	index, err := strconv.Atoi(Index)
+	if err != nil {
+		return fmt.Errorf("invalid rule index %q: %v", Index, err)
+	}
+	return updateTokenEntry(TokenFile, SecretSource, ID, func(property *keystore.SessionKey) error {
+		if index < 0 || index >= len(property.Rules) {
+			return fmt.Errorf("rule index %d out of range, %s has %d rules", index, ID, len(property.Rules))
+		}
+		property.Rules = append(property.Rules[:index:index], property.Rules[index+1:]...)
+		return nil
+	})
+}
+
+func cmdRevokeToken(TokenFile, SecretSource, ID string) error {
+	keyStore, err := util.CreateOrLoadKeyStore(TokenFile, SecretSource)
+	if err != nil {
+		return fmt.Errorf("failed to initialize KeyStore: %v", err)
+	}
+	hashKey, property, err := keyStore.DeleteKeyByID(ID)
+	if err != nil {
+		return err
+	}
+	return printJSON(newTokenEntry(hashKey, property))
+}
+
+// cmdExtendToken sets the expiration time of the key to `Until` if not zero,
+// otherwise extends it by `Duration` from now or its expiration time, whichever is later.
+func cmdExtendToken(TokenFile, SecretSource, ID string, Duration time.Duration, Until time.Time) error {
+	if Duration <= 0 && Until.IsZero() {
+		return fmt.Errorf("either a positive duration or a time to extend until is required")
+	}
+	return updateTokenEntry(TokenFile, SecretSource, ID, func(property *keystore.SessionKey) error {
+		if !Until.IsZero() {
+			property.Expire = Until
+			return nil
+		}
+		if now := time.Now(); property.Expire.Before(now) {
+			property.Expire = now
+		}
+		property.Expire = property.Expire.Add(Duration)
+		return nil
+	})
+}
+
+func cmdRenameToken(TokenFile, SecretSource, ID, NewID string) error {
+	if len(NewID) == 0 {
+		return fmt.Errorf("the new ID cannot be empty")
+	}
+	return updateTokenEntry(TokenFile, SecretSource, ID, func(property *keystore.SessionKey) error {
+		property.ID = NewID
+		return nil
+	})
+}
+
+// cmdExplainToken prints how the router decides a request on `Channel` from the peer with `CertFile` or bearer `Token`.
+// `Source` and `At` are the IP address and time of the request, empty for unknown and now respectively.
+func cmdExplainToken(TokenFile, SecretSource, CertFile, Token, Channel, Action, Source string, At time.Time, IdentityOrder []string) error {
+	action, err := keystore.ParseAction(Action)
+	if err != nil {
+		return err
+	}
+	if err := keystore.ValidateIdentityOrder(IdentityOrder); err != nil {
+		return err
+	}
+	context := keystore.RequestContext{Time: At}
+	if len(Source) > 0 {
+		if context.RemoteIP = net.ParseIP(Source); context.RemoteIP == nil {
+			return fmt.Errorf("invalid source IP address %q", Source)
+		}
+	}
+	keyStore, err := util.LoadKeyStore(TokenFile, SecretSource)
+	if err != nil {
+		return fmt.Errorf("failed to initialize KeyStore: %v", err)
+	}
+	var key []byte
+	switch {
+	case len(CertFile) > 0 && len(Token) > 0:
+		return fmt.Errorf("only one of certificate and token can be specified")
+	case len(CertFile) > 0:
+		certificate, err := loadCertificateFile(CertFile)
+		if err != nil {
+			return fmt.Errorf("cannot load certificate %s: %v", CertFile, err)
+		}
+		key = keyStore.ResolveCertificate(certificate, IdentityOrder)
+	case len(Token) > 0:
+		token, err := base64.RawStdEncoding.DecodeString(Token)
+		if err != nil {
+			return fmt.Errorf("invalid token: %v", err)
+		}
+		key = keystore.TokenKey(token)
+	default:
+		return fmt.Errorf("either a certificate or a token is required")
+	}
+	return printJSON(keyStore.Explain(action, Channel, key, context))
+}
+
+// cmdExportTokens writes all keys and roles of the token file without encryption to `OutputFile`, or stdout if empty.
+func cmdExportTokens(TokenFile, SecretSource, OutputFile string) error {
+	keyStore, err := util.LoadKeyStore(TokenFile, SecretSource)
+	if err != nil {
+		return fmt.Errorf("failed to initialize KeyStore: %v", err)
+	}
+	data, err := keyStore.Export()
+	if err != nil {
+		return err
+	}
+	if len(OutputFile) == 0 {
+		fmt.Println(string(data))
+		return nil
+	}
+	return os.WriteFile(OutputFile, data, 0600)
+}
+
+// cmdImportTokens merges the keys and roles exported by `token export` in `InputFile`, or stdin if it is `-`, into the token file.
+func cmdImportTokens(TokenFile, SecretSource, InputFile string) error {
+	var data []byte
+	var err error
+	if InputFile == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(InputFile)
+	}
+	if err != nil {
+		return err
+	}
+	imported, err := keystore.ParseKeyStore(data)
+	if err != nil {
+		return fmt.Errorf("invalid input: %v", err)
+	}
+	keyStore, err := util.CreateOrLoadKeyStore(TokenFile, SecretSource)
+	if err != nil {
+		return fmt.Errorf("failed to initialize KeyStore: %v", err)
+	}
+	if err := keyStore.Merge(imported); err != nil {
+		return err
+	}
+	return printJSON(struct {
+		Keys  int `json:"keys"`
+		Roles int `json:"roles"`
+	}{len(imported.Table), len(imported.Roles)})
+}
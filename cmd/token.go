@@ -10,6 +10,7 @@ import (
 	"log"
 	"os"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/xpy123993/yukino-net/libraries/common"
@@ -17,12 +18,13 @@ import (
 	"github.com/xpy123993/yukino-net/libraries/util"
 )
 
-func calculateCertificateSignature(cert *tls.Certificate) (string, error) {
+// calculateCertificateIdentity returns the hashed public key identity of `cert`, as stored in the token file.
+func calculateCertificateIdentity(cert *tls.Certificate) (string, error) {
 	certificate, err := x509.ParseCertificate(cert.Certificate[0])
 	if err != nil {
 		return "", fmt.Errorf("failed to parse the certificate: %v", err)
 	}
-	return keystore.HashKey(certificate.Signature), nil
+	return keystore.HashKey(keystore.SPKIKey(certificate)), nil
 }
 
 func cmdGenerateCA(CertName string, OutputFolder string) error {
@@ -78,7 +80,7 @@ func loadCA(CAFolder string) ([]byte, []byte, *x509.Certificate, error) {
 	return caPriv, caPub, caCert, nil
 }
 
-func cmdGenerateCertificate(CertName string, DNSName string, CAFolder string, OutputFolder string) error {
+func cmdGenerateCertificate(CertName string, DNSName string, CAFolder string, OutputFolder string, KeyFile string) error {
 	if stats, err := os.Stat(OutputFolder); err != nil {
 		if !os.IsNotExist(err) {
 			return fmt.Errorf("error while probing output folder: %v", err)
@@ -97,10 +99,17 @@ func cmdGenerateCertificate(CertName string, DNSName string, CAFolder string, Ou
 	if err != nil {
 		return err
 	}
+	var privateKey []byte
+	if len(KeyFile) > 0 {
+		if privateKey, err = os.ReadFile(KeyFile); err != nil {
+			return fmt.Errorf("cannot load the private key: %v", err)
+		}
+	}
 	priv, pub, _, err := common.GenerateCertificate(common.GenCertOption{
 		CertName:      CertName,
 		DNSName:       DNSName,
 		KeyLength:     4096,
+		PrivateKey:    privateKey,
 		IsCA:          false,
 		CACertificate: *caCert,
 		CAPriv:        caPriv,
@@ -120,7 +129,7 @@ func cmdGenerateCertificate(CertName string, DNSName string, CAFolder string, Ou
 	return nil
 }
 
-func cmdAddCertPermission(KeyFile, CertFile, TokenFile string) error {
+func cmdAddCertPermission(KeyFile, CertFile, TokenFile, SecretSource string) error {
 	cert, err := tls.LoadX509KeyPair(CertFile, KeyFile)
 	if err != nil {
 		return fmt.Errorf("failed to load the certificate: %v", err)
@@ -130,7 +139,7 @@ func cmdAddCertPermission(KeyFile, CertFile, TokenFile string) error {
 		return fmt.Errorf("failed to parse the certificate: %v", err)
 	}
 
-	keyStore, err := util.CreateOrLoadKeyStore(TokenFile)
+	keyStore, err := util.CreateOrLoadKeyStore(TokenFile, SecretSource)
 	if err != nil {
 		return fmt.Errorf("failed to initialize KeyStore: %v", err)
 	}
@@ -154,11 +163,18 @@ func cmdAddCertPermission(KeyFile, CertFile, TokenFile string) error {
 	if resp == "y" {
 		rule.InvokeControl = keystore.Allow
 	} else if resp != "n" {
-		rule.ListenControl = keystore.Deny
+		rule.InvokeControl = keystore.Deny
 		log.Printf("Cannot recongnize %s, set to deny", resp)
 	}
 
-	sessionKey := keyStore.GetSessionKey(certificate.Signature)
+	key := keystore.SPKIKey(certificate)
+	if keyStore.GetSessionKey(key) == nil && keyStore.GetSessionKey(keystore.SignatureKey(certificate)) != nil {
+		if err := keyStore.MigrateKey(keystore.SignatureKey(certificate), key); err != nil {
+			return err
+		}
+		log.Printf("Migrated the entry of %s to the public key identity", certificate.Subject.CommonName)
+	}
+	sessionKey := keyStore.GetSessionKey(key)
 	if sessionKey == nil {
 		sessionKey = &keystore.SessionKey{
 			ID:          certificate.Subject.CommonName,
@@ -166,9 +182,183 @@ func cmdAddCertPermission(KeyFile, CertFile, TokenFile string) error {
 			Description: "ACL rules for " + certificate.Subject.CommonName + " generated at " + time.Now().Format(time.RFC3339),
 		}
 	}
+	// A renewed certificate of the same key pair extends the entry.
+	if certificate.NotAfter.After(sessionKey.Expire) {
+		sessionKey.Expire = certificate.NotAfter
+	}
 	sessionKey.Rules = append(sessionKey.Rules, rule)
-	keyStore.UpdateKey(certificate.Signature, *sessionKey)
-	return keyStore.Save(TokenFile)
+	return keyStore.UpdateKey(key, *sessionKey)
+}
+
+// cmdEncryptKeyStore encrypts the token file with the secret from `NewSecretSource`, or decrypts it if `Decrypt` is true.
+func cmdEncryptKeyStore(TokenFile, SecretSource, NewSecretSource string, Decrypt bool) error {
+	if util.IsBoltTokenFile(TokenFile) {
+		return fmt.Errorf("encryption is only supported by JSON token files")
+	}
+	encrypted, err := keystore.IsEncrypted(TokenFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var currentSecret []byte
+	if encrypted {
+		if currentSecret, err = util.ReadSecret(SecretSource); err != nil {
+			return fmt.Errorf("cannot unlock %s: %v", TokenFile, err)
+		}
+	}
+	if Decrypt {
+		log.Printf("Saving %s WITHOUT encryption", TokenFile)
+		return keystore.ChangeFileSecret(TokenFile, currentSecret, nil)
+	}
+	var secret []byte
+	if NewSecretSource == "prompt" {
+		if secret, err = util.PromptSecret("New secret: "); err != nil {
+			return err
+		}
+		confirm, err := util.PromptSecret("Confirm the new secret: ")
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(secret, confirm) {
+			return fmt.Errorf("secrets do not match")
+		}
+		if len(secret) == 0 {
+			return fmt.Errorf("the secret cannot be empty")
+		}
+	} else if secret, err = util.ReadSecret(NewSecretSource); err != nil {
+		return err
+	}
+	if err := keystore.ChangeFileSecret(TokenFile, currentSecret, secret); err != nil {
+		return err
+	}
+	log.Printf("Encrypted: %s", TokenFile)
+	return nil
+}
+
+// cmdConvertKeyStore copies all keys and roles of `TokenFile` into a new file `OutputFile`, the format is chosen by its extension.
+func cmdConvertKeyStore(TokenFile, SecretSource, OutputFile string) error {
+	if _, err := os.Stat(TokenFile); err != nil {
+		return err
+	}
+	if _, err := os.Stat(OutputFile); err == nil {
+		return fmt.Errorf("%s already exists", OutputFile)
+	}
+	source, secret, err := util.OpenTokenStorage(TokenFile, SecretSource)
+	if err != nil {
+		return err
+	}
+	var destination keystore.Storage
+	if secret != nil {
+		// Keys of an encrypted token file are never written in plaintext.
+		if util.IsBoltTokenFile(OutputFile) {
+			return fmt.Errorf("%s is encrypted, but embedded databases cannot be encrypted", TokenFile)
+		}
+		destination = keystore.NewFileStorage(OutputFile, secret)
+	} else if destination, _, err = util.OpenTokenStorage(OutputFile, ""); err != nil {
+		return err
+	}
+	if err := keystore.CopyStorage(destination, source); err != nil {
+		return err
+	}
+	log.Printf("Converted %s to %s", TokenFile, OutputFile)
+	return nil
+}
+
+// cmdMigrateIdentity moves the entries of certificates in `CertFiles` from signature identities to public key identities.
+func cmdMigrateIdentity(TokenFile, SecretSource string, CertFiles []string) error {
+	keyStore, err := util.CreateOrLoadKeyStore(TokenFile, SecretSource)
+	if err != nil {
+		return fmt.Errorf("failed to initialize KeyStore: %v", err)
+	}
+	for _, certFile := range CertFiles {
+		certificate, err := loadCertificateFile(certFile)
+		if err != nil {
+			return fmt.Errorf("cannot load certificate %s: %v", certFile, err)
+		}
+		if err := keyStore.MigrateKey(keystore.SignatureKey(certificate), keystore.SPKIKey(certificate)); err != nil {
+			log.Printf("Skipped %s: %v", certFile, err)
+			continue
+		}
+		log.Printf("Migrated: %s", certFile)
+	}
+	return nil
+}
+
+func cmdGenerateBearerToken(TokenFile, SecretSource, Name, ChannelRegexp string, AllowListen, AllowInvoke bool, Roles []string, Duration time.Duration) error {
+	keyStore, err := util.CreateOrLoadKeyStore(TokenFile, SecretSource)
+	if err != nil {
+		return fmt.Errorf("failed to initialize KeyStore: %v", err)
+	}
+	rules := []keystore.ACLRule{}
+	if len(ChannelRegexp) > 0 || AllowListen || AllowInvoke {
+		rule := keystore.ACLRule{ChannelRegexp: ChannelRegexp}
+		if AllowListen {
+			rule.ListenControl = keystore.Allow
+		}
+		if AllowInvoke {
+			rule.InvokeControl = keystore.Allow
+		}
+		rules = append(rules, rule)
+	}
+	token, err := keyStore.GenerateKey(keystore.SessionKey{
+		ID:     Name,
+		Expire: time.Now().Add(Duration),
+		Rules:  rules,
+		Roles:  Roles,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Token: %s\n", token)
+	return nil
+}
+
+func cmdSetRole(TokenFile, SecretSource, Name, Description string, Rules []string) error {
+	keyStore, err := util.CreateOrLoadKeyStore(TokenFile, SecretSource)
+	if err != nil {
+		return fmt.Errorf("failed to initialize KeyStore: %v", err)
+	}
+	role := keystore.Role{Description: Description}
+	for _, value := range Rules {
+		rule, err := parseRule(value)
+		if err != nil {
+			return err
+		}
+		role.Rules = append(role.Rules, rule)
+	}
+	return keyStore.SetRole(Name, role)
+}
+
+// parseRule parses a rule in the format of `[channel regexp]=[action],[action]...`, e.g. `kitchen-.*=listen,invoke`.
+// An action prefixed with `!` is denied.
+func parseRule(value string) (keystore.ACLRule, error) {
+	separator := strings.LastIndex(value, "=")
+	if separator < 0 {
+		return keystore.ACLRule{}, fmt.Errorf("invalid rule %q, expect [channel regexp]=[action],[action]", value)
+	}
+	rule := keystore.ACLRule{ChannelRegexp: value[:separator]}
+	for _, action := range strings.Split(value[separator+1:], ",") {
+		control := keystore.Allow
+		if strings.HasPrefix(action, "!") {
+			control = keystore.Deny
+			action = action[1:]
+		}
+		switch action {
+		case "listen":
+			rule.ListenControl = control
+		case "invoke":
+			rule.InvokeControl = control
+		case "publish":
+			rule.PublishControl = control
+		case "subscribe":
+			rule.SubscribeControl = control
+		default:
+			return keystore.ACLRule{}, fmt.Errorf("unknown action %q in rule %q", action, value)
+		}
+	}
+	if err := keystore.ValidateRules([]keystore.ACLRule{rule}); err != nil {
+		return keystore.ACLRule{}, err
+	}
+	return rule, nil
 }
 
 func batchWrite(dataMap map[string][]byte, writer *zip.Writer) error {
@@ -207,11 +397,11 @@ func generateConfigZIP(RouterAddress string, CAFolder string, ServerDNS string,
 	if err != nil {
 		return err
 	}
-	signature, err := calculateCertificateSignature(&cert)
+	identity, err := calculateCertificateIdentity(&cert)
 	if err != nil {
 		return err
 	}
-	log.Printf("Cert signature: %s", signature)
+	log.Printf("Cert identity: %s", identity)
 	config := util.ClientConfig{
 		RouterAddress:      RouterAddress,
 		ServerNameOverride: RouterAddress,
@@ -227,7 +417,7 @@ func generateConfigZIP(RouterAddress string, CAFolder string, ServerDNS string,
 	}
 	buf := new(bytes.Buffer)
 	w := zip.NewWriter(buf)
-	w.SetComment("This file contains a configuration set for yukino-net. Cert signature: " + signature)
+	w.SetComment("This file contains a configuration set for yukino-net. Cert identity: " + identity)
 	if err := batchWrite(map[string][]byte{
 		"cert.key":    priv,
 		"cert.crt":    pub,
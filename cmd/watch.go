@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+
+	"github.com/google/shlex"
+	"github.com/xpy123993/yukino-net/libraries/router"
+	"github.com/xpy123993/yukino-net/libraries/util"
+)
+
+func runWatchHook(Hook string, event *router.ChannelEvent) error {
+	commandSeq, err := shlex.Split(Hook)
+	if err != nil {
+		return err
+	}
+	if len(commandSeq) == 0 {
+		return fmt.Errorf("empty hook command")
+	}
+	eventName := "unregistered"
+	if event.Registered {
+		eventName = "registered"
+	}
+	cmd := exec.Command(commandSeq[0], commandSeq[1:]...)
+	cmd.Env = append(os.Environ(), "YUKINO_CHANNEL="+event.Channel, "YUKINO_EVENT="+eventName)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func cmdWatchChannels(ConfigFile []string, Pattern string, Hook string) error {
+	client, err := util.CreateClientFromConfig(ConfigFile)
+	if err != nil {
+		return err
+	}
+	watcher, err := client.Watch(Pattern)
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	log.Printf("Watching channels matching `%s`", Pattern)
+	for {
+		event, err := watcher.Next()
+		if err != nil {
+			return err
+		}
+		if event.Registered {
+			log.Printf("Channel `%s` registered", event.Channel)
+		} else {
+			log.Printf("Channel `%s` unregistered", event.Channel)
+		}
+		if len(Hook) > 0 {
+			if err := runWatchHook(Hook, event); err != nil {
+				log.Printf("Hook returns error: %v", err)
+			}
+		}
+	}
+}
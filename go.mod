@@ -2,14 +2,18 @@ module github.com/xpy123993/yukino-net
 
 go 1.17
 
-require github.com/armon/go-socks5 v0.0.0-20160902184237-e75332964ef5
+require (
+	github.com/armon/go-socks5 v0.0.0-20160902184237-e75332964ef5
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
+)
 
 require (
 	github.com/google/shlex v0.0.0-20191202100458-e7afc7fbc510
 	github.com/spf13/cobra v1.2.1
 	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5
 	golang.org/x/net v0.0.0-20210908191846-a5e095526f91 // indirect
-	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
+	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1
 	golang.org/x/time v0.0.0-20210723032227-1f47c861a9ac
 )
 
@@ -0,0 +1,137 @@
+package common
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrBridgeIdleTimeout is returned by Bridge if the bridge is cut due to inactivity.
+	ErrBridgeIdleTimeout = errors.New("bridge idle timeout")
+	// ErrBridgeLifetimeExceeded is returned by Bridge if the bridge is cut due to reaching its maximum lifetime.
+	ErrBridgeLifetimeExceeded = errors.New("bridge maximum lifetime exceeded")
+)
+
+// BridgeOption specifies parameters used by Bridge.
+type BridgeOption struct {
+	// BufferBytes specifies the size of the buffer used in each direction. Zero uses the io.Copy default.
+	BufferBytes int
+	// HalfCloseTimeout specifies how long the remaining direction can stay idle once the other direction finished.
+	// Zero means no limit.
+	HalfCloseTimeout time.Duration
+	// IdleTimeout specifies how long the bridge can stay without any bytes in either direction. Zero means no limit.
+	IdleTimeout time.Duration
+	// MaxLifetime specifies the maximum duration of the bridge. Zero means no limit.
+	MaxLifetime time.Duration
+}
+
+// MinTimeout returns the smaller one of two timeouts, where zero stands for no limit.
+func MinTimeout(a, b time.Duration) time.Duration {
+	if a <= 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// closeWriter is implemented by connections supporting half-close, e.g. *net.TCPConn and *tls.Conn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// CloseWrite shuts down the writing side of `conn`.
+// If `conn` does not support half-close, it will be fully closed.
+func CloseWrite(conn net.Conn) error {
+	if writer, ok := conn.(closeWriter); ok {
+		return writer.CloseWrite()
+	}
+	return conn.Close()
+}
+
+// activityWriter records the timestamp of the last write into `lastActive`.
+type activityWriter struct {
+	writer     io.Writer
+	lastActive *int64
+}
+
+func (w *activityWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	atomic.StoreInt64(w.lastActive, time.Now().UnixNano())
+	return n, err
+}
+
+// Bridge copies data between `peerA` and `peerB` until both directions finish.
+// Once a direction reaches EOF, the write side of its destination is closed so that half-close is propagated.
+// Both connections are closed when Bridge returns.
+func Bridge(peerA, peerB net.Conn, option BridgeOption) error {
+	defer peerA.Close()
+	defer peerB.Close()
+
+	lastActive := time.Now().UnixNano()
+	done := make(chan error, 2)
+	pipe := func(dst, src net.Conn) {
+		var reader io.Reader = src
+		if option.BufferBytes > 0 {
+			reader = bufio.NewReaderSize(src, option.BufferBytes)
+		}
+		_, err := io.Copy(&activityWriter{writer: dst, lastActive: &lastActive}, reader)
+		if err == nil {
+			err = CloseWrite(dst)
+		}
+		done <- err
+	}
+	go pipe(peerA, peerB)
+	go pipe(peerB, peerA)
+
+	var lifetime <-chan time.Time
+	if option.MaxLifetime > 0 {
+		lifetimeTimer := time.NewTimer(option.MaxLifetime)
+		defer lifetimeTimer.Stop()
+		lifetime = lifetimeTimer.C
+	}
+	var idleTimer *time.Timer
+	var idleSignal <-chan time.Time
+	armIdleTimer := func(timeout time.Duration) {
+		if idleTimer == nil {
+			idleTimer = time.NewTimer(timeout)
+			idleSignal = idleTimer.C
+			return
+		}
+		idleTimer.Reset(timeout)
+	}
+	defer func() {
+		if idleTimer != nil {
+			idleTimer.Stop()
+		}
+	}()
+	idleTimeout := option.IdleTimeout
+	if idleTimeout > 0 {
+		armIdleTimer(idleTimeout)
+	}
+
+	for pending := 2; pending > 0; {
+		select {
+		case err := <-done:
+			if err != nil {
+				return err
+			}
+			pending--
+			if timeout := MinTimeout(idleTimeout, option.HalfCloseTimeout); timeout != idleTimeout {
+				idleTimeout = timeout
+				armIdleTimer(idleTimeout)
+			}
+		case <-idleSignal:
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(&lastActive)))
+			if idle >= idleTimeout {
+				return ErrBridgeIdleTimeout
+			}
+			armIdleTimer(idleTimeout - idle)
+		case <-lifetime:
+			return ErrBridgeLifetimeExceeded
+		}
+	}
+	return nil
+}
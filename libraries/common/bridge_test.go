@@ -0,0 +1,106 @@
+package common_test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xpy123993/yukino-net/libraries/common"
+)
+
+func TestBridgeIdleTimeout(t *testing.T) {
+	peerA, clientA := net.Pipe()
+	peerB, clientB := net.Pipe()
+	defer clientA.Close()
+	defer clientB.Close()
+
+	go func() {
+		p := make([]byte, 5)
+		clientB.Read(p)
+	}()
+	go clientA.Write([]byte("hello"))
+	if err := common.Bridge(peerA, peerB, common.BridgeOption{IdleTimeout: 50 * time.Millisecond}); err != common.ErrBridgeIdleTimeout {
+		t.Errorf("expect idle timeout, got %v", err)
+	}
+}
+
+func TestBridgeMaxLifetime(t *testing.T) {
+	peerA, clientA := net.Pipe()
+	peerB, clientB := net.Pipe()
+	defer clientA.Close()
+	defer clientB.Close()
+
+	go func() {
+		p := make([]byte, 1)
+		for {
+			if _, err := clientB.Read(p); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			if _, err := clientA.Write([]byte("a")); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	if err := common.Bridge(peerA, peerB, common.BridgeOption{
+		IdleTimeout: time.Second,
+		MaxLifetime: 100 * time.Millisecond,
+	}); err != common.ErrBridgeLifetimeExceeded {
+		t.Errorf("expect lifetime exceeded, got %v", err)
+	}
+}
+
+func TestBridgeHalfClose(t *testing.T) {
+	peerA, clientA, err := tcpPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerB, clientB, err := tcpPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientA.Close()
+	defer clientB.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- common.Bridge(peerA, peerB, common.BridgeOption{})
+	}()
+
+	if _, err := clientA.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err := common.CloseWrite(clientA); err != nil {
+		t.Fatal(err)
+	}
+	// EOF is only received if the half-close is propagated.
+	request, err := io.ReadAll(clientB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(request) != "request" {
+		t.Errorf("expect `request`, got `%s`", string(request))
+	}
+
+	// The other direction keeps flowing after the half-close.
+	if _, err := clientB.Write([]byte("response")); err != nil {
+		t.Fatal(err)
+	}
+	if err := common.CloseWrite(clientB); err != nil {
+		t.Fatal(err)
+	}
+	response, err := io.ReadAll(clientA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != "response" {
+		t.Errorf("expect `response`, got `%s`", string(response))
+	}
+	if err := <-done; err != nil {
+		t.Errorf("expect the bridge to finish without error, got %v", err)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"fmt"
 	"math/big"
 	"time"
 )
@@ -36,7 +37,7 @@ func createCertificateSpec(isCA bool, DNSName string, CommonName string) *x509.C
 	if isCA {
 		certificate.IsCA = true
 		certificate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth}
-		certificate.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign
+		certificate.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign
 		certificate.BasicConstraintsValid = true
 		certificate.DNSNames = []string{DNSName}
 	} else {
@@ -54,6 +55,8 @@ type GenCertOption struct {
 	DNSName   string
 	CertName  string
 	KeyLength int
+	// If not empty, reuses this PEM encoded PKCS1 private key instead of generating one with `KeyLength`.
+	PrivateKey []byte
 
 	IsCA          bool
 	CACertificate x509.Certificate
@@ -65,7 +68,17 @@ type GenCertOption struct {
 func GenerateCertificate(option GenCertOption) ([]byte, []byte, *x509.Certificate, error) {
 	cert := createCertificateSpec(option.IsCA, option.DNSName, option.CertName)
 
-	certPrivKey, err := rsa.GenerateKey(rand.Reader, option.KeyLength)
+	var certPrivKey *rsa.PrivateKey
+	var err error
+	if len(option.PrivateKey) > 0 {
+		block, _ := pem.Decode(option.PrivateKey)
+		if block == nil {
+			return nil, nil, nil, fmt.Errorf("cannot decode the private key")
+		}
+		certPrivKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		certPrivKey, err = rsa.GenerateKey(rand.Reader, option.KeyLength)
+	}
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -0,0 +1,152 @@
+package common
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+)
+
+// ParseCRL parses a PEM or DER encoded CRL and verifies that it is signed by `issuer`.
+func ParseCRL(data []byte, issuer *x509.Certificate) (*pkix.CertificateList, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "X509 CRL" {
+			return nil, fmt.Errorf("unexpected PEM block type %s", block.Type)
+		}
+		data = block.Bytes
+	}
+	crl, err := x509.ParseDERCRL(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := issuer.CheckCRLSignature(crl); err != nil {
+		return nil, fmt.Errorf("invalid CRL signature: %v", err)
+	}
+	return crl, nil
+}
+
+// CreateCRL returns a PEM encoded CRL signed by `issuer` containing `revoked`, valid for `validity`.
+func CreateCRL(issuer *x509.Certificate, issuerKey crypto.Signer, revoked []pkix.RevokedCertificate, validity time.Duration) ([]byte, error) {
+	now := time.Now()
+	data, err := issuer.CreateCRL(rand.Reader, issuerKey, revoked, now, now.Add(validity))
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: data}), nil
+}
+
+// DefaultCRLReloadInterval is the default interval to check if the CRL file is modified.
+const DefaultCRLReloadInterval = time.Minute
+
+// CRLChecker rejects certificates revoked by a CRL file.
+// The file is checked at most once per reload interval, and reloaded once its modification time changes.
+type CRLChecker struct {
+	fileName string
+	issuer   *x509.Certificate
+
+	mu             sync.Mutex
+	modTime        time.Time
+	revoked        map[string]bool
+	reloadInterval time.Duration
+	lastReload     time.Time
+}
+
+// NewCRLChecker loads the CRL in `fileName` issued by `issuer`.
+func NewCRLChecker(fileName string, issuer *x509.Certificate) (*CRLChecker, error) {
+	checker := &CRLChecker{fileName: fileName, issuer: issuer, reloadInterval: DefaultCRLReloadInterval, lastReload: time.Now()}
+	if err := checker.Reload(); err != nil {
+		return nil, err
+	}
+	return checker, nil
+}
+
+// SetReloadInterval sets the minimum interval between checks of the CRL file made by IsRevoked.
+func (checker *CRLChecker) SetReloadInterval(interval time.Duration) {
+	checker.mu.Lock()
+	checker.reloadInterval = interval
+	checker.mu.Unlock()
+}
+
+// reloadIfDue reloads the CRL file if it has not been checked within the reload interval.
+// Errors are logged, so that a broken file is reported at most once per interval.
+func (checker *CRLChecker) reloadIfDue() {
+	now := time.Now()
+	checker.mu.Lock()
+	due := now.Sub(checker.lastReload) >= checker.reloadInterval
+	if due {
+		checker.lastReload = now
+	}
+	checker.mu.Unlock()
+	if !due {
+		return
+	}
+	if err := checker.Reload(); err != nil {
+		log.Printf("Warning: %v, using the previously loaded CRL", err)
+	}
+}
+
+// Reload reads the CRL file if it has been modified since the last load.
+// On error, the previously loaded list stays in effect.
+func (checker *CRLChecker) Reload() error {
+	stat, err := os.Stat(checker.fileName)
+	if err != nil {
+		return err
+	}
+	checker.mu.Lock()
+	defer checker.mu.Unlock()
+	if checker.revoked != nil && stat.ModTime().Equal(checker.modTime) {
+		return nil
+	}
+	data, err := os.ReadFile(checker.fileName)
+	if err != nil {
+		return err
+	}
+	crl, err := ParseCRL(data, checker.issuer)
+	if err != nil {
+		return fmt.Errorf("cannot load CRL from %s: %v", checker.fileName, err)
+	}
+	if crl.HasExpired(time.Now()) {
+		log.Printf("Warning: CRL %s has expired at %v, please renew it with `cert revoke`", checker.fileName, crl.TBSCertList.NextUpdate)
+	}
+	revoked := make(map[string]bool)
+	for _, entry := range crl.TBSCertList.RevokedCertificates {
+		revoked[entry.SerialNumber.String()] = true
+	}
+	checker.revoked = revoked
+	checker.modTime = stat.ModTime()
+	return nil
+}
+
+// IsRevoked returns whether the certificate with `serial` is revoked.
+func (checker *CRLChecker) IsRevoked(serial *big.Int) bool {
+	checker.reloadIfDue()
+	checker.mu.Lock()
+	defer checker.mu.Unlock()
+	return checker.revoked[serial.String()]
+}
+
+// VerifyConnection can be used as `tls.Config.VerifyConnection` to reject revoked certificates.
+// Unlike `tls.Config.VerifyPeerCertificate`, it also runs on resumed sessions.
+// It must be used together with the standard verification, as only the verified chains are checked if available.
+func (checker *CRLChecker) VerifyConnection(state tls.ConnectionState) error {
+	chains := state.VerifiedChains
+	if len(chains) == 0 {
+		chains = [][]*x509.Certificate{state.PeerCertificates}
+	}
+	for _, chain := range chains {
+		for _, certificate := range chain {
+			if checker.IsRevoked(certificate.SerialNumber) {
+				return fmt.Errorf("certificate %s (serial %s) has been revoked", certificate.Subject.CommonName, certificate.SerialNumber.Text(16))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package common_test
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/xpy123993/yukino-net/libraries/common"
+)
+
+type testCA struct {
+	priv, pub   []byte
+	certificate *x509.Certificate
+	key         *rsa.PrivateKey
+}
+
+func parsePEMCertificate(t *testing.T, data []byte) *x509.Certificate {
+	block, _ := pem.Decode(data)
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate
+}
+
+func createTestCA(t *testing.T) *testCA {
+	priv, pub, _, err := common.GenerateCertificate(common.GenCertOption{DNSName: "test", CertName: "Test CA", IsCA: true, KeyLength: 2048})
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(priv)
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{priv: priv, pub: pub, certificate: parsePEMCertificate(t, pub), key: key}
+}
+
+func (ca *testCA) issue(t *testing.T) tls.Certificate {
+	priv, pub, _, err := common.GenerateCertificate(common.GenCertOption{
+		DNSName: "test", CertName: "test", KeyLength: 2048, CACertificate: *ca.certificate, CAPriv: ca.priv, CAPub: ca.pub,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := tls.X509KeyPair(pub, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate.Leaf = parsePEMCertificate(t, pub)
+	return certificate
+}
+
+func (ca *testCA) writeCRL(t *testing.T, fileName string, revoked ...tls.Certificate) {
+	entries := []pkix.RevokedCertificate{}
+	for _, certificate := range revoked {
+		entries = append(entries, pkix.RevokedCertificate{SerialNumber: certificate.Leaf.SerialNumber, RevocationTime: time.Now()})
+	}
+	data, err := common.CreateCRL(ca.certificate, ca.key, entries, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fileName, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCRLChecker(t *testing.T) {
+	ca := createTestCA(t)
+	revoked, valid := ca.issue(t), ca.issue(t)
+	crlFile := path.Join(t.TempDir(), "ca.crl")
+	ca.writeCRL(t, crlFile, revoked)
+
+	checker, err := common.NewCRLChecker(crlFile, ca.certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checker.IsRevoked(revoked.Leaf.SerialNumber) || checker.IsRevoked(valid.Leaf.SerialNumber) {
+		t.Error("unexpected revocation status")
+	}
+
+	// The CRL file is not checked again within the reload interval.
+	ca.writeCRL(t, crlFile, revoked, valid)
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(crlFile, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if checker.IsRevoked(valid.Leaf.SerialNumber) {
+		t.Error("expect the CRL not to be reloaded within the reload interval")
+	}
+
+	// The CRL is reloaded once modified.
+	checker.SetReloadInterval(0)
+	if !checker.IsRevoked(valid.Leaf.SerialNumber) {
+		t.Error("expect the CRL to be reloaded")
+	}
+
+	// A CRL signed by another CA is rejected, and the previous list stays in effect.
+	createTestCA(t).writeCRL(t, crlFile)
+	if err := os.Chtimes(crlFile, future.Add(time.Minute), future.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := checker.Reload(); err == nil {
+		t.Error("expect a CRL with invalid signature to be rejected")
+	}
+	if !checker.IsRevoked(revoked.Leaf.SerialNumber) {
+		t.Error("expect the previous CRL to stay in effect")
+	}
+	if _, err := common.NewCRLChecker(crlFile, ca.certificate); err == nil {
+		t.Error("expect a CRL with invalid signature to be rejected")
+	}
+}
+
+// tcpPipe returns both ends of a loopback TCP connection.
+func tcpPipe() (net.Conn, net.Conn, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer listener.Close()
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		return nil, nil, err
+	}
+	serverConn, err := listener.Accept()
+	if err != nil {
+		clientConn.Close()
+		return nil, nil, err
+	}
+	return serverConn, clientConn, nil
+}
+
+func handshake(serverCertificate, clientCertificate tls.Certificate, ca *testCA, checker *common.CRLChecker) error {
+	_, err := handshakeWithCache(serverCertificate, clientCertificate, ca, checker, nil)
+	return err
+}
+
+// handshakeWithCache returns whether the session is resumed from `cache`, if not nil.
+func handshakeWithCache(serverCertificate, clientCertificate tls.Certificate, ca *testCA, checker *common.CRLChecker, cache tls.ClientSessionCache) (bool, error) {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.certificate)
+	// net.Pipe is not used as it deadlocks when both sides write at the same time, e.g. on resumption.
+	serverConn, clientConn, err := tcpPipe()
+	if err != nil {
+		return false, err
+	}
+	server := tls.Server(serverConn, &tls.Config{
+		Certificates:     []tls.Certificate{serverCertificate},
+		ClientCAs:        pool,
+		ClientAuth:       tls.RequireAndVerifyClientCert,
+		VerifyConnection: checker.VerifyConnection,
+		// Shared by all servers, so that sessions can be resumed across handshakes.
+		SessionTicketKey: [32]byte{1},
+	})
+	client := tls.Client(clientConn, &tls.Config{
+		Certificates:       []tls.Certificate{clientCertificate},
+		RootCAs:            pool,
+		ServerName:         "test",
+		ClientSessionCache: cache,
+	})
+	resumed := make(chan bool, 1)
+	go func() {
+		if err := client.Handshake(); err == nil {
+			// Session tickets are received after the handshake.
+			client.Read(make([]byte, 1))
+		}
+		resumed <- client.ConnectionState().DidResume
+		clientConn.Close()
+	}()
+	err = server.Handshake()
+	if err == nil {
+		server.Write([]byte{0})
+	}
+	serverConn.Close()
+	return <-resumed, err
+}
+
+func TestCRLVerifyConnection(t *testing.T) {
+	ca := createTestCA(t)
+	server, revoked, valid := ca.issue(t), ca.issue(t), ca.issue(t)
+	crlFile := path.Join(t.TempDir(), "ca.crl")
+	ca.writeCRL(t, crlFile, revoked)
+	checker, err := common.NewCRLChecker(crlFile, ca.certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := handshake(server, valid, ca, checker); err != nil {
+		t.Errorf("expect valid certificates to be accepted: %v", err)
+	}
+	if err := handshake(server, revoked, ca, checker); err == nil {
+		t.Error("expect revoked certificates to be rejected")
+	}
+}
+
+func TestCRLResumedSession(t *testing.T) {
+	ca := createTestCA(t)
+	server, client := ca.issue(t), ca.issue(t)
+	crlFile := path.Join(t.TempDir(), "ca.crl")
+	ca.writeCRL(t, crlFile)
+	checker, err := common.NewCRLChecker(crlFile, ca.certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := tls.NewLRUClientSessionCache(1)
+	if _, err := handshakeWithCache(server, client, ca, checker, cache); err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := handshakeWithCache(server, client, ca, checker, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resumed {
+		t.Fatal("expect the session to be resumed")
+	}
+
+	ca.writeCRL(t, crlFile, client)
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(crlFile, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if err := checker.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handshakeWithCache(server, client, ca, checker, cache); err == nil {
+		t.Error("expect resumed sessions of revoked certificates to be rejected")
+	}
+}
@@ -0,0 +1,159 @@
+package router
+
+import (
+	"log"
+	"time"
+)
+
+// Activator starts and stops on-demand services behind channels.
+type Activator interface {
+	// Activate starts the service serving `channel`. Returns false if `channel` is not an on-demand service.
+	// The router holds dials on `channel` until the service registers or `ActivationTimeout` passes.
+	Activate(channel string) bool
+	// Deactivate stops the service serving `channel`, called once it stays idle for `ActivationIdleTimeout`.
+	Deactivate(channel string)
+}
+
+// activation tracks a service started by the Activator.
+type activation struct {
+	registered chan struct{} // closed once the channel is registered.
+	bridges    int
+	idleTimer  *time.Timer
+}
+
+// waitForActivation activates `channel` if it is an on-demand service and waits until it registers.
+// Returns false if the channel is not activated or does not register in time.
+func (router *Router) waitForActivation(channel string, cancel <-chan struct{}) bool {
+	if router.option.Activator == nil {
+		return false
+	}
+	router.mu.Lock()
+	current, exists := router.activationTable[channel]
+	restart := false
+	if exists {
+		select {
+		case <-current.registered:
+			// The service was activated before but has left, start it again.
+			if current.idleTimer != nil {
+				current.idleTimer.Stop()
+			}
+			current = &activation{registered: make(chan struct{})}
+			router.activationTable[channel] = current
+			exists = false
+			restart = true
+		default:
+		}
+	} else {
+		current = &activation{registered: make(chan struct{})}
+		router.activationTable[channel] = current
+	}
+	router.mu.Unlock()
+
+	if restart {
+		// Stops what is left of the previous service, so that it is not leaked by the new one.
+		log.Printf("deactivating channel `%s` before activating it again", channel)
+		router.option.Activator.Deactivate(channel)
+	}
+	if !exists {
+		log.Printf("activating channel `%s`", channel)
+		if !router.option.Activator.Activate(channel) {
+			router.mu.Lock()
+			delete(router.activationTable, channel)
+			close(current.registered)
+			router.mu.Unlock()
+			return false
+		}
+	}
+
+	timer := time.NewTimer(router.option.ActivationTimeout)
+	defer timer.Stop()
+	select {
+	case <-current.registered:
+		return true
+	case <-timer.C:
+		log.Printf("channel `%s` is not registered within %v after activation", channel, router.option.ActivationTimeout)
+		router.abortActivation(channel, current)
+	case <-cancel:
+	}
+	return false
+}
+
+// abortActivation stops `current` if it is still waiting for `channel` to register, so that the next dial activates it again.
+func (router *Router) abortActivation(channel string, current *activation) {
+	router.mu.Lock()
+	if router.activationTable[channel] != current {
+		router.mu.Unlock()
+		return
+	}
+	select {
+	case <-current.registered:
+		router.mu.Unlock()
+		return
+	default:
+	}
+	// Other dials waiting for `current` time out by themselves.
+	delete(router.activationTable, channel)
+	router.mu.Unlock()
+	router.option.Activator.Deactivate(channel)
+}
+
+// notifyActivation wakes up dials waiting for `channel` and starts counting its idle time.
+// Must be called with `router.mu` held.
+func (router *Router) notifyActivation(channel string) {
+	if current, exists := router.activationTable[channel]; exists {
+		select {
+		case <-current.registered:
+		default:
+			close(current.registered)
+			router.armIdleTimer(channel, current)
+		}
+	}
+}
+
+// acquireActivation marks an activated `channel` as in use, returns nil if `channel` is not activated by the router.
+// Must be called with `router.mu` held.
+func (router *Router) acquireActivation(channel string) *activation {
+	current, exists := router.activationTable[channel]
+	if !exists {
+		return nil
+	}
+	current.bridges++
+	if current.idleTimer != nil {
+		current.idleTimer.Stop()
+	}
+	return current
+}
+
+// releaseActivation marks `current` acquired by acquireActivation as no longer used by a bridge.
+func (router *Router) releaseActivation(channel string, current *activation) {
+	if current == nil {
+		return
+	}
+	router.mu.Lock()
+	defer router.mu.Unlock()
+	current.bridges--
+	if router.activationTable[channel] == current {
+		router.armIdleTimer(channel, current)
+	}
+}
+
+// armIdleTimer schedules deactivation of `channel` if it is idle. Must be called with `router.mu` held.
+func (router *Router) armIdleTimer(channel string, current *activation) {
+	if current.bridges > 0 || router.option.ActivationIdleTimeout <= 0 {
+		return
+	}
+	if current.idleTimer != nil {
+		current.idleTimer.Stop()
+	}
+	current.idleTimer = time.AfterFunc(router.option.ActivationIdleTimeout, func() {
+		router.mu.Lock()
+		if router.activationTable[channel] != current || current.bridges > 0 {
+			router.mu.Unlock()
+			return
+		}
+		delete(router.activationTable, channel)
+		router.mu.Unlock()
+		log.Printf("deactivating idle channel `%s`", channel)
+		router.option.Activator.Deactivate(channel)
+	})
+}
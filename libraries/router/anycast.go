@@ -0,0 +1,90 @@
+package router
+
+import (
+	"math/rand"
+	"net"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/xpy123993/yukino-net/libraries/router/proto"
+)
+
+const (
+	// AnycastOrdered selects the first available candidate in the order they are specified.
+	// Channels matched by the same glob pattern are ordered by name.
+	AnycastOrdered = iota
+	// AnycastRandom selects a random available candidate.
+	AnycastRandom = iota
+)
+
+// anycastCandidates expands the comma separated candidates in `payload` into registered channels that `key` is
+// allowed to invoke from `remoteAddr`, in order of preference.
+// Each candidate is rewritten by the rewrite rules first. As in Dial, a rewritten candidate is checked against
+// the requested name, unless the rule requires the permission on the target.
+func (router *Router) anycastCandidates(payload string, key []byte, remoteAddr net.Addr) []string {
+	router.mu.RLock()
+	registered := make([]string, 0, len(router.receiverTable))
+	for channel := range router.receiverTable {
+		registered = append(registered, channel)
+	}
+	router.mu.RUnlock()
+	sort.Strings(registered)
+
+	candidates := []string{}
+	visited := make(map[string]bool)
+	for _, requested := range strings.Split(payload, ",") {
+		pattern, requireTargetPermission := router.rewriteChannel(requested)
+		checkRequested := pattern != requested && !requireTargetPermission
+		if checkRequested && !router.option.TokenAuthority.CheckPermission(&Frame{Type: proto.Dial, Payload: requested}, key, remoteAddr) {
+			continue
+		}
+		for _, channel := range registered {
+			if matched, err := path.Match(pattern, channel); err != nil || !matched || visited[channel] {
+				continue
+			}
+			// A channel denied as a target can still be allowed through another requested name.
+			if checkRequested || router.option.TokenAuthority.CheckPermission(&Frame{Type: proto.Dial, Payload: channel}, key, remoteAddr) {
+				visited[channel] = true
+				candidates = append(candidates, channel)
+			}
+		}
+	}
+	return candidates
+}
+
+// selectReceiver returns a registered channel among `candidates` according to `strategy`.
+// If there are multiple registered candidates, listeners not responding to a probe are skipped.
+// Returns nil if none of them is available. Must be called without `router.mu` held, as probing takes a round trip.
+func (router *Router) selectReceiver(candidates []string, strategy uint64) (string, *receiver) {
+	available := []string{}
+	router.mu.RLock()
+	for _, channel := range candidates {
+		if _, exists := router.receiverTable[channel]; exists {
+			available = append(available, channel)
+		}
+	}
+	receivers := make([]*receiver, len(available))
+	for i, channel := range available {
+		receivers[i] = router.receiverTable[channel]
+	}
+	router.mu.RUnlock()
+
+	if len(available) == 1 {
+		// Nothing to fall back to, the bridge request will find out if the listener is alive.
+		return available[0], receivers[0]
+	}
+	order := make([]int, len(available))
+	for i := range order {
+		order[i] = i
+	}
+	if strategy == AnycastRandom {
+		rand.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+	}
+	for _, i := range order {
+		if receivers[i].conn.probe() {
+			return available[i], receivers[i]
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,120 @@
+package router
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/xpy123993/yukino-net/libraries/router/proto"
+)
+
+// subscriber stores a receiver of a broadcast channel.
+type subscriber struct {
+	conn     *routerConnection
+	messages chan []byte
+}
+
+// deliver queues `message` to the subscriber following `delivery` semantics.
+func (sub *subscriber) deliver(message []byte, delivery int, timeout time.Duration) {
+	switch delivery {
+	case BlockOnSlowSubscriber:
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case sub.messages <- message:
+		case <-sub.conn.Closed:
+		case <-timer.C:
+			log.Printf("dropping subscriber %s: cannot catch up with the publisher", sub.conn.Connection.RemoteAddr().String())
+			sub.conn.close()
+		}
+	default:
+		select {
+		case sub.messages <- message:
+		default:
+		}
+	}
+}
+
+// handleSubscribe registers the connection as a subscriber of `channel` and forwards all published messages.
+// `expiration` is the deadline of `conn`, which is kept by the connection checker.
+// It is caller's responsibility to close the connection.
+func (router *Router) handleSubscribe(channel string, conn net.Conn, expiration time.Time) error {
+	sub := &subscriber{
+		conn:     newConnWithDeadline(conn, expiration),
+		messages: make(chan []byte, router.option.BroadcastBufferSize),
+	}
+	router.mu.Lock()
+	subscriberID := router.nextConnectionID
+	router.nextConnectionID++
+	if _, exist := router.subscriberTable[channel]; !exist {
+		router.subscriberTable[channel] = make(map[uint64]*subscriber)
+	}
+	router.subscriberTable[channel][subscriberID] = sub
+	router.mu.Unlock()
+
+	defer func() {
+		router.mu.Lock()
+		delete(router.subscriberTable[channel], subscriberID)
+		if len(router.subscriberTable[channel]) == 0 {
+			delete(router.subscriberTable, channel)
+		}
+		router.mu.Unlock()
+	}()
+
+	if err := sub.conn.writeFrame(&nopFrame); err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			select {
+			case message := <-sub.messages:
+				if err := sub.conn.writeMessage(message); err != nil {
+					sub.conn.close()
+					return
+				}
+			case <-sub.conn.Closed:
+				return
+			}
+		}
+	}()
+	sub.conn.SpawnConnectionChecker(router.option.ListenConnectionKeepAlive)
+
+	<-sub.conn.Closed
+	return nil
+}
+
+// handlePublish reads messages from the connection and fans them out to all subscribers of `channel`.
+func (router *Router) handlePublish(channel string, conn net.Conn) error {
+	if err := writeFrame(&nopFrame, conn); err != nil {
+		return err
+	}
+	frame := Frame{}
+	for {
+		if err := readFrame(&frame, conn); err != nil {
+			return err
+		}
+		if frame.Type != proto.Message {
+			continue
+		}
+		message, err := readMessage(conn, router.option.MaxMessageBytes)
+		if err != nil {
+			return writeFrame(&Frame{
+				Type:    proto.Close,
+				Payload: fmt.Sprintf("invalid message: %v", err),
+			}, conn)
+		}
+
+		router.mu.RLock()
+		subscribers := make([]*subscriber, 0, len(router.subscriberTable[channel]))
+		for _, sub := range router.subscriberTable[channel] {
+			subscribers = append(subscribers, sub)
+		}
+		router.mu.RUnlock()
+
+		for _, sub := range subscribers {
+			sub.deliver(message, router.option.BroadcastDelivery, router.option.DialConnectionTimeout)
+		}
+	}
+}
@@ -6,74 +6,205 @@ import (
 	"io"
 	"log"
 	"net"
+	"path"
+	"strings"
 	"sync"
 
+	"github.com/xpy123993/yukino-net/libraries/common"
 	"github.com/xpy123993/yukino-net/libraries/router/proto"
 )
 
+// ClientOption specifies how clients and listeners connect to the Router.
+type ClientOption struct {
+	// If not nil, tls.Dial will be used to connect to the Router.
+	TLSConfig *tls.Config
+	// If not empty, the token will be presented to the Router for authentication.
+	// Used by deployments without client certificates.
+	Token string
+	// If not nil, it will be used to create connections to the Router instead of net.Dial.
+	// TLS, if enabled, is established on top of the returned connection.
+	Dialer func(network, address string) (net.Conn, error)
+}
+
+// DialOption specifies optional information sent along with a dial request.
+type DialOption struct {
+	// TraceID correlates logs of the dial on the dialer, the Router and the listener.
+	// If empty, the Router generates one.
+	TraceID string
+	// Metadata will be available to the listener through `Conn.Metadata`.
+	// The URL encoded metadata must not exceed `MaxChannelNameLength` bytes.
+	Metadata map[string]string
+}
+
+// connectRouter creates a connection to the Router and authenticates with the token in `option` if any.
+func connectRouter(network, address string, option *ClientOption) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	switch {
+	case option.Dialer != nil:
+		conn, err = option.Dialer(network, address)
+		if err == nil && option.TLSConfig != nil {
+			config := option.TLSConfig
+			if len(config.ServerName) == 0 {
+				config = config.Clone()
+				config.ServerName, _, _ = net.SplitHostPort(address)
+			}
+			tlsConn := tls.Client(conn, config)
+			if err = tlsConn.Handshake(); err != nil {
+				conn.Close()
+			}
+			conn = tlsConn
+		}
+	case option.TLSConfig != nil:
+		conn, err = tls.Dial(network, address, option.TLSConfig)
+	default:
+		conn, err = net.Dial(network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(option.Token) > 0 {
+		if err := writeFrame(&Frame{Type: proto.Auth, Payload: option.Token}, conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
 // Client implements a Dial method to join the Router network.
 type Client struct {
 	// The public address of the Router.
 	routerAddress string
-	// If not nil, the client will use tls.Dial to connect to the Router.
-	tlsConfig *tls.Config
+	// Specifies how to connect to the Router.
+	option ClientOption
 }
 
 // NewClientWithoutAuth creates a RouterClient structure.
 func NewClientWithoutAuth(RouterAddress string) *Client {
-	return &Client{
-		routerAddress: RouterAddress,
-	}
+	return NewClientWithOption(RouterAddress, ClientOption{})
 }
 
 // NewClient creates a RouterClient with permision settings.
 func NewClient(RouterAddress string, TLSConfig *tls.Config) *Client {
+	return NewClientWithOption(RouterAddress, ClientOption{TLSConfig: TLSConfig})
+}
+
+// NewClientWithOption creates a RouterClient connecting to the Router with `Option`.
+func NewClientWithOption(RouterAddress string, Option ClientOption) *Client {
 	return &Client{
 		routerAddress: RouterAddress,
-		tlsConfig:     TLSConfig,
+		option:        Option,
 	}
 }
 
+func (client *Client) createConnection() (net.Conn, error) {
+	return connectRouter("tcp", client.routerAddress, &client.option)
+}
+
 // Dial initiaites a dial request into the Route network.
 func (client *Client) Dial(TargetChannel string) (net.Conn, error) {
-	var conn net.Conn
-	var err error
+	return client.DialWithMetadata(TargetChannel, nil)
+}
+
+// DialWithMetadata initiates a dial request carrying `Metadata`, which will be available to the listener through
+// `Conn.Metadata`. The URL encoded metadata must not exceed `MaxChannelNameLength` bytes.
+func (client *Client) DialWithMetadata(TargetChannel string, Metadata map[string]string) (net.Conn, error) {
+	return client.DialWithOption(TargetChannel, DialOption{Metadata: Metadata})
+}
+
+// DialWithOption initiates a dial request with `Option`.
+func (client *Client) DialWithOption(TargetChannel string, Option DialOption) (net.Conn, error) {
+	conn, _, err := client.dial(&Frame{Type: proto.Dial, Payload: TargetChannel}, Option)
+	return conn, err
+}
 
-	if client.tlsConfig != nil {
-		conn, err = tls.Dial("tcp", client.routerAddress, client.tlsConfig)
-	} else {
-		conn, err = net.Dial("tcp", client.routerAddress)
+// DialAnycast connects to any live channel among `Candidates` that the client is allowed to invoke.
+// Candidates can be glob patterns like `backup-*`, `Strategy` can be AnycastOrdered or AnycastRandom.
+// The selection is made by the Router atomically, the selected channel is returned along with the connection.
+func (client *Client) DialAnycast(Candidates []string, Strategy int) (net.Conn, string, error) {
+	return client.DialAnycastWithOption(Candidates, Strategy, DialOption{})
+}
+
+// DialAnycastWithOption is DialAnycast with `Option`, see DialWithOption.
+func (client *Client) DialAnycastWithOption(Candidates []string, Strategy int, Option DialOption) (net.Conn, string, error) {
+	for _, candidate := range Candidates {
+		if len(candidate) == 0 || strings.Contains(candidate, ",") {
+			return nil, "", fmt.Errorf("invalid candidate `%s`", candidate)
+		}
+		if _, err := path.Match(candidate, ""); err != nil {
+			return nil, "", fmt.Errorf("invalid candidate `%s`: %v", candidate, err)
+		}
+	}
+	return client.dial(&Frame{
+		Type:         proto.Anycast,
+		ConnectionID: uint64(Strategy),
+		Payload:      strings.Join(Candidates, ","),
+	}, Option)
+}
+
+// dial sends the dial request `request` and returns the bridged connection with the channel selected by the Router.
+func (client *Client) dial(request *Frame, Option DialOption) (net.Conn, string, error) {
+	if err := validateTraceID(Option.TraceID); err != nil {
+		return nil, "", err
 	}
+	var payload string
+	if len(Option.Metadata) > 0 {
+		var err error
+		if payload, err = encodeMetadata(Option.Metadata); err != nil {
+			return nil, "", err
+		}
+	}
+	conn, err := client.createConnection()
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	if err := writeFrame(&Frame{
-		Type:    proto.Dial,
-		Payload: TargetChannel,
-	}, conn); err != nil {
-		return nil, err
+	if len(Option.TraceID) > 0 {
+		if err := writeFrame(&Frame{Type: proto.Trace, Payload: Option.TraceID}, conn); err != nil {
+			conn.Close()
+			return nil, "", err
+		}
+	}
+	if len(payload) > 0 {
+		if err := writeFrame(&Frame{Type: proto.Metadata, Payload: payload}, conn); err != nil {
+			conn.Close()
+			return nil, "", err
+		}
+	}
+	if err := writeFrame(request, conn); err != nil {
+		conn.Close()
+		return nil, "", err
 	}
 	frame := Frame{}
 	if err := readFrame(&frame, conn); err != nil {
-		return nil, err
+		conn.Close()
+		return nil, "", err
 	}
 	if frame.Type != proto.Bridge {
-		return nil, fmt.Errorf("invalid response")
+		conn.Close()
+		return nil, "", fmt.Errorf("invalid response")
 	}
-	return conn, nil
+	traceID := Option.TraceID
+	if len(traceID) == 0 && frame.ConnectionID != 0 {
+		// Generated by the Router.
+		traceID = formatTraceID(frame.ConnectionID)
+	}
+	return &Conn{Conn: conn, traceID: traceID}, frame.Payload, nil
 }
 
 // Listener implements a net.Listener interface on Router network.
 type Listener struct {
 	routerAddress string
 	channel       string
-	tlsConfig     *tls.Config
+	option        ClientOption
 	acceptorChan  chan net.Conn
 	closedSig     chan struct{}
 
 	mu              sync.Mutex
 	isClosed        bool
 	activeAcceptors int
+	// pendingBridges tracks bridge requests not yet handed to Accept.
+	pendingBridges sync.WaitGroup
 }
 
 // Address represents an address in Router network.
@@ -91,14 +222,61 @@ func (address *Address) String() string {
 	return address.Channel
 }
 
+// Conn is a bridged connection, returned by the dial methods of Client and accepted by a Listener.
+// Use NetConn to reach the connection to the Router, e.g. a *tls.Conn, for type assertions.
+type Conn struct {
+	net.Conn
+	traceID  string
+	metadata map[string]string
+}
+
+// TraceID returns the trace ID of the dial request.
+// On the dialer side, it is empty if not supplied by the dialer and the Router does not return the generated one.
+func (conn *Conn) TraceID() string {
+	return conn.traceID
+}
+
+// Metadata returns the metadata attached by the dialer, the result should not be modified.
+// It is always nil on the dialer side.
+func (conn *Conn) Metadata() map[string]string {
+	return conn.metadata
+}
+
+// NetConn returns the underlying connection to the Router.
+func (conn *Conn) NetConn() net.Conn {
+	return conn.Conn
+}
+
+// CloseWrite shuts down the writing side of the connection.
+func (conn *Conn) CloseWrite() error {
+	return common.CloseWrite(conn.Conn)
+}
+
 // NewRouterListenerWithConn creates a RouterListener structure.
 // Conn here can be a just initialized connectiono from TLS.
 func NewRouterListenerWithConn(
 	RouterAddress string, Channel string, TLSConfig *tls.Config) (*Listener, error) {
+	return NewListenerWithOption(RouterAddress, Channel, ClientOption{TLSConfig: TLSConfig})
+}
+
+// NewListenerWithOption creates a RouterListener connecting to the Router with `Option`.
+func NewListenerWithOption(RouterAddress string, Channel string, Option ClientOption) (*Listener, error) {
+	return newListener(RouterAddress, Channel, Option, proto.Listen)
+}
+
+// NewTakeoverListenerWithOption creates a RouterListener that replaces the active listener of `Channel`.
+// The active listener must be registered with the same identity. New dial requests will be routed to the returned
+// listener, while the previous one finishes its in-flight bridges and closes itself.
+// If `Channel` is not registered, this is the same as `NewListenerWithOption`.
+func NewTakeoverListenerWithOption(RouterAddress string, Channel string, Option ClientOption) (*Listener, error) {
+	return newListener(RouterAddress, Channel, Option, proto.Takeover)
+}
+
+func newListener(RouterAddress string, Channel string, Option ClientOption, requestType byte) (*Listener, error) {
 	routerListener := Listener{
 		routerAddress: RouterAddress,
 		channel:       Channel,
-		tlsConfig:     TLSConfig,
+		option:        Option,
 		acceptorChan:  make(chan net.Conn),
 		closedSig:     make(chan struct{}),
 
@@ -115,7 +293,7 @@ func NewRouterListenerWithConn(
 		log.Printf("CipherSuite: %s", tls.CipherSuiteName(tlsConn.ConnectionState().CipherSuite))
 	}
 	if err := writeFrame(&Frame{
-		Type:    proto.Listen,
+		Type:    requestType,
 		Payload: Channel,
 	}, controlConn); err != nil {
 		controlConn.Close()
@@ -130,10 +308,7 @@ func NewRouterListenerWithConn(
 }
 
 func (listener *Listener) createConnection(network, address string) (net.Conn, error) {
-	if listener.tlsConfig != nil {
-		return tls.Dial(network, address, listener.tlsConfig)
-	}
-	return net.Dial(network, address)
+	return connectRouter(network, address, &listener.option)
 }
 
 // NewListenerWithoutAuth creates a RouterListener structure and try to handshake with Router in `RouterAddress`.
@@ -154,7 +329,6 @@ func (listener *Listener) Close() error {
 		return nil
 	}
 	listener.isClosed = true
-	close(listener.acceptorChan)
 	close(listener.closedSig)
 	return nil
 }
@@ -203,42 +377,271 @@ func (listener *Listener) spawnController(controlConn net.Conn) {
 				return
 			}
 		}
+		if frame.Type == proto.Takeover {
+			log.Printf("channel `%s` is taken over by another listener, draining in-flight requests", listener.channel)
+			listener.pendingBridges.Wait()
+			return
+		}
 		if frame.Type == proto.Bridge && listener.acceptorCount() > 0 {
-			go func(connectionID uint64) {
+			listener.pendingBridges.Add(1)
+			go func(connectionID uint64, traceID string) {
+				defer listener.pendingBridges.Done()
 				conn, err := listener.createConnection("tcp", listener.routerAddress)
 				if err != nil {
-					log.Printf("cannot fork connection request: %v", err)
+					log.Printf("%scannot fork connection request: %v", tracePrefix(traceID), err)
 					listener.Close()
+					return
 				}
 				if err := writeFrame(&Frame{
 					Type:         proto.Bridge,
 					Payload:      listener.channel,
 					ConnectionID: connectionID,
 				}, conn); err != nil {
-					log.Printf("failed to handshake: %v", err)
+					log.Printf("%sfailed to handshake: %v", tracePrefix(traceID), err)
 					conn.Close()
 					return
 				}
 				frame := Frame{}
 				if err := readFrame(&frame, conn); err != nil {
-					log.Printf("failed while finishing handshake: %v", err)
+					log.Printf("%sfailed while finishing handshake: %v", tracePrefix(traceID), err)
+					conn.Close()
+					return
+				}
+				metadata, err := decodeMetadata(frame.Payload)
+				if err != nil {
+					log.Printf("%sinvalid metadata: %v", tracePrefix(traceID), err)
 					conn.Close()
 					return
 				}
-				listener.acceptorChan <- conn
-			}(frame.ConnectionID)
+				select {
+				case listener.acceptorChan <- &Conn{Conn: conn, traceID: traceID, metadata: metadata}:
+				case <-listener.closedSig:
+					conn.Close()
+				}
+			}(frame.ConnectionID, frame.Payload)
 		}
 	}
 }
 
-// Accept returns a bridged connection from a dial request.
+// Accept returns a bridged connection from a dial request, the returned connection is a *Conn.
 func (listener *Listener) Accept() (net.Conn, error) {
 	listener.incAcceptorCount(1)
 	defer listener.incAcceptorCount(-1)
 
-	conn, ok := <-listener.acceptorChan
-	if ok {
+	select {
+	case conn := <-listener.acceptorChan:
 		return conn, nil
+	case <-listener.closedSig:
+		return nil, io.EOF
+	}
+}
+
+// ChannelEvent describes a presence change of a channel on the Router.
+type ChannelEvent struct {
+	// Channel is the name of the channel.
+	Channel string
+	// Registered is true if the channel just came online, false if it went offline.
+	Registered bool
+}
+
+// Watcher receives presence events of channels from the Router.
+type Watcher struct {
+	conn   net.Conn
+	events chan ChannelEvent
+
+	mu  sync.Mutex
+	err error
+}
+
+// Watch subscribes to presence events of all channels matching the regular expression `Pattern`.
+// Only channels the client is allowed to invoke will be reported.
+// Channels already registered are reported first as registered events.
+func (client *Client) Watch(Pattern string) (*Watcher, error) {
+	conn, err := client.createConnection()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFrame(&Frame{
+		Type:    proto.Watch,
+		Payload: Pattern,
+	}, conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := readFrame(&Frame{}, conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	watcher := &Watcher{
+		conn:   conn,
+		events: make(chan ChannelEvent, watchEventBufferSize),
+	}
+	go watcher.spawnReceiver()
+	return watcher, nil
+}
+
+func (watcher *Watcher) spawnReceiver() {
+	defer close(watcher.events)
+	frame := Frame{}
+	for {
+		if err := readFrame(&frame, watcher.conn); err != nil {
+			watcher.mu.Lock()
+			watcher.err = err
+			watcher.mu.Unlock()
+			return
+		}
+		switch frame.Type {
+		case proto.Nop:
+			if err := writeFrame(&nopFrame, watcher.conn); err != nil {
+				watcher.mu.Lock()
+				watcher.err = err
+				watcher.mu.Unlock()
+				return
+			}
+		case proto.Registered, proto.Unregistered:
+			watcher.events <- ChannelEvent{
+				Channel:    frame.Payload,
+				Registered: frame.Type == proto.Registered,
+			}
+		}
+	}
+}
+
+// Next blocks until the next event arrives. Returns an error once the watch is terminated.
+func (watcher *Watcher) Next() (*ChannelEvent, error) {
+	event, ok := <-watcher.events
+	if ok {
+		return &event, nil
+	}
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+	if watcher.err != nil {
+		return nil, watcher.err
 	}
 	return nil, io.EOF
 }
+
+// Close terminates the watch.
+func (watcher *Watcher) Close() error {
+	return watcher.conn.Close()
+}
+
+// Publisher sends messages to all subscribers of a broadcast channel.
+type Publisher struct {
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// Publish creates a publisher on the broadcast channel `Channel`.
+func (client *Client) Publish(Channel string) (*Publisher, error) {
+	conn, err := client.createConnection()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFrame(&Frame{
+		Type:    proto.Publish,
+		Payload: Channel,
+	}, conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := readFrame(&Frame{}, conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Publisher{conn: conn}, nil
+}
+
+// Send broadcasts `message` to all current subscribers.
+// Delivery is best effort, subject to the delivery semantics configured on the Router.
+func (publisher *Publisher) Send(message []byte) error {
+	publisher.mu.Lock()
+	defer publisher.mu.Unlock()
+	if err := writeFrame(&messageFrame, publisher.conn); err != nil {
+		return err
+	}
+	return writeMessage(message, publisher.conn)
+}
+
+// Close closes the publisher.
+func (publisher *Publisher) Close() error {
+	return publisher.conn.Close()
+}
+
+// Subscriber receives messages from a broadcast channel.
+type Subscriber struct {
+	conn     net.Conn
+	messages chan []byte
+
+	mu  sync.Mutex
+	err error
+}
+
+// Subscribe joins the broadcast channel `Channel`.
+func (client *Client) Subscribe(Channel string) (*Subscriber, error) {
+	conn, err := client.createConnection()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFrame(&Frame{
+		Type:    proto.Subscribe,
+		Payload: Channel,
+	}, conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := readFrame(&Frame{}, conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	subscriber := &Subscriber{
+		conn:     conn,
+		messages: make(chan []byte, DefaultBroadcastBufferSize),
+	}
+	go subscriber.spawnReceiver()
+	return subscriber, nil
+}
+
+func (subscriber *Subscriber) spawnReceiver() {
+	defer close(subscriber.messages)
+	frame := Frame{}
+	for {
+		err := readFrame(&frame, subscriber.conn)
+		if err == nil {
+			switch frame.Type {
+			case proto.Nop:
+				err = writeFrame(&nopFrame, subscriber.conn)
+			case proto.Message:
+				var message []byte
+				if message, err = readMessage(subscriber.conn, 0); err == nil {
+					subscriber.messages <- message
+				}
+			}
+		}
+		if err != nil {
+			subscriber.mu.Lock()
+			subscriber.err = err
+			subscriber.mu.Unlock()
+			return
+		}
+	}
+}
+
+// Receive blocks until the next message arrives. Returns an error once the subscription is terminated.
+func (subscriber *Subscriber) Receive() ([]byte, error) {
+	message, ok := <-subscriber.messages
+	if ok {
+		return message, nil
+	}
+	subscriber.mu.Lock()
+	defer subscriber.mu.Unlock()
+	if subscriber.err != nil {
+		return nil, subscriber.err
+	}
+	return nil, io.EOF
+}
+
+// Close terminates the subscription.
+func (subscriber *Subscriber) Close() error {
+	return subscriber.conn.Close()
+}
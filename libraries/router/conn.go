@@ -11,6 +11,10 @@ import (
 type routerConnection struct {
 	mu         sync.Mutex
 	Connection net.Conn
+	// probeMu serializes probes, so that each of them reads its own reply.
+	probeMu sync.Mutex
+	// deadline is the deadline of Connection outside of probes, zero means none.
+	deadline time.Time
 
 	isclosed bool
 	// Closed is a signal indicates this connection is ready to be GCed.
@@ -38,6 +42,19 @@ func (conn *routerConnection) writeFrame(frame *Frame) error {
 	return writeFrame(frame, conn.Connection)
 }
 
+// writeMessage writes a Message frame followed by `message` as a whole.
+func (conn *routerConnection) writeMessage(message []byte) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.isclosed {
+		return fmt.Errorf("connection is already closed")
+	}
+	if err := writeFrame(&messageFrame, conn.Connection); err != nil {
+		return err
+	}
+	return writeMessage(message, conn.Connection)
+}
+
 func newConn(conn net.Conn) *routerConnection {
 	return &routerConnection{
 		mu:         sync.Mutex{},
@@ -47,10 +64,25 @@ func newConn(conn net.Conn) *routerConnection {
 	}
 }
 
+// newConnWithDeadline wraps `conn` whose deadline is set to `deadline`, which is restored after each probe.
+func newConnWithDeadline(conn net.Conn, deadline time.Time) *routerConnection {
+	result := newConn(conn)
+	result.deadline = deadline
+	return result
+}
+
 // probe returns whether the connection is healthy.
+// It can be called concurrently, e.g. by the connection checker and anycast.
 func (conn *routerConnection) probe() bool {
-	conn.Connection.SetDeadline(time.Now().Add(DefaultDialConnectionTimeout))
-	defer conn.Connection.SetDeadline(time.Time{})
+	conn.probeMu.Lock()
+	defer conn.probeMu.Unlock()
+	// A probe never extends the connection beyond its deadline.
+	deadline := time.Now().Add(DefaultDialConnectionTimeout)
+	if !conn.deadline.IsZero() && conn.deadline.Before(deadline) {
+		deadline = conn.deadline
+	}
+	conn.Connection.SetDeadline(deadline)
+	defer conn.Connection.SetDeadline(conn.deadline)
 	if err := conn.writeFrame(&nopFrame); err != nil {
 		return false
 	}
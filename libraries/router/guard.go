@@ -0,0 +1,101 @@
+package router
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// guardSweepInterval is the interval to drop records of inactive addresses.
+	guardSweepInterval = time.Minute
+	// guardRecordTTL is how long the record of an inactive address is kept.
+	guardRecordTTL = 10 * time.Minute
+)
+
+// addressRecord tracks the connection rate and authentication failures of a remote IP.
+type addressRecord struct {
+	limiter     *rate.Limiter
+	failures    int
+	bannedUntil time.Time
+	lastSeen    time.Time
+}
+
+// connectionGuard limits connections by remote IP.
+type connectionGuard struct {
+	mu        sync.Mutex
+	records   map[string]*addressRecord
+	lastSweep time.Time
+}
+
+// lookupRecord returns the record of `ip`, creating one if not exists. Must be called with `guard.mu` held.
+func (router *Router) lookupRecord(ip net.IP) *addressRecord {
+	guard := &router.guard
+	now := time.Now()
+	if now.Sub(guard.lastSweep) > guardSweepInterval {
+		for address, record := range guard.records {
+			if now.Sub(record.lastSeen) > guardRecordTTL && now.After(record.bannedUntil) {
+				delete(guard.records, address)
+			}
+		}
+		guard.lastSweep = now
+	}
+	record, exists := guard.records[ip.String()]
+	if !exists {
+		record = &addressRecord{}
+		if router.option.AcceptRatePerIP > 0 {
+			record.limiter = rate.NewLimiter(rate.Limit(router.option.AcceptRatePerIP), router.option.AcceptBurstPerIP)
+		}
+		guard.records[ip.String()] = record
+	}
+	record.lastSeen = now
+	return record
+}
+
+// allowConnection returns false if `ip` is banned or exceeds the accept rate.
+func (router *Router) allowConnection(ip net.IP) bool {
+	if ip == nil || (router.option.AcceptRatePerIP <= 0 && router.option.AuthFailureLimit <= 0) {
+		return true
+	}
+	router.guard.mu.Lock()
+	defer router.guard.mu.Unlock()
+	record := router.lookupRecord(ip)
+	if time.Now().Before(record.bannedUntil) {
+		return false
+	}
+	return record.limiter == nil || record.limiter.Allow()
+}
+
+// isCredentialError returns whether the TLS handshake error `err` is caused by the credential of the peer, e.g. an
+// untrusted or revoked certificate, rather than the connection being closed, timed out or not speaking TLS.
+func isCredentialError(err error) bool {
+	var opErr *net.OpError
+	var recordErr tls.RecordHeaderError
+	return !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.As(err, &opErr) && !errors.As(err, &recordErr)
+}
+
+// recordAuthResult bans `ip` for `AuthFailureBanDuration` after `AuthFailureLimit` consecutive failures.
+func (router *Router) recordAuthResult(ip net.IP, succeeded bool) {
+	if ip == nil || router.option.AuthFailureLimit <= 0 {
+		return
+	}
+	router.guard.mu.Lock()
+	defer router.guard.mu.Unlock()
+	record := router.lookupRecord(ip)
+	if succeeded {
+		record.failures = 0
+		return
+	}
+	record.failures++
+	if record.failures >= router.option.AuthFailureLimit {
+		log.Printf("banning address %s for %v after %d authentication failures", ip.String(), router.option.AuthFailureBanDuration, record.failures)
+		record.bannedUntil = time.Now().Add(router.option.AuthFailureBanDuration)
+		record.failures = 0
+	}
+}
@@ -0,0 +1,149 @@
+package keystore
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltKeysBucket  = []byte("keys")
+	boltRolesBucket = []byte("roles")
+)
+
+// boltOpenTimeout is how long to wait for other processes holding the database.
+const boltOpenTimeout = 10 * time.Second
+
+// boltStorage stores each key and role as a separate entry of a bbolt database, so that updates only write the
+// changed entries. The database is opened for each transaction, so that the router and CLI writers can share it.
+type boltStorage struct {
+	fileName string
+}
+
+// NewBoltStorage returns a Storage in the bbolt database `FileName`, the file is created if not exists.
+func NewBoltStorage(FileName string) Storage {
+	return &boltStorage{fileName: FileName}
+}
+
+func (storage *boltStorage) open(readOnly bool) (*bolt.DB, error) {
+	return bolt.Open(storage.fileName, 0600, &bolt.Options{Timeout: boltOpenTimeout, ReadOnly: readOnly})
+}
+
+func (storage *boltStorage) View(fn func(tx StorageTx) error) error {
+	if _, err := os.Stat(storage.fileName); err != nil {
+		return err
+	}
+	db, err := storage.open(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (storage *boltStorage) Update(fn func(tx StorageTx) error) error {
+	db, err := storage.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltKeysBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(boltRolesBucket); err != nil {
+			return err
+		}
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (tx *boltTx) get(bucket []byte, name string, value interface{}) (bool, error) {
+	b := tx.tx.Bucket(bucket)
+	if b == nil {
+		return false, nil
+	}
+	data := b.Get([]byte(name))
+	if data == nil {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, value)
+}
+
+func (tx *boltTx) put(bucket []byte, name string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return tx.tx.Bucket(bucket).Put([]byte(name), data)
+}
+
+func (tx *boltTx) forEach(bucket []byte, fn func(name string, data []byte) error) error {
+	b := tx.tx.Bucket(bucket)
+	if b == nil {
+		return nil
+	}
+	return b.ForEach(func(k, v []byte) error {
+		return fn(string(k), v)
+	})
+}
+
+func (tx *boltTx) GetKey(hashKey string) (*SessionKey, error) {
+	property := &SessionKey{}
+	if found, err := tx.get(boltKeysBucket, hashKey, property); !found || err != nil {
+		return nil, err
+	}
+	return property, nil
+}
+
+func (tx *boltTx) PutKey(hashKey string, property *SessionKey) error {
+	return tx.put(boltKeysBucket, hashKey, property)
+}
+
+func (tx *boltTx) DeleteKey(hashKey string) error {
+	return tx.tx.Bucket(boltKeysBucket).Delete([]byte(hashKey))
+}
+
+func (tx *boltTx) ForEachKey(fn func(hashKey string, property *SessionKey) error) error {
+	return tx.forEach(boltKeysBucket, func(name string, data []byte) error {
+		property := &SessionKey{}
+		if err := json.Unmarshal(data, property); err != nil {
+			return err
+		}
+		return fn(name, property)
+	})
+}
+
+func (tx *boltTx) GetRole(name string) (*Role, error) {
+	role := &Role{}
+	if found, err := tx.get(boltRolesBucket, name, role); !found || err != nil {
+		return nil, err
+	}
+	return role, nil
+}
+
+func (tx *boltTx) PutRole(name string, role *Role) error {
+	return tx.put(boltRolesBucket, name, role)
+}
+
+func (tx *boltTx) DeleteRole(name string) error {
+	return tx.tx.Bucket(boltRolesBucket).Delete([]byte(name))
+}
+
+func (tx *boltTx) ForEachRole(fn func(name string, role *Role) error) error {
+	return tx.forEach(boltRolesBucket, func(name string, data []byte) error {
+		role := &Role{}
+		if err := json.Unmarshal(data, role); err != nil {
+			return err
+		}
+		return fn(name, role)
+	})
+}
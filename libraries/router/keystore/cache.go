@@ -0,0 +1,68 @@
+package keystore
+
+import (
+	"container/list"
+	"sync"
+)
+
+type decisionKey struct {
+	action  int
+	channel string
+}
+
+type decisionEntry struct {
+	key     decisionKey
+	allowed bool
+}
+
+// decisionCache is a LRU cache of rule evaluation results of a key.
+// Each key owns its cache, so that lookups of different keys never contend and a change of a key drops only its decisions.
+type decisionCache struct {
+	mu      sync.Mutex
+	entries map[decisionKey]*list.Element
+	order   *list.List // most recently used first.
+}
+
+func newDecisionCache() *decisionCache {
+	return &decisionCache{
+		entries: make(map[decisionKey]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// get returns the cached decision of `key`.
+func (cache *decisionCache) get(key decisionKey) (allowed bool, cached bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	element, ok := cache.entries[key]
+	if !ok {
+		return false, false
+	}
+	cache.order.MoveToFront(element)
+	return element.Value.(*decisionEntry).allowed, true
+}
+
+// put caches the decision of `key`, evicting the least recently used decisions beyond `capacity`.
+func (cache *decisionCache) put(key decisionKey, allowed bool, capacity int) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if element, ok := cache.entries[key]; ok {
+		element.Value.(*decisionEntry).allowed = allowed
+		cache.order.MoveToFront(element)
+		return
+	}
+	cache.entries[key] = cache.order.PushFront(&decisionEntry{key: key, allowed: allowed})
+	for cache.order.Len() > capacity {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*decisionEntry).key)
+	}
+}
+
+// clear drops all cached decisions.
+func (cache *decisionCache) clear() {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.entries = make(map[decisionKey]*list.Element)
+	cache.order.Init()
+}
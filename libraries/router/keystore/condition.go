@@ -0,0 +1,144 @@
+package keystore
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/xpy123993/yukino-net/libraries/common"
+)
+
+// TimeWindow restricts a rule to a daily time range.
+// Windows are only checked when a request is authorized, e.g. when a connection dials or listens on a channel.
+// Bridges and listeners established within a window are not closed when it ends.
+type TimeWindow struct {
+	// Days of the week in short English names, e.g. ["mon", "tue"]. Empty means every day.
+	// For windows crossing midnight, the day is the one on which the window starts.
+	Days []string `json:"days,omitempty"`
+	// Start of the window in the format of "15:04", inclusive.
+	Start string `json:"start"`
+	// End of the window in the format of "15:04", exclusive. Windows with `End` before `Start` cross midnight.
+	End string `json:"end"`
+	// IANA time zone name of `Start` and `End`, e.g. "America/New_York". Empty means the local time zone of the router.
+	TimeZone string `json:"time_zone,omitempty"`
+}
+
+// RequestContext carries the properties of a request used by rule conditions.
+type RequestContext struct {
+	// IP address of the connection making the request.
+	RemoteIP net.IP
+	// Time of the request, zero means now.
+	Time time.Time
+}
+
+type compiledWindow struct {
+	days     [7]bool
+	start    time.Duration
+	end      time.Duration
+	location *time.Location
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expect HH:MM", value)
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+func compileWindow(window TimeWindow) (compiledWindow, error) {
+	result := compiledWindow{location: time.Local}
+	var err error
+	if result.start, err = parseTimeOfDay(window.Start); err != nil {
+		return result, err
+	}
+	if result.end, err = parseTimeOfDay(window.End); err != nil {
+		return result, err
+	}
+	if len(window.TimeZone) > 0 {
+		if result.location, err = time.LoadLocation(window.TimeZone); err != nil {
+			return result, fmt.Errorf("invalid time zone %q: %v", window.TimeZone, err)
+		}
+	}
+	if len(window.Days) == 0 {
+		for i := range result.days {
+			result.days[i] = true
+		}
+	}
+	for _, day := range window.Days {
+		weekday, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return result, fmt.Errorf("invalid day %q, expect one of sun, mon, tue, wed, thu, fri, sat", day)
+		}
+		result.days[weekday] = true
+	}
+	return result, nil
+}
+
+func (window *compiledWindow) contains(now time.Time) bool {
+	now = now.In(window.location)
+	offset := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute + time.Duration(now.Second())*time.Second
+	if window.start <= window.end {
+		return window.days[now.Weekday()] && offset >= window.start && offset < window.end
+	}
+	if offset >= window.start {
+		return window.days[now.Weekday()]
+	}
+	// The window started on the previous day.
+	return offset < window.end && window.days[(now.Weekday()+6)%7]
+}
+
+// compileConditions validates and compiles the conditions of `rule` into `compiled`.
+func compileConditions(compiled *compiledRule, rule ACLRule) error {
+	sources, err := common.ParseCIDRs(rule.SourceCIDRs)
+	if err != nil {
+		return fmt.Errorf("invalid source of rule %q: %v", rule.ChannelRegexp, err)
+	}
+	compiled.sources = sources
+	for _, window := range rule.TimeWindows {
+		result, err := compileWindow(window)
+		if err != nil {
+			return fmt.Errorf("invalid time window of rule %q: %v", rule.ChannelRegexp, err)
+		}
+		compiled.windows = append(compiled.windows, result)
+	}
+	return nil
+}
+
+// conditional returns whether the rule has conditions other than the channel.
+func (rule *compiledRule) conditional() bool {
+	return len(rule.sources) > 0 || len(rule.windows) > 0
+}
+
+// satisfied returns whether the conditions of the rule hold for a request of `requestType` described by `context`.
+// If the remote address is unknown, source conditions fail closed: they hold for rules denying `requestType` only.
+func (rule *compiledRule) satisfied(requestType int, context *RequestContext) bool {
+	if len(rule.sources) > 0 {
+		if context.RemoteIP == nil {
+			if rule.control(requestType) != Deny {
+				return false
+			}
+		} else if !common.ContainsIP(rule.sources, context.RemoteIP) {
+			return false
+		}
+	}
+	if len(rule.windows) == 0 {
+		return true
+	}
+	now := context.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+	for i := range rule.windows {
+		if rule.windows[i].contains(now) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,152 @@
+package keystore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// encryptedFormat identifies an encrypted KeyStore file and its algorithms.
+const encryptedFormat = "yukino-net/keystore/argon2id-aes256gcm/v1"
+
+// ErrLocked is returned when loading an encrypted KeyStore without a secret.
+var ErrLocked = errors.New("the key store is encrypted, a secret is required to unlock it")
+
+// ErrNotEncrypted is returned when loading an unencrypted KeyStore with a secret.
+var ErrNotEncrypted = errors.New("the key store is not encrypted, but a secret is given")
+
+const (
+	// Upper bounds of the argon2id parameters read from an encrypted KeyStore, so that a crafted file cannot
+	// exhaust the CPU or memory of the reader.
+	maxArgon2Time   = 16
+	maxArgon2Memory = 1024 * 1024 // In KiB.
+	maxArgon2Thread = 64
+)
+
+// encryptedKeyStore is the on-disk envelope of an encrypted KeyStore.
+type encryptedKeyStore struct {
+	Format string `json:"format"`
+	// Parameters of argon2id to derive the encryption key from the secret.
+	Salt    []byte `json:"salt"`
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+	// AES-256-GCM nonce and the sealed KeyStore in JSON.
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func (envelope *encryptedKeyStore) aead(secret []byte) (cipher.AEAD, error) {
+	if envelope.Time == 0 || envelope.Time > maxArgon2Time {
+		return nil, fmt.Errorf("invalid argon2 time %d in the key store, expect 1 to %d", envelope.Time, maxArgon2Time)
+	}
+	if envelope.Threads == 0 || envelope.Threads > maxArgon2Thread {
+		return nil, fmt.Errorf("invalid argon2 threads %d in the key store, expect 1 to %d", envelope.Threads, maxArgon2Thread)
+	}
+	if envelope.Memory == 0 || envelope.Memory > maxArgon2Memory {
+		return nil, fmt.Errorf("invalid argon2 memory %d KiB in the key store, expect at most %d KiB", envelope.Memory, maxArgon2Memory)
+	}
+	block, err := aes.NewCipher(argon2.IDKey(secret, envelope.Salt, envelope.Time, envelope.Memory, envelope.Threads, 32))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptKeyStore(data []byte, secret []byte) ([]byte, error) {
+	envelope := encryptedKeyStore{
+		Format:  encryptedFormat,
+		Salt:    make([]byte, 16),
+		Time:    1,
+		Memory:  64 * 1024,
+		Threads: 4,
+	}
+	if _, err := rand.Read(envelope.Salt); err != nil {
+		return nil, err
+	}
+	aead, err := envelope.aead(secret)
+	if err != nil {
+		return nil, err
+	}
+	envelope.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(envelope.Nonce); err != nil {
+		return nil, err
+	}
+	envelope.Ciphertext = aead.Seal(nil, envelope.Nonce, data, []byte(envelope.Format))
+	return json.MarshalIndent(envelope, "", "    ")
+}
+
+// decryptKeyStore returns the plain KeyStore in `data`.
+// Unencrypted data is returned as is if `secret` is nil, or rejected with ErrNotEncrypted otherwise.
+func decryptKeyStore(data []byte, secret []byte) ([]byte, bool, error) {
+	envelope := encryptedKeyStore{}
+	if err := json.Unmarshal(data, &envelope); err != nil || envelope.Format != encryptedFormat {
+		if secret != nil {
+			return nil, false, ErrNotEncrypted
+		}
+		return data, false, nil
+	}
+	if secret == nil {
+		return nil, true, ErrLocked
+	}
+	aead, err := envelope.aead(secret)
+	if err != nil {
+		return nil, true, err
+	}
+	if len(envelope.Nonce) != aead.NonceSize() {
+		return nil, true, fmt.Errorf("invalid nonce in the key store")
+	}
+	plaintext, err := aead.Open(nil, envelope.Nonce, envelope.Ciphertext, []byte(envelope.Format))
+	if err != nil {
+		return nil, true, fmt.Errorf("cannot decrypt the key store: wrong secret or corrupted file")
+	}
+	return plaintext, true, nil
+}
+
+// IsEncrypted returns whether the KeyStore file `FileName` is encrypted.
+func IsEncrypted(FileName string) (bool, error) {
+	data, err := os.ReadFile(FileName)
+	if err != nil {
+		return false, err
+	}
+	_, encrypted, _ := decryptKeyStore(data, nil)
+	return encrypted, nil
+}
+
+// SetSecret sets the secret to encrypt the KeyStore on Save. A nil secret disables the encryption.
+func (store *KeyStore) SetSecret(secret []byte) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.secret = secret
+}
+
+// writeFileAtomic replaces `FileName` with `data` so that readers never observe a partially written file.
+func writeFileAtomic(FileName string, data []byte, perm os.FileMode) error {
+	file, err := os.CreateTemp(filepath.Dir(FileName), filepath.Base(FileName)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(file.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), FileName)
+}
@@ -0,0 +1,157 @@
+package keystore_test
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"runtime"
+	"testing"
+
+	"github.com/xpy123993/yukino-net/libraries/router/keystore"
+)
+
+func TestEncryptedKeyStore(t *testing.T) {
+	key, keyStore := initializeKeyStoreWithUnExpiredKey(keystore.Allow, keystore.Deny, "secret-channel")
+	configFile := path.Join(t.TempDir(), "auth.json")
+	keyStore.SetSecret([]byte("passphrase"))
+	if err := keyStore.Save(configFile); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret-channel")) {
+		t.Error("the key store is saved in plain text")
+	}
+	if encrypted, err := keystore.IsEncrypted(configFile); err != nil || !encrypted {
+		t.Errorf("expect the key store to be encrypted: %v", err)
+	}
+
+	if _, err := keystore.LoadKeyStore(configFile); err != keystore.ErrLocked {
+		t.Errorf("expect ErrLocked, got %v", err)
+	}
+	if _, err := keystore.LoadKeyStoreWithSecret(configFile, []byte("wrong")); err == nil {
+		t.Error("expect an error with a wrong secret")
+	}
+	loadedKeyStore, err := keystore.LoadKeyStoreWithSecret(configFile, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkPermission(loadedKeyStore, key, "secret-channel", true, false); err != nil {
+		t.Error(err)
+	}
+
+	// The loaded KeyStore keeps the encryption on Save.
+	if err := loadedKeyStore.Save(configFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keystore.LoadKeyStore(configFile); err != keystore.ErrLocked {
+		t.Errorf("expect ErrLocked after saving again, got %v", err)
+	}
+}
+
+func TestEncryptedKeyStoreTampered(t *testing.T) {
+	_, keyStore := initializeKeyStoreWithUnExpiredKey(keystore.Allow, keystore.Deny, "test")
+	configFile := path.Join(t.TempDir(), "auth.json")
+	keyStore.SetSecret([]byte("passphrase"))
+	if err := keyStore.Save(configFile); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flips a character inside the base64 encoded ciphertext.
+	index := bytes.Index(data, []byte(`"ciphertext": "`)) + len(`"ciphertext": "`) + 8
+	if data[index] == 'A' {
+		data[index] = 'B'
+	} else {
+		data[index] = 'A'
+	}
+	if err := os.WriteFile(configFile, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keystore.LoadKeyStoreWithSecret(configFile, []byte("passphrase")); err == nil {
+		t.Error("expect tampered key store to be rejected")
+	}
+}
+
+func TestSavePermission(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not supported on windows")
+	}
+	_, keyStore := initializeKeyStoreWithUnExpiredKey(keystore.Allow, keystore.Deny, "test")
+	configFile := path.Join(t.TempDir(), "auth.json")
+	if err := os.WriteFile(configFile, []byte("{}"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyStore.Save(configFile); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode().Perm() != 0600 {
+		t.Errorf("expect mode 0600, got %v", stat.Mode().Perm())
+	}
+	entries, err := os.ReadDir(path.Dir(configFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expect no temporary files left, got %d entries", len(entries))
+	}
+}
+
+func TestEncryptedKeyStoreRejectsPlaintext(t *testing.T) {
+	_, keyStore := initializeKeyStoreWithUnExpiredKey(keystore.Allow, keystore.Deny, "test")
+	configFile := path.Join(t.TempDir(), "auth.json")
+	if err := keyStore.Save(configFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keystore.LoadKeyStoreWithSecret(configFile, []byte("passphrase")); err != keystore.ErrNotEncrypted {
+		t.Errorf("expect ErrNotEncrypted, got %v", err)
+	}
+	if _, err := keystore.OpenKeyStore(keystore.NewFileStorage(configFile, []byte("passphrase"))); err != keystore.ErrNotEncrypted {
+		t.Errorf("expect ErrNotEncrypted, got %v", err)
+	}
+
+	// New files are created encrypted.
+	newFile := path.Join(t.TempDir(), "new.json")
+	if err := keystore.NewFileStorage(newFile, []byte("passphrase")).Update(func(tx keystore.StorageTx) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if encrypted, err := keystore.IsEncrypted(newFile); err != nil || !encrypted {
+		t.Errorf("expect the new file to be encrypted: %v", err)
+	}
+}
+
+func TestEncryptedKeyStoreInvalidParameters(t *testing.T) {
+	_, keyStore := initializeKeyStoreWithUnExpiredKey(keystore.Allow, keystore.Deny, "test")
+	configFile := path.Join(t.TempDir(), "auth.json")
+	keyStore.SetSecret([]byte("passphrase"))
+	if err := keyStore.Save(configFile); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, testCase := range []struct{ from, to string }{
+		{`"time": 1`, `"time": 0`},
+		{`"threads": 4`, `"threads": 0`},
+		{`"memory": 65536`, `"memory": 4294967295`},
+	} {
+		if !bytes.Contains(data, []byte(testCase.from)) {
+			t.Fatalf("%s not found in the key store", testCase.from)
+		}
+		if err := os.WriteFile(configFile, bytes.Replace(data, []byte(testCase.from), []byte(testCase.to), 1), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := keystore.LoadKeyStoreWithSecret(configFile, []byte("passphrase")); err == nil {
+			t.Errorf("expect %s to be rejected", testCase.to)
+		}
+	}
+}
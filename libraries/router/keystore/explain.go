@@ -0,0 +1,191 @@
+package keystore
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var actionNames = map[int]string{
+	InvokeAction:    "invoke",
+	ListenAction:    "listen",
+	PublishAction:   "publish",
+	SubscribeAction: "subscribe",
+}
+
+// ActionName returns the name of `action`, e.g. "invoke" for InvokeAction.
+func ActionName(action int) string {
+	if name, ok := actionNames[action]; ok {
+		return name
+	}
+	return fmt.Sprintf("action(%d)", action)
+}
+
+// ParseAction returns the action named `name`, one of invoke, listen, publish and subscribe.
+func ParseAction(name string) (int, error) {
+	for action, actionName := range actionNames {
+		if actionName == name {
+			return action, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid action %q, expect invoke, listen, publish or subscribe", name)
+}
+
+// controlName returns the name of an ACL control, or an empty string for UndefinedACL.
+func controlName(control int) string {
+	switch control {
+	case Allow:
+		return "allow"
+	case Deny:
+		return "deny"
+	}
+	return ""
+}
+
+// RuleTrace is the evaluation of an effective rule of a key, see Decision.
+type RuleTrace struct {
+	// Name of the role defining this rule, empty for rules of the key itself.
+	Role string `json:"role,omitempty"`
+	// Index of this rule within the rules of the role or the key.
+	Index         int    `json:"index"`
+	ChannelRegexp string `json:"channel_regexp"`
+	// Whether the channel matches `ChannelRegexp`.
+	ChannelMatched bool `json:"channel_matched"`
+	// Whether the source and time window conditions hold, only evaluated if the channel matches.
+	ConditionsMet bool `json:"conditions_met"`
+	// Control of this rule on the action if it matches: "allow", "deny", or empty if undefined.
+	Control string `json:"control,omitempty"`
+	// Whether this rule decides the result.
+	Decisive bool `json:"decisive,omitempty"`
+}
+
+func (trace *RuleTrace) source() string {
+	if len(trace.Role) > 0 {
+		return fmt.Sprintf("rule #%d of role %s", trace.Index, trace.Role)
+	}
+	return fmt.Sprintf("rule #%d of the key", trace.Index)
+}
+
+// Decision is the trace of a permission check returned by Explain.
+type Decision struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason"`
+	Action  string `json:"action"`
+	Channel string `json:"channel"`
+	// Hashed key of the request, see HashKey.
+	Key string `json:"key"`
+	// ID and expiration time of the key, empty if not registered.
+	ID     string    `json:"id,omitempty"`
+	Expire time.Time `json:"expire"`
+	// Effective rules of the key in evaluation order.
+	Rules []RuleTrace `json:"rules,omitempty"`
+}
+
+// String returns the decision in one line, including the rules matching the request.
+func (decision *Decision) String() string {
+	result := "denied"
+	if decision.Allowed {
+		result = "allowed"
+	}
+	key := decision.Key
+	if len(decision.ID) > 0 {
+		key = decision.ID
+	}
+	matched := []string{}
+	for i := range decision.Rules {
+		if trace := &decision.Rules[i]; trace.ChannelMatched && trace.ConditionsMet {
+			matched = append(matched, trace.source())
+		}
+	}
+	if len(matched) == 0 {
+		return fmt.Sprintf("%s %s on %q for key %s: %s", result, decision.Action, decision.Channel, key, decision.Reason)
+	}
+	return fmt.Sprintf("%s %s on %q for key %s: %s, matched %s", result, decision.Action, decision.Channel, key, decision.Reason, strings.Join(matched, ", "))
+}
+
+// Explain evaluates the permission of `key` like CheckPermissionWithContext, and returns how the decision is made.
+// It is much slower than CheckPermissionWithContext as no cache is used, intended for debugging.
+func (store *KeyStore) Explain(requestType int, channelName string, key []byte, context RequestContext) *Decision {
+	hashKey := HashKey(key)
+	decision := &Decision{Action: ActionName(requestType), Channel: channelName, Key: hashKey}
+	store.mu.RLock()
+	property, ok := store.Table[hashKey]
+	if ok {
+		tmp := *property
+		property = &tmp
+	}
+	store.mu.RUnlock()
+	if !ok {
+		decision.Reason = "key is not registered"
+		return decision
+	}
+	decision.ID, decision.Expire = property.ID, property.Expire
+
+	rules := property.compiled
+	for i := range rules {
+		rule := &rules[i]
+		trace := RuleTrace{
+			Role:           rule.role,
+			Index:          rule.index,
+			ChannelRegexp:  rule.ChannelRegexp,
+			ChannelMatched: rule.matcher.MatchString(channelName),
+		}
+		if trace.ChannelMatched {
+			trace.ConditionsMet = rule.satisfied(requestType, &context)
+		}
+		if trace.ChannelMatched && trace.ConditionsMet {
+			trace.Control = controlName(rule.control(requestType))
+		}
+		decision.Rules = append(decision.Rules, trace)
+	}
+
+	if time.Now().After(property.Expire) {
+		decision.Reason = fmt.Sprintf("key expired at %s", property.Expire.Format(time.RFC3339))
+		return decision
+	}
+	if requestType == ListenAction {
+		if owner := store.GetChannelOwner(channelName); len(owner) > 0 && owner != hashKey {
+			decision.Reason = "channel is reserved by another key"
+			return decision
+		}
+	}
+	decisive := decisiveRule(requestType, rules, func(i int) bool {
+		return decision.Rules[i].ChannelMatched && decision.Rules[i].ConditionsMet
+	})
+	if decisive < 0 {
+		decision.Reason = fmt.Sprintf("no matching rule defines %s", decision.Action)
+		return decision
+	}
+	trace := &decision.Rules[decisive]
+	trace.Decisive = true
+	decision.Allowed = trace.Control == "allow"
+	if decision.Allowed {
+		decision.Reason = "allowed by " + trace.source()
+	} else {
+		decision.Reason = "denied by " + trace.source()
+	}
+	return decision
+}
+
+// ExplainKey returns whether `key` is registered and not expired like GetSessionKey, the only check of requests
+// which are not bound to an action on a channel, e.g. watching channels. `request` names the request in the decision.
+func (store *KeyStore) ExplainKey(request string, channelName string, key []byte) *Decision {
+	hashKey := HashKey(key)
+	decision := &Decision{Action: request, Channel: channelName, Key: hashKey}
+	store.mu.RLock()
+	property, ok := store.Table[hashKey]
+	if ok {
+		decision.ID, decision.Expire = property.ID, property.Expire
+	}
+	store.mu.RUnlock()
+	switch {
+	case !ok:
+		decision.Reason = "key is not registered"
+	case time.Now().After(decision.Expire):
+		decision.Reason = fmt.Sprintf("key expired at %s", decision.Expire.Format(time.RFC3339))
+	default:
+		decision.Allowed = true
+		decision.Reason = "only a valid key is required"
+	}
+	return decision
+}
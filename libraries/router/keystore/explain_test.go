@@ -0,0 +1,117 @@
+package keystore_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xpy123993/yukino-net/libraries/router/keystore"
+)
+
+func TestExplain(t *testing.T) {
+	keyStore := keystore.CreateKeyStore()
+	if err := keyStore.SetRole("reader", keystore.Role{Rules: []keystore.ACLRule{{ChannelRegexp: ".*", InvokeControl: keystore.Allow}}}); err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("key")
+	if err := keyStore.RegisterKey(key, keystore.SessionKey{
+		ID:     "test",
+		Expire: time.Now().Add(time.Hour),
+		Roles:  []string{"reader"},
+		Rules: []keystore.ACLRule{
+			{ChannelRegexp: "secret-.*", InvokeControl: keystore.Deny},
+			{ChannelRegexp: "office-.*", ListenControl: keystore.Allow, SourceCIDRs: []string{"10.0.0.0/8"}},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyStore.RegisterKey([]byte("owner"), keystore.SessionKey{
+		ID:               "owner",
+		Expire:           time.Now().Add(time.Hour),
+		ReservedChannels: []string{"office-reserved"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyStore.RegisterKey([]byte("expired"), keystore.SessionKey{
+		ID:     "expired",
+		Expire: time.Now().Add(-time.Hour),
+		Roles:  []string{"reader"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	office := keystore.RequestContext{RemoteIP: net.ParseIP("10.1.2.3")}
+	for _, test := range []struct {
+		action  int
+		channel string
+		key     string
+		context keystore.RequestContext
+		reason  string
+	}{
+		{keystore.InvokeAction, "kitchen", "key", keystore.RequestContext{}, "allowed by rule #0 of role reader"},
+		{keystore.InvokeAction, "secret-1", "key", keystore.RequestContext{}, "denied by rule #0 of the key"},
+		{keystore.ListenAction, "office-1", "key", keystore.RequestContext{}, "no matching rule defines listen"},
+		{keystore.ListenAction, "office-1", "key", office, "allowed by rule #1 of the key"},
+		{keystore.ListenAction, "office-reserved", "key", office, "channel is reserved by another key"},
+		{keystore.InvokeAction, "kitchen", "expired", keystore.RequestContext{}, "key expired at"},
+		{keystore.InvokeAction, "kitchen", "unknown", keystore.RequestContext{}, "key is not registered"},
+	} {
+		decision := keyStore.Explain(test.action, test.channel, []byte(test.key), test.context)
+		if !strings.HasPrefix(decision.Reason, test.reason) {
+			t.Errorf("%s %s by %s: expect reason %q, got %q", keystore.ActionName(test.action), test.channel, test.key, test.reason, decision.Reason)
+		}
+		if allowed := keyStore.CheckPermissionWithContext(test.action, test.channel, []byte(test.key), test.context); allowed != decision.Allowed {
+			t.Errorf("%s %s by %s: explained %v, but CheckPermission returns %v", keystore.ActionName(test.action), test.channel, test.key, decision.Allowed, allowed)
+		}
+	}
+
+	decision := keyStore.Explain(keystore.InvokeAction, "secret-1", key, keystore.RequestContext{})
+	if len(decision.Rules) != 3 || decision.ID != "test" {
+		t.Fatalf("unexpected decision: %v", decision)
+	}
+	if trace := decision.Rules[0]; trace.Role != "reader" || !trace.ChannelMatched || trace.Control != "allow" || trace.Decisive {
+		t.Errorf("unexpected trace of the role rule: %+v", trace)
+	}
+	if trace := decision.Rules[1]; !trace.ChannelMatched || trace.Control != "deny" || !trace.Decisive {
+		t.Errorf("unexpected trace of the decisive rule: %+v", trace)
+	}
+	if trace := decision.Rules[2]; trace.ChannelMatched {
+		t.Errorf("unexpected trace of the unmatched rule: %+v", trace)
+	}
+	if description := decision.String(); !strings.Contains(description, "matched rule #0 of role reader, rule #0 of the key") {
+		t.Errorf("unexpected description: %s", description)
+	}
+}
+
+func TestExplainKey(t *testing.T) {
+	keyStore := keystore.CreateKeyStore()
+	for id, expire := range map[string]time.Duration{"valid": time.Hour, "expired": -time.Hour} {
+		// Keys without rules, which are denied any action on channels.
+		if err := keyStore.RegisterKey([]byte(id), keystore.SessionKey{ID: id, Expire: time.Now().Add(expire)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []string{"valid", "expired", "unknown"} {
+		key := []byte(id)
+		decision := keyStore.ExplainKey("watch", ".*", key)
+		if decision.Allowed != (keyStore.GetSessionKey(key) != nil) {
+			t.Errorf("ExplainKey disagrees with GetSessionKey on key %s: %s", id, decision)
+		}
+		if (id == "valid") != decision.Allowed {
+			t.Errorf("unexpected decision of key %s: %s", id, decision)
+		}
+	}
+}
+
+func TestParseAction(t *testing.T) {
+	for _, action := range []int{keystore.InvokeAction, keystore.ListenAction, keystore.PublishAction, keystore.SubscribeAction} {
+		parsed, err := keystore.ParseAction(keystore.ActionName(action))
+		if err != nil || parsed != action {
+			t.Errorf("cannot parse %s: %v", keystore.ActionName(action), err)
+		}
+	}
+	if _, err := keystore.ParseAction("dial"); err == nil {
+		t.Error("expect an error parsing an unknown action")
+	}
+}
@@ -0,0 +1,110 @@
+package keystore
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+)
+
+const (
+	// SPKIIdentity identifies a certificate by the SHA-256 fingerprint of its public key,
+	// which stays the same when the certificate is re-issued for the same key pair.
+	SPKIIdentity = "spki"
+	// SignatureIdentity identifies a certificate by its signature, it changes on every re-issue.
+	SignatureIdentity = "signature"
+)
+
+// DefaultIdentityOrder is the default order to look up certificate identities.
+var DefaultIdentityOrder = []string{SPKIIdentity, SignatureIdentity}
+
+// spkiKeyPrefix separates SPKI identities from other kinds of keys.
+const spkiKeyPrefix = "spki-sha256:"
+
+// TokenKeyPrefix separates bearer tokens from certificate keys, so that a token can never collide with
+// the signature or the SPKI key of a certificate.
+const TokenKeyPrefix = "token:"
+
+// TokenKey returns the key of the bearer token `token`.
+func TokenKey(token []byte) []byte {
+	return append([]byte(TokenKeyPrefix), token...)
+}
+
+// SPKIKey returns the key of `certificate` based on the fingerprint of its public key.
+func SPKIKey(certificate *x509.Certificate) []byte {
+	fingerprint := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+	return append([]byte(spkiKeyPrefix), fingerprint[:]...)
+}
+
+// SignatureKey returns the key of `certificate` based on its signature.
+func SignatureKey(certificate *x509.Certificate) []byte {
+	return certificate.Signature
+}
+
+// CertificateKey returns the key of `certificate` under `identity`.
+func CertificateKey(certificate *x509.Certificate, identity string) ([]byte, error) {
+	switch identity {
+	case SPKIIdentity:
+		return SPKIKey(certificate), nil
+	case SignatureIdentity:
+		return SignatureKey(certificate), nil
+	}
+	return nil, fmt.Errorf("unknown identity type %q, expect %s or %s", identity, SPKIIdentity, SignatureIdentity)
+}
+
+// ValidateIdentityOrder returns an error if `order` is empty or contains unknown identity types.
+func ValidateIdentityOrder(order []string) error {
+	if len(order) == 0 {
+		return fmt.Errorf("identity order cannot be empty")
+	}
+	for _, identity := range order {
+		if identity != SPKIIdentity && identity != SignatureIdentity {
+			return fmt.Errorf("unknown identity type %q, expect %s or %s", identity, SPKIIdentity, SignatureIdentity)
+		}
+	}
+	return nil
+}
+
+// ResolveCertificate returns the key of `certificate` under the first identity type in `order` that has a
+// valid entry in the KeyStore. If none is registered, the key of the first identity type is returned.
+// Unknown identity types in `order` are skipped.
+func (store *KeyStore) ResolveCertificate(certificate *x509.Certificate, order []string) []byte {
+	var fallback []byte
+	for _, identity := range order {
+		key, err := CertificateKey(certificate, identity)
+		if err != nil {
+			continue
+		}
+		if store.GetSessionKey(key) != nil {
+			return key
+		}
+		if fallback == nil {
+			fallback = key
+		}
+	}
+	return fallback
+}
+
+// MigrateKey moves the entry of `oldKey` to `newKey`. Returns error if `oldKey` is not registered or `newKey` is.
+func (store *KeyStore) MigrateKey(oldKey []byte, newKey []byte) error {
+	oldHashKey, newHashKey := HashKey(oldKey), HashKey(newKey)
+	return store.update(func(tx StorageTx) error {
+		property, err := tx.GetKey(oldHashKey)
+		if err != nil {
+			return err
+		}
+		if property == nil {
+			return fmt.Errorf("key not found")
+		}
+		existing, err := tx.GetKey(newHashKey)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return fmt.Errorf("key %s already exists", existing.ID)
+		}
+		if err := tx.DeleteKey(oldHashKey); err != nil {
+			return err
+		}
+		return tx.PutKey(newHashKey, property)
+	})
+}
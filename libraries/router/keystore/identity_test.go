@@ -0,0 +1,102 @@
+package keystore_test
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/xpy123993/yukino-net/libraries/common"
+	"github.com/xpy123993/yukino-net/libraries/router/keystore"
+)
+
+func issueCertificates(t *testing.T) (*x509.Certificate, *x509.Certificate, *x509.Certificate) {
+	caPriv, caPub, _, err := common.GenerateCertificate(common.GenCertOption{DNSName: "test", CertName: "Test CA", IsCA: true, KeyLength: 2048})
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(caPub)
+	caCert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issue := func(privateKey []byte) ([]byte, *x509.Certificate) {
+		priv, pub, _, err := common.GenerateCertificate(common.GenCertOption{
+			DNSName: "test", CertName: "device", KeyLength: 2048, PrivateKey: privateKey,
+			CACertificate: *caCert, CAPriv: caPriv, CAPub: caPub,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		block, _ := pem.Decode(pub)
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return priv, certificate
+	}
+	priv, original := issue(nil)
+	_, renewed := issue(priv)
+	_, other := issue(nil)
+	return original, renewed, other
+}
+
+func TestSPKIIdentity(t *testing.T) {
+	original, renewed, other := issueCertificates(t)
+	if string(keystore.SPKIKey(original)) != string(keystore.SPKIKey(renewed)) {
+		t.Error("expect renewed certificates of the same key to share the identity")
+	}
+	if string(keystore.SignatureKey(original)) == string(keystore.SignatureKey(renewed)) {
+		t.Error("expect renewed certificates to have different signatures")
+	}
+	if string(keystore.SPKIKey(original)) == string(keystore.SPKIKey(other)) {
+		t.Error("expect different keys to have different identities")
+	}
+}
+
+func TestResolveCertificate(t *testing.T) {
+	original, renewed, _ := issueCertificates(t)
+	keyStore := keystore.CreateKeyStore()
+	rules := []keystore.ACLRule{{InvokeControl: keystore.Allow, ChannelRegexp: ".*"}}
+	if err := keyStore.RegisterKey(keystore.SignatureKey(original), keystore.SessionKey{ID: "legacy", Expire: time.Now().Add(time.Hour), Rules: rules}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Falls back to the legacy identity if the public key is not registered.
+	key := keyStore.ResolveCertificate(original, keystore.DefaultIdentityOrder)
+	if string(key) != string(keystore.SignatureKey(original)) {
+		t.Error("expect the signature identity to be resolved")
+	}
+	if string(keyStore.ResolveCertificate(renewed, keystore.DefaultIdentityOrder)) != string(keystore.SPKIKey(renewed)) {
+		t.Error("expect the first identity type to be used for unknown certificates")
+	}
+	if string(keyStore.ResolveCertificate(original, []string{keystore.SPKIIdentity})) != string(keystore.SPKIKey(original)) {
+		t.Error("expect identity types not in the order to be ignored")
+	}
+
+	if err := keyStore.MigrateKey(keystore.SignatureKey(original), keystore.SPKIKey(original)); err != nil {
+		t.Fatal(err)
+	}
+	if keyStore.GetSessionKey(keystore.SignatureKey(original)) != nil {
+		t.Error("expect the legacy entry to be removed")
+	}
+	key = keyStore.ResolveCertificate(renewed, keystore.DefaultIdentityOrder)
+	if !keyStore.CheckPermission(keystore.InvokeAction, "test", key) {
+		t.Error("expect the renewed certificate to keep permissions after migration")
+	}
+	if err := keyStore.MigrateKey(keystore.SignatureKey(original), keystore.SPKIKey(original)); err == nil {
+		t.Error("expect migrating an unknown key to fail")
+	}
+}
+
+func TestValidateIdentityOrder(t *testing.T) {
+	if err := keystore.ValidateIdentityOrder(keystore.DefaultIdentityOrder); err != nil {
+		t.Error(err)
+	}
+	if err := keystore.ValidateIdentityOrder([]string{"fingerprint"}); err == nil {
+		t.Error("expect unknown identity types to be rejected")
+	}
+	if err := keystore.ValidateIdentityOrder(nil); err == nil {
+		t.Error("expect empty order to be rejected")
+	}
+}
@@ -0,0 +1,290 @@
+package keystore
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Storage persists the keys and roles of a KeyStore.
+// Implementations must be safe for concurrent use by multiple processes.
+type Storage interface {
+	// View runs `fn` in a read-only transaction.
+	View(fn func(tx StorageTx) error) error
+	// Update runs `fn` in a read-write transaction. Changes are persisted atomically if `fn` returns nil.
+	Update(fn func(tx StorageTx) error) error
+}
+
+// StorageTx accesses the keys, indexed by hashed key, and the roles of a Storage within a transaction.
+type StorageTx interface {
+	// GetKey returns the property of `hashKey`, or nil if not found.
+	GetKey(hashKey string) (*SessionKey, error)
+	PutKey(hashKey string, property *SessionKey) error
+	DeleteKey(hashKey string) error
+	// ForEachKey calls `fn` on each key, the storage must not be modified within `fn`.
+	ForEachKey(fn func(hashKey string, property *SessionKey) error) error
+
+	// GetRole returns the role `name`, or nil if not found.
+	GetRole(name string) (*Role, error)
+	PutRole(name string, role *Role) error
+	DeleteRole(name string) error
+	// ForEachRole calls `fn` on each role, the storage must not be modified within `fn`.
+	ForEachRole(fn func(name string, role *Role) error) error
+}
+
+// CopyStorage copies all keys and roles in `source` into `destination`, overwriting the entries with the same names.
+func CopyStorage(destination Storage, source Storage) error {
+	snapshot, err := readSnapshot(source)
+	if err != nil {
+		return err
+	}
+	return destination.Update(func(tx StorageTx) error {
+		if err := snapshot.ForEachRole(tx.PutRole); err != nil {
+			return err
+		}
+		return snapshot.ForEachKey(tx.PutKey)
+	})
+}
+
+// readSnapshot reads all keys and roles of `storage` into memory.
+func readSnapshot(storage Storage) (*memoryTx, error) {
+	snapshot := &memoryTx{table: make(map[string]*SessionKey), roles: make(map[string]*Role)}
+	err := storage.View(func(tx StorageTx) error {
+		if err := tx.ForEachRole(snapshot.PutRole); err != nil {
+			return err
+		}
+		return tx.ForEachKey(snapshot.PutKey)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// recordingTx records the changes made through a transaction of a Storage, so that they can be applied in memory.
+type recordingTx struct {
+	StorageTx
+	// Keys and roles written, nil if deleted.
+	keys  map[string]*SessionKey
+	roles map[string]*Role
+}
+
+func newRecordingTx(tx StorageTx) *recordingTx {
+	return &recordingTx{StorageTx: tx, keys: make(map[string]*SessionKey), roles: make(map[string]*Role)}
+}
+
+func (tx *recordingTx) PutKey(hashKey string, property *SessionKey) error {
+	if err := tx.StorageTx.PutKey(hashKey, property); err != nil {
+		return err
+	}
+	tx.keys[hashKey] = property
+	return nil
+}
+
+func (tx *recordingTx) DeleteKey(hashKey string) error {
+	if err := tx.StorageTx.DeleteKey(hashKey); err != nil {
+		return err
+	}
+	tx.keys[hashKey] = nil
+	return nil
+}
+
+func (tx *recordingTx) PutRole(name string, role *Role) error {
+	if err := tx.StorageTx.PutRole(name, role); err != nil {
+		return err
+	}
+	tx.roles[name] = role
+	return nil
+}
+
+func (tx *recordingTx) DeleteRole(name string) error {
+	if err := tx.StorageTx.DeleteRole(name); err != nil {
+		return err
+	}
+	tx.roles[name] = nil
+	return nil
+}
+
+// memoryTx is a transaction on tables in memory.
+type memoryTx struct {
+	table map[string]*SessionKey
+	roles map[string]*Role
+	// Whether roles are modified, keys should be compiled again.
+	rolesChanged bool
+}
+
+func (tx *memoryTx) GetKey(hashKey string) (*SessionKey, error) {
+	return tx.table[hashKey], nil
+}
+
+func (tx *memoryTx) PutKey(hashKey string, property *SessionKey) error {
+	tx.table[hashKey] = property
+	return nil
+}
+
+func (tx *memoryTx) DeleteKey(hashKey string) error {
+	delete(tx.table, hashKey)
+	return nil
+}
+
+func (tx *memoryTx) ForEachKey(fn func(hashKey string, property *SessionKey) error) error {
+	for hashKey, property := range tx.table {
+		if err := fn(hashKey, property); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *memoryTx) GetRole(name string) (*Role, error) {
+	return tx.roles[name], nil
+}
+
+func (tx *memoryTx) PutRole(name string, role *Role) error {
+	tx.roles[name] = role
+	tx.rolesChanged = true
+	return nil
+}
+
+func (tx *memoryTx) DeleteRole(name string) error {
+	delete(tx.roles, name)
+	tx.rolesChanged = true
+	return nil
+}
+
+func (tx *memoryTx) ForEachRole(fn func(name string, role *Role) error) error {
+	for name, role := range tx.roles {
+		if err := fn(name, role); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileLockTimeout is how long a writer waits for other writers of the same file.
+const fileLockTimeout = 10 * time.Second
+
+// fileStorage stores all keys and roles in a single JSON file, optionally encrypted.
+// Every update rewrites the whole file, writers are serialized with a lock file next to it.
+type fileStorage struct {
+	fileName string
+	secret   []byte
+	// If true, updates write the file with `newSecret`, or without encryption if it is nil.
+	rekey     bool
+	newSecret []byte
+}
+
+// NewFileStorage returns a Storage in the JSON file `FileName`, the format written by KeyStore.Save.
+// If `Secret` is not nil, the file must be encrypted with it, otherwise ErrNotEncrypted is returned.
+// New files are encrypted if `Secret` is not nil.
+func NewFileStorage(FileName string, Secret []byte) Storage {
+	return &fileStorage{fileName: FileName, secret: Secret}
+}
+
+type fileContent struct {
+	Table map[string]*SessionKey `json:"table"`
+	Roles map[string]*Role       `json:"roles,omitempty"`
+}
+
+// read returns the content of the file and whether it is encrypted.
+func (storage *fileStorage) read() (*memoryTx, bool, error) {
+	data, err := os.ReadFile(storage.fileName)
+	if err != nil {
+		return nil, false, err
+	}
+	data, encrypted, err := decryptKeyStore(data, storage.secret)
+	if err != nil {
+		return nil, encrypted, err
+	}
+	content := fileContent{}
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, encrypted, err
+	}
+	tx := &memoryTx{table: content.Table, roles: content.Roles}
+	if tx.table == nil {
+		tx.table = make(map[string]*SessionKey)
+	}
+	if tx.roles == nil {
+		tx.roles = make(map[string]*Role)
+	}
+	return tx, encrypted, nil
+}
+
+func (storage *fileStorage) View(fn func(tx StorageTx) error) error {
+	tx, _, err := storage.read()
+	if err != nil {
+		return err
+	}
+	return fn(tx)
+}
+
+func (storage *fileStorage) Update(fn func(tx StorageTx) error) error {
+	unlock, err := lockFile(storage.fileName + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	tx, encrypted, err := storage.read()
+	if os.IsNotExist(err) {
+		tx = &memoryTx{table: make(map[string]*SessionKey), roles: make(map[string]*Role)}
+		encrypted = storage.secret != nil
+	} else if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(fileContent{Table: tx.table, Roles: tx.roles}, "", "    ")
+	if err != nil {
+		return err
+	}
+	secret := storage.secret
+	if storage.rekey {
+		encrypted, secret = storage.newSecret != nil, storage.newSecret
+	}
+	if encrypted {
+		if data, err = encryptKeyStore(data, secret); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(storage.fileName, data, 0600)
+}
+
+// ChangeFileSecret encrypts the JSON token file `FileName` with `NewSecret`, or removes its encryption if `NewSecret` is nil.
+// `Secret` unlocks the current file, it must be nil if the file is not encrypted. A missing file is created.
+// The file is rewritten under the same lock as updates made through NewFileStorage.
+func ChangeFileSecret(FileName string, Secret []byte, NewSecret []byte) error {
+	storage := &fileStorage{fileName: FileName, secret: Secret, rekey: true, newSecret: NewSecret}
+	return storage.Update(func(tx StorageTx) error { return nil })
+}
+
+// lockFile takes an exclusive lock on `lockFileName`, waiting for other holders up to fileLockTimeout.
+// The lock is held by the operating system, so it is released even if the holder crashes.
+// Returns a function to release the lock.
+func lockFile(lockFileName string) (func(), error) {
+	file, err := os.OpenFile(lockFileName, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(fileLockTimeout)
+	for {
+		locked, err := tryLockFile(file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("cannot lock %s: %v", lockFileName, err)
+		}
+		if locked {
+			return func() {
+				unlockFile(file)
+				file.Close()
+			}, nil
+		}
+		if time.Now().After(deadline) {
+			file.Close()
+			return nil, fmt.Errorf("timed out waiting for another process writing %s", lockFileName)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,253 @@
+package keystore_test
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xpy123993/yukino-net/libraries/router/keystore"
+)
+
+func storageBackends(t *testing.T) map[string]func() keystore.Storage {
+	folder := t.TempDir()
+	return map[string]func() keystore.Storage{
+		"file": func() keystore.Storage { return keystore.NewFileStorage(path.Join(folder, "auth.json"), nil) },
+		"bolt": func() keystore.Storage { return keystore.NewBoltStorage(path.Join(folder, "auth.db")) },
+	}
+}
+
+func openKeyStore(t *testing.T, storage keystore.Storage) *keystore.KeyStore {
+	if err := storage.Update(func(tx keystore.StorageTx) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	keyStore, err := keystore.OpenKeyStore(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyStore
+}
+
+func TestStorageWriteThrough(t *testing.T) {
+	for name, newStorage := range storageBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			keyStore := openKeyStore(t, newStorage())
+			if err := keyStore.SetRole("reader", keystore.Role{Rules: []keystore.ACLRule{{ChannelRegexp: ".*", InvokeControl: keystore.Allow}}}); err != nil {
+				t.Fatal(err)
+			}
+			key := []byte("key")
+			if err := keyStore.RegisterKey(key, keystore.SessionKey{ID: "test", Expire: time.Now().Add(time.Hour), Roles: []string{"reader"}}); err != nil {
+				t.Fatal(err)
+			}
+			if err := keyStore.RegisterKey([]byte("expired"), keystore.SessionKey{ID: "expired", Expire: time.Now().Add(-time.Hour)}); err != nil {
+				t.Fatal(err)
+			}
+			removed, err := keyStore.CleanUp()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(removed) != 1 || removed[0] != "expired" {
+				t.Errorf("expect the expired key to be reported, got %v", removed)
+			}
+
+			loadedKeyStore, err := keystore.OpenKeyStore(newStorage())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !loadedKeyStore.CheckPermission(keystore.InvokeAction, "channel", key) {
+				t.Error("expect the key to be persisted with its role")
+			}
+			if len(loadedKeyStore.Table) != 1 {
+				t.Errorf("expect the expired key to be removed, got %d keys", len(loadedKeyStore.Table))
+			}
+			if err := loadedKeyStore.DeleteRole("reader"); err == nil {
+				t.Error("expect an error deleting a role in use")
+			}
+		})
+	}
+}
+
+func TestCleanUpWithoutExpiredKeys(t *testing.T) {
+	fileName := path.Join(t.TempDir(), "auth.json")
+	keyStore := openKeyStore(t, keystore.NewFileStorage(fileName, nil))
+	if err := keyStore.RegisterKey([]byte("key"), keystore.SessionKey{ID: "test", Expire: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, err := keyStore.CleanUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 0 {
+		t.Errorf("expect no key to be removed, got %v", removed)
+	}
+	after, err := os.Stat(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Error("expect the token file not to be rewritten")
+	}
+}
+
+func TestStorageReload(t *testing.T) {
+	for name, newStorage := range storageBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			routerKeyStore := openKeyStore(t, newStorage())
+			cliKeyStore := openKeyStore(t, newStorage())
+			key := []byte("key")
+			if err := cliKeyStore.RegisterKey(key, keystore.SessionKey{
+				ID:     "test",
+				Expire: time.Now().Add(time.Hour),
+				Rules:  []keystore.ACLRule{{ChannelRegexp: ".*", ListenControl: keystore.Allow}},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if routerKeyStore.CheckPermission(keystore.ListenAction, "channel", key) {
+				t.Error("expect changes of other writers to be invisible before Reload")
+			}
+			if err := routerKeyStore.Reload(); err != nil {
+				t.Fatal(err)
+			}
+			if !routerKeyStore.CheckPermission(keystore.ListenAction, "channel", key) {
+				t.Error("expect changes of other writers to be visible after Reload")
+			}
+		})
+	}
+}
+
+func TestStorageConcurrentWriters(t *testing.T) {
+	const writers = 8
+	for name, newStorage := range storageBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			openKeyStore(t, newStorage())
+			wg := sync.WaitGroup{}
+			errs := make(chan error, writers)
+			for i := 0; i < writers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					keyStore, err := keystore.OpenKeyStore(newStorage())
+					if err != nil {
+						errs <- err
+						return
+					}
+					errs <- keyStore.RegisterKey([]byte(fmt.Sprintf("key-%d", i)), keystore.SessionKey{ID: fmt.Sprintf("key-%d", i), Expire: time.Now().Add(time.Hour)})
+				}(i)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			keyStore, err := keystore.OpenKeyStore(newStorage())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keyStore.Table) != writers {
+				t.Errorf("expect %d keys, got %d", writers, len(keyStore.Table))
+			}
+		})
+	}
+}
+
+func TestFileStorageLeftLock(t *testing.T) {
+	configFile := path.Join(t.TempDir(), "auth.json")
+	// A lock file left by a crashed writer does not block others, as the lock is released with the process.
+	if err := os.WriteFile(configFile+".lock", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	keyStore := openKeyStore(t, keystore.NewFileStorage(configFile, nil))
+	if err := keyStore.RegisterKey([]byte("key"), keystore.SessionKey{ID: "test", Expire: time.Now().Add(time.Hour)}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStorageUpdateRoles(t *testing.T) {
+	for name, newStorage := range storageBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			keyStore := openKeyStore(t, newStorage())
+			if err := keyStore.SetRole("reader", keystore.Role{}); err != nil {
+				t.Fatal(err)
+			}
+			key := []byte("key")
+			if err := keyStore.RegisterKey(key, keystore.SessionKey{ID: "test", Expire: time.Now().Add(time.Hour), Roles: []string{"reader"}}); err != nil {
+				t.Fatal(err)
+			}
+			if keyStore.CheckPermission(keystore.InvokeAction, "channel", key) {
+				t.Error("expect the key to have no permission")
+			}
+			// Keys are compiled again with the updated role.
+			if err := keyStore.SetRole("reader", keystore.Role{Rules: []keystore.ACLRule{{ChannelRegexp: ".*", InvokeControl: keystore.Allow}}}); err != nil {
+				t.Fatal(err)
+			}
+			if !keyStore.CheckPermission(keystore.InvokeAction, "channel", key) {
+				t.Error("expect the updated role to apply")
+			}
+			if err := keyStore.DeleteHashKey(keystore.HashKey(key)); err != nil {
+				t.Fatal(err)
+			}
+			if keyStore.Size() != 0 {
+				t.Errorf("expect the key to be deleted, got %d keys", keyStore.Size())
+			}
+		})
+	}
+}
+
+func TestChangeFileSecret(t *testing.T) {
+	configFile := path.Join(t.TempDir(), "auth.json")
+	key := []byte("key")
+	keyStore := openKeyStore(t, keystore.NewFileStorage(configFile, nil))
+	if err := keyStore.RegisterKey(key, keystore.SessionKey{ID: "test", Expire: time.Now().Add(time.Hour), Rules: []keystore.ACLRule{{ChannelRegexp: ".*", InvokeControl: keystore.Allow}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := keystore.ChangeFileSecret(configFile, []byte("wrong"), []byte("passphrase")); err == nil {
+		t.Error("expect a secret to be rejected for an unencrypted file")
+	}
+	if err := keystore.ChangeFileSecret(configFile, nil, []byte("passphrase")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keystore.LoadKeyStore(configFile); err != keystore.ErrLocked {
+		t.Errorf("expect ErrLocked, got %v", err)
+	}
+	if err := keystore.ChangeFileSecret(configFile, []byte("passphrase"), nil); err != nil {
+		t.Fatal(err)
+	}
+	loadedKeyStore, err := keystore.LoadKeyStore(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loadedKeyStore.CheckPermission(keystore.InvokeAction, "channel", key) {
+		t.Error("expect the key to be kept")
+	}
+}
+
+func TestCopyStorage(t *testing.T) {
+	backends := storageBackends(t)
+	key := []byte("key")
+	source := openKeyStore(t, backends["file"]())
+	if err := source.RegisterKey(key, keystore.SessionKey{
+		ID:     "test",
+		Expire: time.Now().Add(time.Hour),
+		Rules:  []keystore.ACLRule{{ChannelRegexp: ".*", InvokeControl: keystore.Allow}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := keystore.CopyStorage(backends["bolt"](), backends["file"]()); err != nil {
+		t.Fatal(err)
+	}
+	destination, err := keystore.OpenKeyStore(backends["bolt"]())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !destination.CheckPermission(keystore.InvokeAction, "channel", key) {
+		t.Error("expect the key to be copied")
+	}
+}
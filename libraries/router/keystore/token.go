@@ -7,9 +7,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"regexp"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -26,6 +29,10 @@ const (
 	InvokeAction = iota
 	// ListenAction indicates listen type of requests.
 	ListenAction = iota
+	// PublishAction indicates publish type of requests on broadcast channels.
+	PublishAction = iota
+	// SubscribeAction indicates subscribe type of requests on broadcast channels.
+	SubscribeAction = iota
 )
 
 // ACLRule stores an access control rule to all channels matched with `ChannelRegexp`.
@@ -34,110 +41,515 @@ type ACLRule struct {
 	ListenControl int `json:"listen" default:"0"`
 	// Controls the ability to invoke services on a channel.
 	InvokeControl int `json:"invoke" default:"0"`
+	// Controls the ability to publish messages to a broadcast channel.
+	PublishControl int `json:"publish" default:"0"`
+	// Controls the ability to subscribe to a broadcast channel.
+	SubscribeControl int `json:"subscribe" default:"0"`
 	// Specifies the regular expression matching rules.
 	ChannelRegexp string `json:"channel_regexp"`
+	// If not empty, the rule only matches requests from these IP addresses or CIDR ranges.
+	SourceCIDRs []string `json:"source,omitempty"`
+	// If not empty, the rule only matches requests within any of these windows, checked when the request is made.
+	TimeWindows []TimeWindow `json:"time_windows,omitempty"`
+}
+
+// Duration is a time.Duration stored in a human readable form like "1h30m" in JSON.
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler.
+func (duration Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(duration).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (duration *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*duration = Duration(parsed)
+	return nil
+}
+
+// Role is a named set of rules shared by keys.
+type Role struct {
+	// Description of this role.
+	Description string `json:"description"`
+	// If there are multiple matching rules, takes the later one in the array.
+	Rules []ACLRule `json:"rules"`
 }
 
 // SessionKey represents the property of the key.
+//
+// Rules of a key are evaluated in layers: the rules of each role in `Roles` in the listed order, then `Rules` of the key itself.
+// Within a layer, the last matching rule decides the result of the layer, even if it leaves the action as UndefinedACL.
+// A layer resulting in Allow or Deny overrides earlier layers, so key-specific rules override its roles,
+// and later roles override earlier ones.
 type SessionKey struct {
 	// Expiration time of the key.
 	Expire time.Time `json:"expire"`
 	// If there are multiple matching rules, takes the later one in the array.
 	Rules []ACLRule `json:"rules"`
+	// Names of the roles this key belongs to.
+	Roles []string `json:"roles,omitempty"`
 	// ID of this key, just for identification.
 	ID string `json:"id"`
 	// Description of this key.
 	Description string `json:"description"`
+	// If not zero, tightens the router's idle timeout of bridges involving this key, it cannot extend the router's limit.
+	BridgeIdleTimeout Duration `json:"bridge-idle-timeout,omitempty"`
+	// If not zero, tightens the router's maximum lifetime of bridges involving this key, it cannot extend the router's limit.
+	BridgeMaxLifetime Duration `json:"bridge-max-lifetime,omitempty"`
+	// Channels that can only be listened by this key, regardless of the rules of other keys.
+	ReservedChannels []string `json:"reserved-channels,omitempty"`
+
+	// Effective rules of this key in evaluation order, with `ChannelRegexp` compiled.
+	compiled []compiledRule
+	// Whether any of `compiled` has conditions, decisions of such keys are not cached.
+	conditional bool
+	// Cached decisions of `compiled`, replaced whenever the key is compiled again. Shared by copies of the property.
+	decisions *decisionCache
+}
+
+type compiledRule struct {
+	ACLRule
+	// Name of the role defining this rule, empty for rules of the key itself.
+	role string
+	// Index of this rule within the rules of the role or the key.
+	index   int
+	matcher *regexp.Regexp
+	sources []*net.IPNet
+	windows []compiledWindow
 }
 
+// DefaultDecisionCacheSize is the default number of decisions cached per key.
+const DefaultDecisionCacheSize = 1024
+
 // KeyStore - A structure to store a set of keys.
 // This structure is thread-compatible.
 type KeyStore struct {
-	mu    *sync.RWMutex
+	// Maximum number of decisions cached per key, accessed atomically.
+	// Kept as the first field to be 64-bit aligned on 32-bit platforms.
+	decisionCacheSize int64
+
+	mu *sync.RWMutex
+	// Keys indexed by hashed keys. Rules are compiled when a key is written through the KeyStore,
+	// so properties must not be modified in place, use UpdateKey or UpdateKeyByID instead.
 	Table map[string]*SessionKey `json:"table"`
+	Roles map[string]*Role       `json:"roles,omitempty"`
 	cache map[string]string      `json:"-"`
+	// Hashed keys reserving each channel, rebuilt on every change of `Table` made through the KeyStore.
+	reservations map[string][]string
+
+	// If not nil, the KeyStore is encrypted with this secret on Save.
+	secret []byte
+	// If not nil, changes are written through to this storage, see OpenKeyStore.
+	storage Storage
 }
 
-// Save dumps all configuration to the disk in JSON format WITHOUT any encryption.
-func (store *KeyStore) Save(FileName string) error {
+// ValidateRules returns an error if any of `rules` has an invalid `ChannelRegexp` or condition.
+func ValidateRules(rules []ACLRule) error {
+	_, err := compileRules(nil, "", rules)
+	return err
+}
+
+// compileRules appends compiled `rules` of `role` to `compiled`, `role` is empty for rules of a key.
+func compileRules(compiled []compiledRule, role string, rules []ACLRule) ([]compiledRule, error) {
+	for index, rule := range rules {
+		matcher, err := regexp.Compile(rule.ChannelRegexp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid channel regexp %q: %v", rule.ChannelRegexp, err)
+		}
+		result := compiledRule{ACLRule: rule, role: role, index: index, matcher: matcher}
+		if err := compileConditions(&result, rule); err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, result)
+	}
+	return compiled, nil
+}
+
+// compileKey resolves the roles of `property` from `tx` and compiles its effective rules.
+func compileKey(property *SessionKey, tx StorageTx) error {
+	compiled := []compiledRule{}
+	for _, name := range property.Roles {
+		role, err := tx.GetRole(name)
+		if err != nil {
+			return err
+		}
+		if role == nil {
+			return fmt.Errorf("unknown role %q", name)
+		}
+		if compiled, err = compileRules(compiled, name, role.Rules); err != nil {
+			return fmt.Errorf("role %s: %v", name, err)
+		}
+	}
+	compiled, err := compileRules(compiled, "", property.Rules)
+	if err != nil {
+		return err
+	}
+	property.compiled = compiled
+	property.decisions = newDecisionCache()
+	property.conditional = false
+	for i := range compiled {
+		if compiled[i].conditional() {
+			property.conditional = true
+		}
+	}
+	return nil
+}
+
+// indexReservations returns the hashed keys reserving each channel in `table`.
+func indexReservations(table map[string]*SessionKey) map[string][]string {
+	reservations := make(map[string][]string)
+	for hashKey, property := range table {
+		for _, channel := range property.ReservedChannels {
+			reservations[channel] = append(reservations[channel], hashKey)
+		}
+	}
+	return reservations
+}
+
+// setTables replaces all keys and roles and drops the caches derived from them, must be called with `mu` held.
+func (store *KeyStore) setTables(table map[string]*SessionKey, roles map[string]*Role) {
+	store.Table, store.Roles = table, roles
+	store.cache = make(map[string]string)
+	store.reservations = indexReservations(table)
+}
+
+// SetDecisionCacheSize sets the maximum number of decisions cached per key, 0 disables the cache.
+// Decisions are cached per key and evicted in least recently used order, so the cache takes at most `size` entries per key.
+func (store *KeyStore) SetDecisionCacheSize(size int) {
 	store.mu.RLock()
 	defer store.mu.RUnlock()
-	data, err := json.MarshalIndent(*store, "", "    ")
+	atomic.StoreInt64(&store.decisionCacheSize, int64(size))
+	for _, property := range store.Table {
+		if property.decisions != nil {
+			property.decisions.clear()
+		}
+	}
+}
+
+// Save dumps all configuration to the disk in JSON format, encrypted if a secret is set by SetSecret.
+// The file is replaced atomically and only readable by the owner.
+func (store *KeyStore) Save(FileName string) error {
+	data, err := store.Export()
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(FileName, data, 0755)
+	store.mu.RLock()
+	secret := store.secret
+	store.mu.RUnlock()
+	if secret != nil {
+		if data, err = encryptKeyStore(data, secret); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(FileName, data, 0600)
 }
 
-// LoadKeyStore will load configuration from disk.
+// Export returns all keys and roles in JSON without encryption, the format of a token file loaded by LoadKeyStore.
+func (store *KeyStore) Export() ([]byte, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return json.MarshalIndent(*store, "", "    ")
+}
+
+// LoadKeyStore will load configuration from disk. Returns ErrLocked if the file is encrypted.
 func LoadKeyStore(FileName string) (*KeyStore, error) {
+	return LoadKeyStoreWithSecret(FileName, nil)
+}
+
+// LoadKeyStoreWithSecret will load configuration from disk, decrypting it with `Secret` if not nil.
+// Returns ErrNotEncrypted if `Secret` is not nil but the file is not encrypted.
+// The returned KeyStore will be saved with the same encryption.
+func LoadKeyStoreWithSecret(FileName string, Secret []byte) (*KeyStore, error) {
 	data, err := os.ReadFile(FileName)
 	if err != nil {
 		return nil, err
 	}
-	keyStore := &KeyStore{
-		mu:    &sync.RWMutex{},
-		Table: make(map[string]*SessionKey),
-		cache: make(map[string]string),
+	data, encrypted, err := decryptKeyStore(data, Secret)
+	if err != nil {
+		return nil, err
+	}
+	keyStore, err := ParseKeyStore(data)
+	if err != nil {
+		return nil, err
 	}
+	if encrypted {
+		keyStore.secret = Secret
+	}
+	return keyStore, nil
+}
+
+// ParseKeyStore parses a KeyStore in JSON, the format returned by Export.
+func ParseKeyStore(data []byte) (*KeyStore, error) {
+	keyStore := CreateKeyStore()
 	if err := json.Unmarshal(data, keyStore); err != nil {
 		return nil, err
 	}
+	if keyStore.Roles == nil {
+		keyStore.Roles = make(map[string]*Role)
+	}
+	for _, property := range keyStore.Table {
+		if err := compileKey(property, &memoryTx{roles: keyStore.Roles}); err != nil {
+			return nil, fmt.Errorf("key %s: %v", property.ID, err)
+		}
+	}
+	keyStore.reservations = indexReservations(keyStore.Table)
+	return keyStore, nil
+}
+
+// OpenKeyStore loads a KeyStore from `storage`. Changes to the returned KeyStore are written through to `storage`,
+// changes made by other processes are picked up on Reload.
+func OpenKeyStore(storage Storage) (*KeyStore, error) {
+	keyStore := CreateKeyStore()
+	keyStore.storage = storage
+	if err := keyStore.Reload(); err != nil {
+		return nil, err
+	}
 	return keyStore, nil
 }
 
+// Reload loads all keys and roles from the storage again, the KeyStore is unchanged on error.
+// It does nothing if the KeyStore is not opened by OpenKeyStore.
+func (store *KeyStore) Reload() error {
+	if store.storage == nil {
+		return nil
+	}
+	tx, err := readSnapshot(store.storage)
+	if err != nil {
+		return err
+	}
+	for _, property := range tx.table {
+		if err := compileKey(property, tx); err != nil {
+			return fmt.Errorf("key %s: %v", property.ID, err)
+		}
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.setTables(tx.table, tx.roles)
+	return nil
+}
+
+// update runs `fn` in a transaction of the storage, or of the tables in memory if the KeyStore is not backed by a storage.
+// Nothing is changed if `fn` returns error.
+// Keys written by `fn` must have been compiled, they are compiled again if any role is changed.
+func (store *KeyStore) update(fn func(tx StorageTx) error) error {
+	if store.storage != nil {
+		var changes *recordingTx
+		err := store.storage.Update(func(tx StorageTx) error {
+			changes = newRecordingTx(tx)
+			return fn(changes)
+		})
+		if err != nil {
+			return err
+		}
+		if err := store.applyChanges(changes); err != nil {
+			// The tables in memory are out of date, e.g. a role added by another process is used.
+			return store.Reload()
+		}
+		return nil
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	tx := &memoryTx{table: make(map[string]*SessionKey, len(store.Table)), roles: make(map[string]*Role, len(store.Roles))}
+	for hashKey, property := range store.Table {
+		tx.table[hashKey] = property
+	}
+	for name, role := range store.Roles {
+		tx.roles[name] = role
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if tx.rolesChanged {
+		for hashKey, property := range tx.table {
+			// Compiles a copy, as the property in `Table` may be in use by concurrent requests.
+			tmp := *property
+			if err := compileKey(&tmp, tx); err != nil {
+				// Should not happen as the rules of all roles are validated.
+				return err
+			}
+			tx.table[hashKey] = &tmp
+		}
+	}
+	store.setTables(tx.table, tx.roles)
+	return nil
+}
+
+// applyChanges applies the changes committed to the storage to the tables in memory.
+func (store *KeyStore) applyChanges(changes *recordingTx) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	tx := &memoryTx{table: make(map[string]*SessionKey, len(store.Table)), roles: make(map[string]*Role, len(store.Roles))}
+	for hashKey, property := range store.Table {
+		tx.table[hashKey] = property
+	}
+	for name, role := range store.Roles {
+		tx.roles[name] = role
+	}
+	for hashKey, property := range changes.keys {
+		if property == nil {
+			delete(tx.table, hashKey)
+		} else {
+			tx.table[hashKey] = property
+		}
+	}
+	for name, role := range changes.roles {
+		if role == nil {
+			delete(tx.roles, name)
+		} else {
+			tx.roles[name] = role
+		}
+	}
+	if len(changes.roles) > 0 {
+		for hashKey, property := range tx.table {
+			// Compiles a copy, so that the properties in `Table` are untouched on error.
+			tmp := *property
+			if err := compileKey(&tmp, tx); err != nil {
+				return err
+			}
+			tx.table[hashKey] = &tmp
+		}
+	}
+	store.setTables(tx.table, tx.roles)
+	return nil
+}
+
 // CreateKeyStore initializes a key store in memory.
 func CreateKeyStore() *KeyStore {
 	return &KeyStore{
-		mu:    &sync.RWMutex{},
-		Table: make(map[string]*SessionKey),
-		cache: make(map[string]string),
+		mu:                &sync.RWMutex{},
+		Table:             make(map[string]*SessionKey),
+		Roles:             make(map[string]*Role),
+		cache:             make(map[string]string),
+		reservations:      make(map[string][]string),
+		decisionCacheSize: DefaultDecisionCacheSize,
 	}
 }
 
 // CleanUp serves as a garbage collection function that will remove all expired keys.
-func (store *KeyStore) CleanUp() {
-	expiredKeys := []string{}
-	store.mu.Lock()
-	defer store.mu.Unlock()
-
-	for key, val := range store.Table {
-		if time.Now().After(val.Expire) {
-			expiredKeys = append(expiredKeys, key)
+// Returns the IDs of the removed keys.
+func (store *KeyStore) CleanUp() ([]string, error) {
+	now := time.Now()
+	if !store.hasExpiredKeys(now) {
+		// Nothing to remove, the storage is not written.
+		return nil, nil
+	}
+	var removed []string
+	err := store.update(func(tx StorageTx) error {
+		removed = nil
+		expiredKeys := []string{}
+		err := tx.ForEachKey(func(hashKey string, property *SessionKey) error {
+			if now.After(property.Expire) {
+				expiredKeys = append(expiredKeys, hashKey)
+				removed = append(removed, property.ID)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range expiredKeys {
+			if err := tx.DeleteKey(key); err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return removed, nil
+}
 
-	for _, key := range expiredKeys {
-		delete(store.Table, key)
+// hasExpiredKeys returns whether any key expires before `now`.
+func (store *KeyStore) hasExpiredKeys(now time.Time) bool {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	for _, property := range store.Table {
+		if now.After(property.Expire) {
+			return true
+		}
 	}
+	return false
+}
 
-	store.cache = make(map[string]string)
+// Size returns the number of keys, including expired ones.
+func (store *KeyStore) Size() int {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return len(store.Table)
+}
+
+// ExpiringKey describes a key expiring soon, see ExpiringKeys.
+type ExpiringKey struct {
+	// Hashed key, see HashKey.
+	Key         string    `json:"key"`
+	ID          string    `json:"id"`
+	Description string    `json:"description"`
+	Expire      time.Time `json:"expire"`
+}
+
+// ExpiringKeys returns the keys that are not expired yet but expire within `within`, sorted by expiration time.
+func (store *KeyStore) ExpiringKeys(within time.Duration) []ExpiringKey {
+	now := time.Now()
+	deadline := now.Add(within)
+	result := []ExpiringKey{}
+	store.mu.RLock()
+	for hashKey, property := range store.Table {
+		if property.Expire.After(now) && !property.Expire.After(deadline) {
+			result = append(result, ExpiringKey{Key: hashKey, ID: property.ID, Description: property.Description, Expire: property.Expire})
+		}
+	}
+	store.mu.RUnlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].Expire.Before(result[j].Expire) })
+	return result
 }
 
 // UpdateKey updates the property of the Key, will create a new entry if Key does not exist.
-func (store *KeyStore) UpdateKey(Key []byte, property SessionKey) {
+// Returns error if any rule of `property` is invalid or it refers to an unknown role.
+func (store *KeyStore) UpdateKey(Key []byte, property SessionKey) error {
 	hashkey := HashKey(Key)
-	store.mu.Lock()
-	defer store.mu.Unlock()
-	store.Table[hashkey] = &property
+	return store.update(func(tx StorageTx) error {
+		if err := compileKey(&property, tx); err != nil {
+			return err
+		}
+		return tx.PutKey(hashkey, &property)
+	})
 }
 
-// RegisterKey registers a key into the KeyStore. Returns error if key exists or is too short.
+// RegisterKey registers a key into the KeyStore.
+// Returns error if key exists, any rule is invalid or it refers to an unknown role.
 func (store *KeyStore) RegisterKey(Key []byte, property SessionKey) error {
 	hashkey := HashKey(Key)
-	store.mu.Lock()
-	defer store.mu.Unlock()
-
-	if _, ok := store.Table[hashkey]; ok {
-		return fmt.Errorf("key already registered")
-	}
-	for _, val := range store.Table {
-		if property.ID == val.ID {
-			return fmt.Errorf("key ID already registered")
+	return store.update(func(tx StorageTx) error {
+		if err := compileKey(&property, tx); err != nil {
+			return err
 		}
-	}
-	store.Table[hashkey] = &property
-	return nil
+		existing, err := tx.GetKey(hashkey)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return fmt.Errorf("key already registered")
+		}
+		err = tx.ForEachKey(func(_ string, val *SessionKey) error {
+			if property.ID == val.ID {
+				return fmt.Errorf("key ID already registered")
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.PutKey(hashkey, &property)
+	})
 }
 
 // lookupHashKey returns nil if key is not registered, or the property of the key if found.
@@ -151,24 +563,68 @@ func (store *KeyStore) lookupHashKey(key string) *SessionKey {
 	return nil
 }
 
-func shouldAllow(requestType int, channelName string, rules []ACLRule) bool {
-	allowed := UndefinedACL
-	for _, rule := range rules {
-		matched, err := regexp.MatchString(rule.ChannelRegexp, channelName)
-		if err != nil {
-			log.Printf("Warning: Rule %s has error: %s, skipped this rule", rule.ChannelRegexp, err.Error())
+// control returns the control of the rule on `requestType`.
+func (rule *compiledRule) control(requestType int) int {
+	switch requestType {
+	case InvokeAction:
+		return rule.InvokeControl
+	case ListenAction:
+		return rule.ListenControl
+	case PublishAction:
+		return rule.PublishControl
+	case SubscribeAction:
+		return rule.SubscribeControl
+	}
+	return UndefinedACL
+}
+
+// decisiveRule returns the index of the rule in `rules` deciding `requestType`, or -1 if the action is undefined.
+// `matched` reports whether the i-th rule matches the request. See SessionKey for the evaluation order.
+func decisiveRule(requestType int, rules []compiledRule, matched func(i int) bool) int {
+	decisive, layer := -1, -1
+	for i := range rules {
+		if rules[i].index == 0 {
+			// A new role, or the rules of the key itself, starts here.
+			if layer >= 0 {
+				decisive = layer
+			}
+			layer = -1
+		}
+		if !matched(i) {
 			continue
 		}
-		if matched {
-			switch requestType {
-			case InvokeAction:
-				allowed = rule.InvokeControl
-			case ListenAction:
-				allowed = rule.ListenControl
-			}
+		if rules[i].control(requestType) != UndefinedACL {
+			layer = i
+		} else {
+			layer = -1
 		}
 	}
-	return allowed == Allow
+	if layer >= 0 {
+		decisive = layer
+	}
+	return decisive
+}
+
+func shouldAllow(requestType int, channelName string, rules []compiledRule, context *RequestContext) bool {
+	decisive := decisiveRule(requestType, rules, func(i int) bool {
+		return rules[i].matcher.MatchString(channelName) && rules[i].satisfied(requestType, context)
+	})
+	return decisive >= 0 && rules[decisive].control(requestType) == Allow
+}
+
+// evaluateRules returns the decision of the rules of `sessionKey`, using its decision cache if possible.
+func (store *KeyStore) evaluateRules(requestType int, channelName string, sessionKey *SessionKey, context *RequestContext) bool {
+	cacheSize := int(atomic.LoadInt64(&store.decisionCacheSize))
+	if sessionKey.conditional || sessionKey.decisions == nil || cacheSize <= 0 {
+		return shouldAllow(requestType, channelName, sessionKey.compiled, context)
+	}
+	index := decisionKey{action: requestType, channel: channelName}
+	if allowed, cached := sessionKey.decisions.get(index); cached {
+		return allowed
+	}
+	allowed := shouldAllow(requestType, channelName, sessionKey.compiled, context)
+	sessionKey.decisions.put(index, allowed, cacheSize)
+	return allowed
 }
 
 // HashKey returns a hashed salted key, which will store on disk.
@@ -179,25 +635,33 @@ func HashKey(key []byte) string {
 
 // GetSessionKey returns the matched key property.
 func (store *KeyStore) GetSessionKey(key []byte) *SessionKey {
-	store.mu.Lock()
-	var realKey string
+	_, keyProperty := store.resolveKey(key)
+	return keyProperty
+}
+
+// resolveKey returns the hashed key and the property of `key`, or nil property if not registered.
+func (store *KeyStore) resolveKey(key []byte) (string, *SessionKey) {
 	serialKey := base64.RawStdEncoding.EncodeToString(key)
-	cachedKey, ok := store.cache[serialKey]
-	if ok {
-		realKey = cachedKey
-	} else {
+	store.mu.RLock()
+	realKey, cached := store.cache[serialKey]
+	store.mu.RUnlock()
+	if !cached {
 		realKey = HashKey(key)
 	}
-	store.cache[serialKey] = realKey
-	store.mu.Unlock()
 	keyProperty := store.lookupHashKey(realKey)
 	if keyProperty == nil {
-		return nil
+		return realKey, nil
+	}
+	// Only registered keys are cached, so that unknown tokens cannot grow the cache.
+	if !cached {
+		store.mu.Lock()
+		store.cache[serialKey] = realKey
+		store.mu.Unlock()
 	}
 	if time.Now().After(keyProperty.Expire) {
-		return nil
+		return realKey, nil
 	}
-	return keyProperty
+	return realKey, keyProperty
 }
 
 // GetExpireTime returns the expiration time of the key, if key is not registered, a past time will be returned.
@@ -210,25 +674,297 @@ func (store *KeyStore) GetExpireTime(key []byte) time.Time {
 
 // CheckPermission checks the permission of the header for given request type acting on the requested channel.
 // We only examine the first key within the `header`.
+// The remote address is unknown, so rules with a source condition only apply if they deny the request, see CheckPermissionWithContext.
 func (store *KeyStore) CheckPermission(requestType int, channelName string, key []byte) bool {
-	if sessionKey := store.GetSessionKey(key); sessionKey != nil {
-		return shouldAllow(requestType, channelName, sessionKey.Rules)
+	return store.CheckPermissionWithContext(requestType, channelName, key, RequestContext{})
+}
+
+// CheckPermissionWithContext is CheckPermission for a request described by `context`.
+func (store *KeyStore) CheckPermissionWithContext(requestType int, channelName string, key []byte, context RequestContext) bool {
+	if hashKey, sessionKey := store.resolveKey(key); sessionKey != nil {
+		if requestType == ListenAction {
+			if owner := store.GetChannelOwner(channelName); len(owner) > 0 && owner != hashKey {
+				return false
+			}
+		}
+		return store.evaluateRules(requestType, channelName, sessionKey, &context)
 	}
 	return false
 }
 
+// SetRole creates or replaces the role `name`, keys referring to it will use the new rules immediately.
+func (store *KeyStore) SetRole(name string, role Role) error {
+	if len(name) == 0 {
+		return fmt.Errorf("role name cannot be empty")
+	}
+	if err := ValidateRules(role.Rules); err != nil {
+		return err
+	}
+	return store.update(func(tx StorageTx) error {
+		return tx.PutRole(name, &role)
+	})
+}
+
+// DeleteRole removes the role `name`. Returns error if any key still refers to it.
+func (store *KeyStore) DeleteRole(name string) error {
+	return store.update(func(tx StorageTx) error {
+		existing, err := tx.GetRole(name)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			return fmt.Errorf("role %q not found", name)
+		}
+		err = tx.ForEachKey(func(_ string, property *SessionKey) error {
+			for _, role := range property.Roles {
+				if role == name {
+					return fmt.Errorf("role %q is still used by key %s", name, property.ID)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.DeleteRole(name)
+	})
+}
+
+// findKeyByID returns the hashed key and the property of the key named `id` in `tx`, including expired keys.
+// Returns error if not found or multiple keys are named `id`.
+func findKeyByID(tx StorageTx, id string) (string, *SessionKey, error) {
+	var hashKey string
+	var result *SessionKey
+	err := tx.ForEachKey(func(key string, property *SessionKey) error {
+		if property.ID != id {
+			return nil
+		}
+		if result != nil {
+			return fmt.Errorf("multiple keys are named %s", id)
+		}
+		hashKey, result = key, property
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if result == nil {
+		return "", nil, fmt.Errorf("key %s not found", id)
+	}
+	return hashKey, result, nil
+}
+
+// checkUniqueID returns error if `id` is used by a key other than `hashKey` in `tx`.
+func checkUniqueID(tx StorageTx, hashKey string, id string) error {
+	return tx.ForEachKey(func(key string, val *SessionKey) error {
+		if key != hashKey && val.ID == id {
+			return fmt.Errorf("key ID already registered")
+		}
+		return nil
+	})
+}
+
+// FindKeyByID returns the hashed key and a copy of the property of the key named `id`, including expired keys.
+// Returns error if not found or multiple keys are named `id`.
+func (store *KeyStore) FindKeyByID(id string) (string, *SessionKey, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	hashKey, property, err := findKeyByID(&memoryTx{table: store.Table}, id)
+	if err != nil {
+		return "", nil, err
+	}
+	tmp := *property
+	return hashKey, &tmp, nil
+}
+
+// Keys returns copies of the properties of all keys indexed by hashed key, including expired keys.
+func (store *KeyStore) Keys() map[string]SessionKey {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	result := make(map[string]SessionKey, len(store.Table))
+	for hashKey, property := range store.Table {
+		result[hashKey] = *property
+	}
+	return result
+}
+
+// UpdateHashKey updates the property of a registered key by its hashed key, see HashKey.
+// Returns error if the key is not registered, its ID is used by another key, any rule is invalid or it refers to an unknown role.
+func (store *KeyStore) UpdateHashKey(hashKey string, property SessionKey) error {
+	return store.update(func(tx StorageTx) error {
+		if err := compileKey(&property, tx); err != nil {
+			return err
+		}
+		existing, err := tx.GetKey(hashKey)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			return fmt.Errorf("key not found")
+		}
+		if err := checkUniqueID(tx, hashKey, property.ID); err != nil {
+			return err
+		}
+		return tx.PutKey(hashKey, &property)
+	})
+}
+
+// UpdateKeyByID applies `fn` to a copy of the property of the key named `id` and stores the result.
+// The lookup and the update are made in one transaction, so that concurrent changes of the key are not lost.
+// Returns the hashed key and a copy of the updated property, or error like FindKeyByID and UpdateHashKey.
+func (store *KeyStore) UpdateKeyByID(id string, fn func(property *SessionKey) error) (string, *SessionKey, error) {
+	var hashKey string
+	var result SessionKey
+	err := store.update(func(tx StorageTx) error {
+		key, existing, err := findKeyByID(tx, id)
+		if err != nil {
+			return err
+		}
+		property := *existing
+		property.Rules = append([]ACLRule(nil), existing.Rules...)
+		property.Roles = append([]string(nil), existing.Roles...)
+		property.ReservedChannels = append([]string(nil), existing.ReservedChannels...)
+		if err := fn(&property); err != nil {
+			return err
+		}
+		if err := compileKey(&property, tx); err != nil {
+			return err
+		}
+		if err := checkUniqueID(tx, key, property.ID); err != nil {
+			return err
+		}
+		hashKey, result = key, property
+		return tx.PutKey(key, &property)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return hashKey, &result, nil
+}
+
+// DeleteKeyByID removes the key named `id` in one transaction.
+// Returns the hashed key and the property of the removed key, or error like FindKeyByID.
+func (store *KeyStore) DeleteKeyByID(id string) (string, *SessionKey, error) {
+	var hashKey string
+	var result SessionKey
+	err := store.update(func(tx StorageTx) error {
+		key, existing, err := findKeyByID(tx, id)
+		if err != nil {
+			return err
+		}
+		hashKey, result = key, *existing
+		return tx.DeleteKey(key)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return hashKey, &result, nil
+}
+
+// DeleteHashKey removes a registered key by its hashed key, see HashKey.
+func (store *KeyStore) DeleteHashKey(hashKey string) error {
+	return store.update(func(tx StorageTx) error {
+		existing, err := tx.GetKey(hashKey)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			return fmt.Errorf("key not found")
+		}
+		return tx.DeleteKey(hashKey)
+	})
+}
+
+// Merge adds all keys and roles of `other` into the KeyStore, overwriting keys with the same hashed keys and roles with the same names.
+// Nothing is changed if a key of `other` is named after a different key in the KeyStore, or any key or role is invalid.
+func (store *KeyStore) Merge(other *KeyStore) error {
+	other.mu.RLock()
+	defer other.mu.RUnlock()
+	for name, role := range other.Roles {
+		if err := ValidateRules(role.Rules); err != nil {
+			return fmt.Errorf("role %s: %v", name, err)
+		}
+	}
+	return store.update(func(tx StorageTx) error {
+		ids := make(map[string]string)
+		err := tx.ForEachKey(func(hashKey string, property *SessionKey) error {
+			ids[property.ID] = hashKey
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for hashKey, property := range other.Table {
+			if existing, ok := ids[property.ID]; ok && existing != hashKey {
+				return fmt.Errorf("key %s: key ID already registered", property.ID)
+			}
+		}
+		for name, role := range other.Roles {
+			tmp := *role
+			if err := tx.PutRole(name, &tmp); err != nil {
+				return err
+			}
+		}
+		for hashKey, property := range other.Table {
+			tmp := *property
+			if err := compileKey(&tmp, tx); err != nil {
+				return fmt.Errorf("key %s: %v", property.ID, err)
+			}
+			if err := tx.PutKey(hashKey, &tmp); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetRole returns a copy of the role `name`, or nil if not found.
+func (store *KeyStore) GetRole(name string) *Role {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	if role, ok := store.Roles[name]; ok {
+		tmp := *role
+		return &tmp
+	}
+	return nil
+}
+
+// GetChannelOwner returns the hashed key that reserves `channelName`, or an empty string if not reserved.
+// Reservations of expired keys are ignored.
+func (store *KeyStore) GetChannelOwner(channelName string) string {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	now := time.Now()
+	for _, hashKey := range store.reservations[channelName] {
+		if property, ok := store.Table[hashKey]; ok && !property.Expire.Before(now) {
+			return hashKey
+		}
+	}
+	return ""
+}
+
 // GenerateKeyAndRegister generates a key and registers into the table.
 func (store *KeyStore) GenerateKeyAndRegister(name string, rules []ACLRule, duration time.Duration) string {
-	p := make([]byte, 64)
-	if _, err := rand.Read(p); err != nil {
-		log.Fatalf("cannot generate keys: %v", err)
-	}
-	if err := store.RegisterKey(p, SessionKey{
+	token, err := store.GenerateKey(SessionKey{
 		Expire: time.Now().Add(duration),
 		Rules:  rules,
 		ID:     name,
-	}); err != nil {
+	})
+	if err != nil {
 		log.Fatalf("cannot register key: %v", err)
 	}
-	return base64.RawStdEncoding.EncodeToString(p)
+	return token
+}
+
+// GenerateKey generates a bearer token with `property` and registers into the table, returns the token in base64 encoding.
+// The token is registered under TokenKey.
+func (store *KeyStore) GenerateKey(property SessionKey) (string, error) {
+	p := make([]byte, 64)
+	if _, err := rand.Read(p); err != nil {
+		return "", fmt.Errorf("cannot generate keys: %v", err)
+	}
+	if err := store.RegisterKey(TokenKey(p), property); err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(p), nil
 }
@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
+	"net"
+	"os"
 	"path"
+	"regexp"
 	"testing"
 	"time"
 
@@ -71,6 +74,35 @@ func TestUtilFunctionSanityCheck(t *testing.T) {
 	}
 }
 
+func TestAuthForBroadcastKey(t *testing.T) {
+	keyStore := keystore.CreateKeyStore()
+	key := randomBytes(32)
+	keyStore.RegisterKey(key, keystore.SessionKey{
+		Expire: time.Now().Add(time.Hour),
+		Rules: []keystore.ACLRule{
+			{
+				PublishControl:   keystore.Allow,
+				SubscribeControl: keystore.Allow,
+				ChannelRegexp:    "fleet",
+			},
+			{
+				PublishControl:   keystore.Deny,
+				SubscribeControl: keystore.Allow,
+				ChannelRegexp:    "fleet-readonly",
+			},
+		},
+	})
+	if !keyStore.CheckPermission(keystore.PublishAction, "fleet", key) || !keyStore.CheckPermission(keystore.SubscribeAction, "fleet", key) {
+		t.Error("expect publish and subscribe to be allowed")
+	}
+	if keyStore.CheckPermission(keystore.PublishAction, "fleet-readonly", key) || !keyStore.CheckPermission(keystore.SubscribeAction, "fleet-readonly", key) {
+		t.Error("expect only subscribe to be allowed")
+	}
+	if err := checkPermission(keyStore, key, "fleet", false, false); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestAuthFailedOnKeyNotExist(t *testing.T) {
 	_, keyStore := initializeKeyStoreWithUnExpiredKey(keystore.Allow, keystore.Allow, ".*")
 	if err := checkPermission(keyStore, randomBytes(32), "test", false, false); err != nil {
@@ -139,6 +171,30 @@ func TestAuthLoadSave(t *testing.T) {
 	}
 }
 
+func TestBridgeLimitsLoadSave(t *testing.T) {
+	keyStore := keystore.CreateKeyStore()
+	key := randomBytes(32)
+	keyStore.RegisterKey(key, keystore.SessionKey{
+		Expire:            time.Now().Add(time.Hour),
+		BridgeIdleTimeout: keystore.Duration(90 * time.Second),
+	})
+	configFile := path.Join(t.TempDir(), "auth.json")
+	if err := keyStore.Save(configFile); err != nil {
+		t.Fatal(err)
+	}
+	loadedKeyStore, err := keystore.LoadKeyStore(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionKey := loadedKeyStore.GetSessionKey(key)
+	if sessionKey == nil {
+		t.Fatal("key not found")
+	}
+	if time.Duration(sessionKey.BridgeIdleTimeout) != 90*time.Second || sessionKey.BridgeMaxLifetime != 0 {
+		t.Errorf("unexpected bridge limits: %v, %v", sessionKey.BridgeIdleTimeout, sessionKey.BridgeMaxLifetime)
+	}
+}
+
 func TestAuthCleanUp(t *testing.T) {
 	key, keyStore := initializeKeyStoreWithUnExpiredKey(keystore.Allow, keystore.Deny, "test")
 	keyStore.Table[keystore.HashKey(key)].Expire = time.Now().Add(-time.Hour)
@@ -154,3 +210,486 @@ func TestNoPlainTokenStored(t *testing.T) {
 		t.Error("key is stored in plain text")
 	}
 }
+
+func TestReservedChannels(t *testing.T) {
+	keyStore := keystore.CreateKeyStore()
+	rules := []keystore.ACLRule{{ListenControl: keystore.Allow, ChannelRegexp: ".*"}}
+	owner, other := randomBytes(32), randomBytes(32)
+	keyStore.RegisterKey(owner, keystore.SessionKey{
+		ID: "owner", Expire: time.Now().Add(time.Hour), Rules: rules, ReservedChannels: []string{"reserved"},
+	})
+	keyStore.RegisterKey(other, keystore.SessionKey{ID: "other", Expire: time.Now().Add(time.Hour), Rules: rules})
+
+	if !keyStore.CheckPermission(keystore.ListenAction, "reserved", owner) {
+		t.Error("owner should be able to listen on the reserved channel")
+	}
+	if keyStore.CheckPermission(keystore.ListenAction, "reserved", other) {
+		t.Error("other keys should not be able to listen on the reserved channel")
+	}
+	if !keyStore.CheckPermission(keystore.ListenAction, "reserved-2", other) {
+		t.Error("reservation should match the exact channel name")
+	}
+
+	// The reservation follows changes of the owner.
+	if err := keyStore.UpdateKey(owner, keystore.SessionKey{
+		ID: "owner", Expire: time.Now().Add(time.Hour), Rules: rules, ReservedChannels: []string{"reserved-2"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !keyStore.CheckPermission(keystore.ListenAction, "reserved", other) {
+		t.Error("released reservation should not apply")
+	}
+	if keyStore.CheckPermission(keystore.ListenAction, "reserved-2", other) {
+		t.Error("new reservation should apply")
+	}
+	if err := keyStore.DeleteHashKey(keystore.HashKey(owner)); err != nil {
+		t.Fatal(err)
+	}
+	if !keyStore.CheckPermission(keystore.ListenAction, "reserved-2", other) {
+		t.Error("reservation of a removed key should not apply")
+	}
+}
+
+func TestInvalidRulesRejected(t *testing.T) {
+	keyStore := keystore.CreateKeyStore()
+	key := randomBytes(32)
+	invalid := keystore.SessionKey{
+		Expire: time.Now().Add(time.Hour),
+		Rules:  []keystore.ACLRule{{InvokeControl: keystore.Allow, ChannelRegexp: "test("}},
+	}
+	if err := keyStore.RegisterKey(key, invalid); err == nil {
+		t.Error("expect RegisterKey to reject invalid rules")
+	}
+	if err := keyStore.UpdateKey(key, invalid); err == nil {
+		t.Error("expect UpdateKey to reject invalid rules")
+	}
+	if keyStore.GetSessionKey(key) != nil {
+		t.Error("invalid key should not be stored")
+	}
+
+	configFile := path.Join(t.TempDir(), "auth.json")
+	if err := os.WriteFile(configFile, []byte(`{"table": {"key": {"id": "bad", "rules": [{"invoke": 1, "channel_regexp": "test("}]}}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keystore.LoadKeyStore(configFile); err == nil {
+		t.Error("expect LoadKeyStore to reject invalid rules")
+	}
+}
+
+func TestDecisionCacheInvalidatedOnUpdate(t *testing.T) {
+	key, keyStore := initializeKeyStoreWithUnExpiredKey(keystore.Allow, keystore.Deny, "test")
+	if err := checkPermission(keyStore, key, "test", true, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyStore.UpdateKey(key, keystore.SessionKey{
+		Expire: time.Now().Add(time.Hour),
+		Rules:  []keystore.ACLRule{{InvokeControl: keystore.Deny, ListenControl: keystore.Allow, ChannelRegexp: "test"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkPermission(keyStore, key, "test", false, true); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecisionCacheBounded(t *testing.T) {
+	key, keyStore := initializeKeyStoreWithUnExpiredKey(keystore.Allow, keystore.Deny, "test-.*")
+	keyStore.SetDecisionCacheSize(4)
+	for i := 0; i < 16; i++ {
+		if err := checkPermission(keyStore, key, fmt.Sprintf("test-%d", i), true, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := checkPermission(keyStore, key, "other", false, false); err != nil {
+		t.Error(err)
+	}
+}
+
+func createLargeKeyStore(b *testing.B, numRules int, cacheSize int) ([]byte, *keystore.KeyStore) {
+	rules := make([]keystore.ACLRule, 0, numRules)
+	for i := 0; i < numRules; i++ {
+		rules = append(rules, keystore.ACLRule{InvokeControl: keystore.Allow, ChannelRegexp: fmt.Sprintf("service-%d-[a-z]+", i)})
+	}
+	keyStore := keystore.CreateKeyStore()
+	keyStore.SetDecisionCacheSize(cacheSize)
+	key := randomBytes(32)
+	if err := keyStore.RegisterKey(key, keystore.SessionKey{Expire: time.Now().Add(time.Hour), Rules: rules}); err != nil {
+		b.Fatal(err)
+	}
+	return key, keyStore
+}
+
+func benchmarkCheckPermission(b *testing.B, numRules int, cacheSize int) {
+	key, keyStore := createLargeKeyStore(b, numRules, cacheSize)
+	channel := fmt.Sprintf("service-%d-test", numRules/2)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !keyStore.CheckPermission(keystore.InvokeAction, channel, key) {
+			b.Fatal("permission denied")
+		}
+	}
+}
+
+func BenchmarkCheckPermission(b *testing.B) {
+	for _, numRules := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("rules=%d/uncached", numRules), func(b *testing.B) {
+			benchmarkCheckPermission(b, numRules, 0)
+		})
+		b.Run(fmt.Sprintf("rules=%d/cached", numRules), func(b *testing.B) {
+			benchmarkCheckPermission(b, numRules, keystore.DefaultDecisionCacheSize)
+		})
+	}
+}
+
+// BenchmarkCheckPermissionRecompile measures matching rules by compiling the regexp on every request, as a baseline.
+func BenchmarkCheckPermissionRecompile(b *testing.B) {
+	for _, numRules := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("rules=%d", numRules), func(b *testing.B) {
+			channel := fmt.Sprintf("service-%d-test", numRules/2)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < numRules; j++ {
+					regexp.MatchString(fmt.Sprintf("service-%d-[a-z]+", j), channel)
+				}
+			}
+		})
+	}
+}
+
+func TestRoles(t *testing.T) {
+	keyStore := keystore.CreateKeyStore()
+	if err := keyStore.SetRole("kitchen", keystore.Role{Rules: []keystore.ACLRule{
+		{ListenControl: keystore.Allow, ChannelRegexp: "kitchen-.*"},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := keyStore.SetRole("viewer", keystore.Role{Rules: []keystore.ACLRule{
+		{InvokeControl: keystore.Allow, ChannelRegexp: ".*"},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	key := randomBytes(32)
+	if err := keyStore.RegisterKey(key, keystore.SessionKey{
+		ID:     "oven",
+		Expire: time.Now().Add(time.Hour),
+		Roles:  []string{"kitchen", "viewer"},
+		// Overrides the invoke permission granted by `viewer`, listen permission is left to the roles.
+		Rules: []keystore.ACLRule{{InvokeControl: keystore.Deny, ChannelRegexp: "admin"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkPermission(keyStore, key, "kitchen-oven", true, true); err != nil {
+		t.Error(err)
+	}
+	if err := checkPermission(keyStore, key, "admin", false, false); err != nil {
+		t.Error(err)
+	}
+
+	// Updating a role applies to all keys referring to it.
+	if err := keyStore.SetRole("kitchen", keystore.Role{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkPermission(keyStore, key, "kitchen-oven", true, false); err != nil {
+		t.Error(err)
+	}
+	if err := keyStore.DeleteRole("kitchen"); err == nil {
+		t.Error("expect roles in use cannot be deleted")
+	}
+	if err := keyStore.RegisterKey(randomBytes(32), keystore.SessionKey{ID: "unknown", Roles: []string{"unknown"}}); err == nil {
+		t.Error("expect keys referring to unknown roles to be rejected")
+	}
+}
+
+func TestLastMatchingRuleWins(t *testing.T) {
+	keyStore := keystore.CreateKeyStore()
+	key := randomBytes(32)
+	if err := keyStore.RegisterKey(key, keystore.SessionKey{
+		Expire: time.Now().Add(time.Hour),
+		Rules: []keystore.ACLRule{
+			{InvokeControl: keystore.Allow, ChannelRegexp: ".*"},
+			{ListenControl: keystore.Allow, ChannelRegexp: "secret"},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// The last matching rule leaves invoke undefined, which overrides the earlier allow.
+	if err := checkPermission(keyStore, key, "secret", false, true); err != nil {
+		t.Error(err)
+	}
+	if err := checkPermission(keyStore, key, "public", true, false); err != nil {
+		t.Error(err)
+	}
+	if decision := keyStore.Explain(keystore.InvokeAction, "secret", key, keystore.RequestContext{}); decision.Allowed {
+		t.Errorf("expect Explain to deny, got %s", decision)
+	}
+}
+
+func TestRolesLoadSave(t *testing.T) {
+	keyStore := keystore.CreateKeyStore()
+	if err := keyStore.SetRole("kitchen", keystore.Role{Rules: []keystore.ACLRule{
+		{ListenControl: keystore.Allow, ChannelRegexp: "kitchen-.*"},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	key := randomBytes(32)
+	if err := keyStore.RegisterKey(key, keystore.SessionKey{Expire: time.Now().Add(time.Hour), Roles: []string{"kitchen"}}); err != nil {
+		t.Fatal(err)
+	}
+	configFile := path.Join(t.TempDir(), "auth.json")
+	if err := keyStore.Save(configFile); err != nil {
+		t.Fatal(err)
+	}
+	loadedKeyStore, err := keystore.LoadKeyStore(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkPermission(loadedKeyStore, key, "kitchen-oven", false, true); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLoadFlatKeyStore(t *testing.T) {
+	configFile := path.Join(t.TempDir(), "auth.json")
+	key := randomBytes(32)
+	data := fmt.Sprintf(`{"table": {"%s": {"id": "flat", "expire": "%s", "rules": [{"listen": 1, "channel_regexp": ".*"}]}}}`,
+		keystore.HashKey(key), time.Now().Add(time.Hour).Format(time.RFC3339))
+	if err := os.WriteFile(configFile, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keyStore, err := keystore.LoadKeyStore(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkPermission(keyStore, key, "test", false, true); err != nil {
+		t.Error(err)
+	}
+	if err := keyStore.SetRole("kitchen", keystore.Role{}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSourceCondition(t *testing.T) {
+	keyStore := keystore.CreateKeyStore()
+	key := randomBytes(32)
+	if err := keyStore.RegisterKey(key, keystore.SessionKey{
+		Expire: time.Now().Add(time.Hour),
+		Rules: []keystore.ACLRule{
+			{InvokeControl: keystore.Allow, ChannelRegexp: ".*"},
+			{InvokeControl: keystore.Deny, ChannelRegexp: "tv.*", SourceCIDRs: []string{"192.168.1.0/24", "10.0.0.1"}},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, testCase := range []struct {
+		ip      string
+		allowed bool
+	}{
+		{"192.168.1.20", false},
+		{"10.0.0.1", false},
+		{"10.0.0.2", true},
+		{"172.16.0.1", true},
+	} {
+		context := keystore.RequestContext{RemoteIP: net.ParseIP(testCase.ip)}
+		if allowed := keyStore.CheckPermissionWithContext(keystore.InvokeAction, "tv-living-room", key, context); allowed != testCase.allowed {
+			t.Errorf("from %s: expect %v, got %v", testCase.ip, testCase.allowed, allowed)
+		}
+	}
+	if keyStore.CheckPermission(keystore.InvokeAction, "tv-living-room", key) {
+		t.Error("deny rules with source conditions should apply to requests without an address")
+	}
+}
+
+func TestTimeWindowCondition(t *testing.T) {
+	keyStore := keystore.CreateKeyStore()
+	key := randomBytes(32)
+	if err := keyStore.RegisterKey(key, keystore.SessionKey{
+		Expire: time.Now().Add(time.Hour),
+		Rules: []keystore.ACLRule{
+			{InvokeControl: keystore.Allow, ChannelRegexp: "tv.*", TimeWindows: []keystore.TimeWindow{
+				{Days: []string{"mon", "tue", "wed", "thu", "fri"}, Start: "16:00", End: "20:00", TimeZone: "UTC"},
+				{Days: []string{"sat"}, Start: "22:00", End: "02:00", TimeZone: "UTC"},
+			}},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, testCase := range []struct {
+		time    string
+		allowed bool
+	}{
+		{"2022-03-07T16:00:00Z", true},  // Monday
+		{"2022-03-07T19:59:59Z", true},  // Monday
+		{"2022-03-07T20:00:00Z", false}, // Monday
+		{"2022-03-07T15:00:00Z", false}, // Monday
+		{"2022-03-06T17:00:00Z", false}, // Sunday
+		{"2022-03-05T23:00:00Z", true},  // Saturday
+		{"2022-03-06T01:00:00Z", true},  // Sunday, within the window started on Saturday
+		{"2022-03-07T01:00:00Z", false}, // Monday
+	} {
+		now, err := time.Parse(time.RFC3339, testCase.time)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed := keyStore.CheckPermissionWithContext(keystore.InvokeAction, "tv", key, keystore.RequestContext{Time: now}); allowed != testCase.allowed {
+			t.Errorf("at %s: expect %v, got %v", testCase.time, testCase.allowed, allowed)
+		}
+	}
+}
+
+func TestInvalidConditionsRejected(t *testing.T) {
+	for _, rule := range []keystore.ACLRule{
+		{ChannelRegexp: ".*", SourceCIDRs: []string{"not an address"}},
+		{ChannelRegexp: ".*", TimeWindows: []keystore.TimeWindow{{Start: "25:00", End: "26:00"}}},
+		{ChannelRegexp: ".*", TimeWindows: []keystore.TimeWindow{{Start: "10:00", End: "11:00", Days: []string{"someday"}}}},
+		{ChannelRegexp: ".*", TimeWindows: []keystore.TimeWindow{{Start: "10:00", End: "11:00", TimeZone: "Nowhere/Unknown"}}},
+	} {
+		if err := keystore.ValidateRules([]keystore.ACLRule{rule}); err == nil {
+			t.Errorf("expect rule %v to be rejected", rule)
+		}
+	}
+}
+
+func TestUpdateByID(t *testing.T) {
+	keyStore := keystore.CreateKeyStore()
+	for _, id := range []string{"alice", "bob"} {
+		if err := keyStore.RegisterKey([]byte(id), keystore.SessionKey{ID: id, Expire: time.Now().Add(time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hashKey, property, err := keyStore.FindKeyByID("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashKey != keystore.HashKey([]byte("alice")) {
+		t.Errorf("unexpected hashed key %s", hashKey)
+	}
+	if _, _, err := keyStore.FindKeyByID("carol"); err == nil {
+		t.Error("expect an error looking up an unknown ID")
+	}
+
+	property.ID = "bob"
+	if err := keyStore.UpdateHashKey(hashKey, *property); err == nil {
+		t.Error("expect an error renaming to an existing ID")
+	}
+	property.ID = "carol"
+	property.Rules = []keystore.ACLRule{{ChannelRegexp: ".*", InvokeControl: keystore.Allow}}
+	if err := keyStore.UpdateHashKey(hashKey, *property); err != nil {
+		t.Fatal(err)
+	}
+	if !keyStore.CheckPermission(keystore.InvokeAction, "channel", []byte("alice")) {
+		t.Error("expect the new rules to take effect")
+	}
+	if err := keyStore.UpdateHashKey(keystore.HashKey([]byte("unknown")), *property); err == nil {
+		t.Error("expect an error updating an unknown key")
+	}
+
+	if err := keyStore.DeleteHashKey(hashKey); err != nil {
+		t.Fatal(err)
+	}
+	if keyStore.GetSessionKey([]byte("alice")) != nil {
+		t.Error("expect the key to be deleted")
+	}
+	if err := keyStore.DeleteHashKey(hashKey); err == nil {
+		t.Error("expect an error deleting a deleted key")
+	}
+}
+
+func TestUpdateKeyByID(t *testing.T) {
+	keyStore := keystore.CreateKeyStore()
+	for _, id := range []string{"alice", "bob"} {
+		if err := keyStore.RegisterKey([]byte(id), keystore.SessionKey{ID: id, Expire: time.Now().Add(time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addRule := func(property *keystore.SessionKey) error {
+		property.Rules = append(property.Rules, keystore.ACLRule{ChannelRegexp: ".*", InvokeControl: keystore.Allow})
+		return nil
+	}
+	hashKey, property, err := keyStore.UpdateKeyByID("alice", addRule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashKey != keystore.HashKey([]byte("alice")) || len(property.Rules) != 1 {
+		t.Errorf("unexpected result %s: %v", hashKey, property)
+	}
+	if !keyStore.CheckPermission(keystore.InvokeAction, "channel", []byte("alice")) {
+		t.Error("expect the new rule to take effect")
+	}
+	if _, _, err := keyStore.UpdateKeyByID("carol", addRule); err == nil {
+		t.Error("expect an error updating an unknown ID")
+	}
+	if _, _, err := keyStore.UpdateKeyByID("alice", func(property *keystore.SessionKey) error {
+		property.ID = "bob"
+		return nil
+	}); err == nil {
+		t.Error("expect an error renaming to an existing ID")
+	}
+
+	keys := keyStore.Keys()
+	if len(keys) != 2 || keys[hashKey].ID != "alice" {
+		t.Errorf("unexpected keys %v", keys)
+	}
+
+	if _, property, err := keyStore.DeleteKeyByID("alice"); err != nil || property.ID != "alice" {
+		t.Fatalf("unexpected result %v: %v", property, err)
+	}
+	if keyStore.GetSessionKey([]byte("alice")) != nil {
+		t.Error("expect the key to be deleted")
+	}
+	if _, _, err := keyStore.DeleteKeyByID("alice"); err == nil {
+		t.Error("expect an error deleting a deleted key")
+	}
+}
+
+func TestExportMerge(t *testing.T) {
+	source := keystore.CreateKeyStore()
+	if err := source.SetRole("reader", keystore.Role{Rules: []keystore.ACLRule{{ChannelRegexp: ".*", InvokeControl: keystore.Allow}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.RegisterKey([]byte("alice"), keystore.SessionKey{ID: "alice", Expire: time.Now().Add(time.Hour), Roles: []string{"reader"}}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := source.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported, err := keystore.ParseKeyStore(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conflicting := keystore.CreateKeyStore()
+	if err := conflicting.RegisterKey([]byte("another"), keystore.SessionKey{ID: "alice", Expire: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := conflicting.Merge(exported); err == nil {
+		t.Error("expect an error merging a key with an existing ID")
+	}
+	if conflicting.GetRole("reader") != nil {
+		t.Error("expect nothing to be merged on error")
+	}
+
+	keyStore := keystore.CreateKeyStore()
+	if err := keyStore.Merge(exported); err != nil {
+		t.Fatal(err)
+	}
+	if !keyStore.CheckPermission(keystore.InvokeAction, "channel", []byte("alice")) {
+		t.Error("expect the key to be merged with its role")
+	}
+}
+
+func TestExpiringKeys(t *testing.T) {
+	keyStore := keystore.CreateKeyStore()
+	for id, expire := range map[string]time.Duration{"expired": -time.Hour, "tomorrow": 24 * time.Hour, "soon": time.Hour, "later": 30 * 24 * time.Hour} {
+		if err := keyStore.RegisterKey([]byte(id), keystore.SessionKey{ID: id, Expire: time.Now().Add(expire)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expiring := keyStore.ExpiringKeys(7 * 24 * time.Hour)
+	if len(expiring) != 2 || expiring[0].ID != "soon" || expiring[1].ID != "tomorrow" {
+		t.Fatalf("unexpected expiring keys: %v", expiring)
+	}
+	if expiring[0].Key != keystore.HashKey([]byte("soon")) {
+		t.Errorf("unexpected hashed key: %s", expiring[0].Key)
+	}
+}
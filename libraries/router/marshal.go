@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"net/url"
 
 	"github.com/xpy123993/yukino-net/libraries/router/proto"
 )
@@ -19,6 +20,7 @@ type Frame struct {
 }
 
 var nopFrame = Frame{Type: proto.Nop}
+var messageFrame = Frame{Type: proto.Message}
 
 func writeBytes(message []byte, writer io.Writer) error {
 	if err := binary.Write(writer, binary.BigEndian, uint16(len(message))); err != nil {
@@ -49,6 +51,32 @@ func readBytes(reader io.Reader) ([]byte, error) {
 	return buf, nil
 }
 
+// encodeMetadata encodes `metadata` into a frame payload.
+func encodeMetadata(metadata map[string]string) (string, error) {
+	values := url.Values{}
+	for key, value := range metadata {
+		values.Set(key, value)
+	}
+	payload := values.Encode()
+	if len(payload) > MaxChannelNameLength {
+		return "", fmt.Errorf("metadata too large: %d > %d bytes encoded", len(payload), MaxChannelNameLength)
+	}
+	return payload, nil
+}
+
+// decodeMetadata decodes a frame payload written by encodeMetadata.
+func decodeMetadata(payload string) (map[string]string, error) {
+	values, err := url.ParseQuery(payload)
+	if err != nil {
+		return nil, err
+	}
+	metadata := make(map[string]string, len(values))
+	for key := range values {
+		metadata[key] = values.Get(key)
+	}
+	return metadata, nil
+}
+
 func writeFrame(frame *Frame, writer io.Writer) error {
 	if err := binary.Write(writer, binary.BigEndian, frame.Type); err != nil {
 		return err
@@ -79,3 +107,33 @@ func readFrame(frame *Frame, reader io.Reader) error {
 	}
 	return nil
 }
+
+// writeMessage writes a length prefixed broadcast message, used after a Message frame.
+func writeMessage(message []byte, writer io.Writer) error {
+	if err := binary.Write(writer, binary.BigEndian, uint32(len(message))); err != nil {
+		return err
+	}
+	if n, err := writer.Write(message); err != nil {
+		return err
+	} else if n != len(message) {
+		return fmt.Errorf("message not fully write")
+	}
+	return nil
+}
+
+// readMessage reads a broadcast message written by writeMessage.
+// If `limit` is not zero, messages longer than `limit` bytes will be rejected.
+func readMessage(reader io.Reader, limit uint32) ([]byte, error) {
+	var messageLen uint32
+	if err := binary.Read(reader, binary.BigEndian, &messageLen); err != nil {
+		return nil, err
+	}
+	if limit > 0 && messageLen > limit {
+		return nil, fmt.Errorf("message length too large: %d > %d", messageLen, limit)
+	}
+	buf := make([]byte, messageLen)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
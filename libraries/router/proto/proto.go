@@ -12,4 +12,35 @@ const (
 	Nop = byte(iota)
 	// Close indicates the connection is closed. No ACL action specific control.
 	Close = byte(iota)
+	// Watch indicates the frame contains a watch request on all channels matching the regular expression in payload.
+	// Events are filtered by Invoke ACL of each channel.
+	Watch = byte(iota)
+	// Registered indicates the channel in payload is now served by a listener. Only sent to watchers.
+	Registered = byte(iota)
+	// Unregistered indicates the channel in payload is no longer served. Only sent to watchers.
+	Unregistered = byte(iota)
+	// Publish indicates the frame contains a request to publish messages to a broadcast channel. Controlled by Publish ACL.
+	Publish = byte(iota)
+	// Subscribe indicates the frame contains a request to receive messages from a broadcast channel. Controlled by Subscribe ACL.
+	Subscribe = byte(iota)
+	// Message indicates the frame is followed by a broadcast message. No ACL action specific control.
+	Message = byte(iota)
+	// Auth indicates the frame contains a bearer token in payload to authenticate the connection.
+	// If present, it must be the first frame on the connection, followed by the actual request frame.
+	Auth = byte(iota)
+	// Takeover indicates the frame contains a request to replace the listener of the channel in payload.
+	// The existing listener must be registered with the same key. Controlled by Listen ACL.
+	// The router also sends this frame to the replaced listener before closing its control connection.
+	Takeover = byte(iota)
+	// Metadata indicates the frame contains URL encoded metadata in payload for the following Dial or Anycast frame.
+	// If present, it must be right before that frame. The router passes it to the listener in the Bridge frame.
+	Metadata = byte(iota)
+	// Anycast indicates the frame contains a dial request to any of the comma separated candidates in payload.
+	// Candidates can be glob patterns, ConnectionID specifies the selection strategy.
+	// Each candidate is controlled by Invoke ACL.
+	Anycast = byte(iota)
+	// Trace indicates the frame contains the trace ID of the following Dial or Anycast frame in payload.
+	// If present, it must be right before the Metadata frame if any, or the dial request.
+	// The router generates a trace ID if not present, and passes it to the listener in the Bridge frame.
+	Trace = byte(iota)
 )
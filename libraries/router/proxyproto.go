@@ -0,0 +1,190 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xpy123993/yukino-net/libraries/common"
+)
+
+// DefaultProxyHeaderTimeout is the default timeout to receive a PROXY protocol header.
+const DefaultProxyHeaderTimeout = 5 * time.Second
+
+const (
+	// proxyV1MaxHeaderBytes is the maximum length of a v1 header including the trailing CRLF.
+	proxyV1MaxHeaderBytes = 107
+	// proxyV2HeaderBytes is the length of the fixed part of a v2 header.
+	proxyV2HeaderBytes = 16
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolListener parses PROXY protocol headers on connections from trusted proxies.
+type proxyProtocolListener struct {
+	net.Listener
+	trustedProxies []*net.IPNet
+	headerTimeout  time.Duration
+}
+
+// NewProxyProtocolListener wraps `listener` to support PROXY protocol v1 and v2.
+// Connections from `TrustedProxies` must start with a PROXY protocol header, and their `RemoteAddr` will report
+// the client address in the header. Connections from other addresses are returned untouched.
+// The header is parsed lazily on the first Read or RemoteAddr call, so Accept never blocks on slow clients.
+func NewProxyProtocolListener(listener net.Listener, TrustedProxies []*net.IPNet, HeaderTimeout time.Duration) net.Listener {
+	return &proxyProtocolListener{
+		Listener:       listener,
+		trustedProxies: TrustedProxies,
+		headerTimeout:  HeaderTimeout,
+	}
+}
+
+// Accept implements net.Listener.
+func (listener *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !common.ContainsIP(listener.trustedProxies, common.AddrIP(conn.RemoteAddr())) {
+		return conn, nil
+	}
+	return &proxyProtocolConn{
+		Conn:          conn,
+		reader:        bufio.NewReader(conn),
+		headerTimeout: listener.headerTimeout,
+	}, nil
+}
+
+// proxyProtocolConn is a connection starting with a PROXY protocol header.
+type proxyProtocolConn struct {
+	net.Conn
+	reader        *bufio.Reader
+	headerTimeout time.Duration
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (conn *proxyProtocolConn) parseHeader() {
+	conn.once.Do(func() {
+		if conn.headerTimeout > 0 {
+			conn.Conn.SetReadDeadline(time.Now().Add(conn.headerTimeout))
+			defer conn.Conn.SetReadDeadline(time.Time{})
+		}
+		conn.remoteAddr, conn.err = readProxyHeader(conn.reader)
+		if conn.err != nil {
+			conn.err = fmt.Errorf("invalid PROXY protocol header from %s: %v", conn.Conn.RemoteAddr().String(), conn.err)
+		}
+	})
+}
+
+// Read implements net.Conn.
+func (conn *proxyProtocolConn) Read(p []byte) (int, error) {
+	conn.parseHeader()
+	if conn.err != nil {
+		return 0, conn.err
+	}
+	return conn.reader.Read(p)
+}
+
+// RemoteAddr returns the client address reported by the proxy, or the proxy address if not available.
+func (conn *proxyProtocolConn) RemoteAddr() net.Addr {
+	conn.parseHeader()
+	if conn.remoteAddr != nil {
+		return conn.remoteAddr
+	}
+	return conn.Conn.RemoteAddr()
+}
+
+// CloseWrite shuts down the writing side of the underlying connection.
+func (conn *proxyProtocolConn) CloseWrite() error {
+	return common.CloseWrite(conn.Conn)
+}
+
+// readProxyHeader consumes a PROXY protocol header from `reader` and returns the source address in it.
+// A nil address is returned if the header does not carry one, e.g. health checks from the proxy itself.
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	signature, err := reader.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(signature, proxyV2Signature) {
+		return readProxyV2Header(reader)
+	}
+	prefix, err := reader.Peek(6)
+	if err != nil {
+		return nil, err
+	}
+	if string(prefix) != "PROXY " {
+		return nil, fmt.Errorf("missing header")
+	}
+	return readProxyV1Header(reader)
+}
+
+func readProxyV1Header(reader *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, proxyV1MaxHeaderBytes)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxHeaderBytes {
+			return nil, fmt.Errorf("v1 header too long")
+		}
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed v1 source address")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2Header(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, proxyV2HeaderBytes)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", header[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+	switch header[12] & 0xF {
+	case 0:
+		// LOCAL command, the connection is established by the proxy itself.
+		return nil, nil
+	case 1:
+		// PROXY command, the address block carries the real client address.
+	default:
+		return nil, fmt.Errorf("unsupported command %d", header[12]&0xF)
+	}
+	switch header[13] >> 4 {
+	case 1:
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("truncated IPv4 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 2:
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("truncated IPv6 address block")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,95 @@
+package router_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xpy123993/yukino-net/libraries/common"
+	"github.com/xpy123993/yukino-net/libraries/router"
+)
+
+func proxyV2Header(ip net.IP, port uint16) []byte {
+	buf := bytes.Buffer{}
+	buf.WriteString("\r\n\r\n\x00\r\nQUIT\n")
+	buf.Write([]byte{0x21, 0x11})
+	binary.Write(&buf, binary.BigEndian, uint16(12))
+	buf.Write(ip.To4())
+	buf.Write(net.IPv4(192, 0, 2, 2).To4())
+	binary.Write(&buf, binary.BigEndian, port)
+	binary.Write(&buf, binary.BigEndian, uint16(443))
+	return buf.Bytes()
+}
+
+func testProxyProtocol(t *testing.T, trusted string, header []byte, expectAddr string, expectPayload string) {
+	trustedProxies, err := common.ParseCIDRs([]string{trusted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := router.NewProxyProtocolListener(tcpListener, trustedProxies, time.Second)
+	defer listener.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write(append(header, []byte("hello")...))
+	}()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if len(expectAddr) > 0 && conn.RemoteAddr().String() != expectAddr {
+		t.Errorf("address mismatch, expect %s, got %s", expectAddr, conn.RemoteAddr().String())
+	}
+	payload, err := io.ReadAll(conn)
+	if len(expectPayload) == 0 {
+		if err == nil {
+			t.Errorf("expect an error here")
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(payload) != expectPayload {
+		t.Errorf("content mismatch, expect %q, got %q", expectPayload, string(payload))
+	}
+}
+
+func TestProxyProtocolV1(t *testing.T) {
+	testProxyProtocol(t, "127.0.0.1", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 12345 443\r\n"), "192.0.2.1:12345", "hello")
+	testProxyProtocol(t, "127.0.0.0/8", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 443\r\n"), "[2001:db8::1]:12345", "hello")
+	testProxyProtocol(t, "127.0.0.0/8", []byte("PROXY UNKNOWN\r\n"), "", "hello")
+}
+
+func TestProxyProtocolV2(t *testing.T) {
+	testProxyProtocol(t, "127.0.0.1", proxyV2Header(net.IPv4(192, 0, 2, 1), 12345), "192.0.2.1:12345", "hello")
+}
+
+func TestProxyProtocolV2UnknownCommand(t *testing.T) {
+	header := proxyV2Header(net.IPv4(192, 0, 2, 1), 12345)
+	// Version 2 with an undefined command.
+	header[12] = 0x22
+	testProxyProtocol(t, "127.0.0.1", header, "", "")
+}
+
+func TestProxyProtocolUntrustedSource(t *testing.T) {
+	header := "PROXY TCP4 192.0.2.1 192.0.2.2 12345 443\r\n"
+	testProxyProtocol(t, "10.0.0.0/8", []byte(header), "", header+"hello")
+}
+
+func TestProxyProtocolMissingHeader(t *testing.T) {
+	testProxyProtocol(t, "127.0.0.1", []byte{}, "", "")
+}
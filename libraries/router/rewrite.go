@@ -0,0 +1,70 @@
+package router
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// RewriteRule maps a requested channel name to the actual channel before the router looks up the listener.
+// ACL is evaluated against the requested name, see `RequireTargetPermission` to check the target as well.
+type RewriteRule struct {
+	// Channel matches the requested channel name exactly. Either `Channel` or `Pattern` should be set.
+	Channel string `json:"channel,omitempty"`
+	// Pattern matches the whole requested channel name with a regular expression.
+	Pattern string `json:"pattern,omitempty"`
+	// Target is the channel to be dialed. For `Pattern` rules, capture groups like `$1` can be referenced.
+	Target string `json:"target"`
+	// RequireTargetPermission requires the dialer to also have Invoke permission on the target channel.
+	RequireTargetPermission bool `json:"require-target-permission,omitempty"`
+}
+
+type compiledRewriteRule struct {
+	RewriteRule
+	pattern *regexp.Regexp
+}
+
+// SetRewriteRules replaces the rewrite rules of the router. Rules are evaluated in order, the first match applies.
+// Existing rules are kept if any of `rules` is invalid.
+func (router *Router) SetRewriteRules(rules []RewriteRule) error {
+	compiledRules := make([]compiledRewriteRule, 0, len(rules))
+	for i, rule := range rules {
+		if len(rule.Target) == 0 {
+			return fmt.Errorf("rule %d: target is empty", i)
+		}
+		if (len(rule.Channel) == 0) == (len(rule.Pattern) == 0) {
+			return fmt.Errorf("rule %d: exactly one of channel and pattern should be set", i)
+		}
+		compiledRule := compiledRewriteRule{RewriteRule: rule}
+		if len(rule.Pattern) > 0 {
+			pattern, err := regexp.Compile("^(?:" + rule.Pattern + ")$")
+			if err != nil {
+				return fmt.Errorf("rule %d: %v", i, err)
+			}
+			compiledRule.pattern = pattern
+		}
+		compiledRules = append(compiledRules, compiledRule)
+	}
+	router.mu.Lock()
+	router.rewriteRules = compiledRules
+	router.mu.Unlock()
+	return nil
+}
+
+// rewriteChannel returns the actual channel of `channel`, and whether the target requires Invoke permission.
+func (router *Router) rewriteChannel(channel string) (string, bool) {
+	router.mu.RLock()
+	rules := router.rewriteRules
+	router.mu.RUnlock()
+	for _, rule := range rules {
+		if rule.pattern == nil {
+			if rule.Channel == channel {
+				return rule.Target, rule.RequireTargetPermission
+			}
+			continue
+		}
+		if match := rule.pattern.FindStringSubmatchIndex(channel); match != nil {
+			return string(rule.pattern.ExpandString(nil, rule.Target, channel, match)), rule.RequireTargetPermission
+		}
+	}
+	return channel, false
+}
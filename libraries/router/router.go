@@ -1,16 +1,19 @@
 package router
 
 import (
-	"bufio"
-	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"regexp"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/xpy123993/yukino-net/libraries/common"
 	"github.com/xpy123993/yukino-net/libraries/router/keystore"
 	"github.com/xpy123993/yukino-net/libraries/router/proto"
 )
@@ -22,20 +25,62 @@ const (
 	DefaultListenConnectionKeepAlive = 20 * time.Second
 	// DefaultServerBufferBytes is the default buffer size to exchange between connections.
 	DefaultServerBufferBytes = 4096
+	// DefaultHalfCloseTimeout is the default time a half-closed bridge can stay idle before being torn down.
+	DefaultHalfCloseTimeout = time.Minute
+	// DefaultBridgeIdleTimeout is the default time a bridge can stay without any traffic before being torn down.
+	DefaultBridgeIdleTimeout = 30 * time.Minute
+	// DefaultHandshakeTimeout is the default time a connection can take to finish TLS handshake and send its request.
+	DefaultHandshakeTimeout = 10 * time.Second
+	// DefaultMaxPendingHandshakes is the default number of connections allowed to stay unauthenticated at the same time.
+	DefaultMaxPendingHandshakes = 1024
+	// DefaultAuthFailureBanDuration is the default time an address is banned after too many authentication failures.
+	DefaultAuthFailureBanDuration = 10 * time.Minute
+	// DefaultActivationTimeout is the default time a dial waits for an on-demand service to register.
+	DefaultActivationTimeout = 30 * time.Second
+
+	// DefaultBroadcastBufferSize is the default number of messages buffered for each subscriber.
+	DefaultBroadcastBufferSize = 16
+	// DefaultMaxMessageBytes is the default size limit of a broadcast message.
+	DefaultMaxMessageBytes = 64 * 1024
+
+	// watchEventBufferSize is the number of pending events a watcher can hold before being dropped.
+	watchEventBufferSize = 64
+)
+
+const (
+	// DropOnSlowSubscriber drops messages to subscribers whose buffer is full.
+	DropOnSlowSubscriber = iota
+	// BlockOnSlowSubscriber blocks the publisher until the subscriber has room in its buffer.
+	// Subscribers that cannot catch up within `DialConnectionTimeout` will be disconnected.
+	BlockOnSlowSubscriber = iota
 )
 
 // Authority will b e used by the router for ACL control.
 type Authority interface {
-	// Returns if the permission check is passed for `frame`.
-	CheckPermission(frame *Frame, key []byte) bool
+	// Returns if the permission check is passed for `frame` sent by a connection from `remoteAddr`.
+	CheckPermission(frame *Frame, key []byte, remoteAddr net.Addr) bool
 
 	// Returns the expiration time of the key. Router will use this to set a connection deadline.
 	GetExpirationTime(key []byte) time.Time
 }
 
+// BridgeLimitAuthority can be optionally implemented by an Authority to tighten bridge limits per key.
+type BridgeLimitAuthority interface {
+	// Returns the idle timeout and the maximum lifetime of bridges involving `key`.
+	// Zero values fall back to the router option, other values only apply if stricter than the router option.
+	GetBridgeLimits(key []byte) (idleTimeout time.Duration, maxLifetime time.Duration)
+}
+
+// PermissionExplainer can be optionally implemented by an Authority to explain permission checks.
+// In debug mode, the router logs the explanation of each denied request.
+type PermissionExplainer interface {
+	// Returns how the permission check of `frame` sent by a connection from `remoteAddr` is decided.
+	ExplainPermission(frame *Frame, key []byte, remoteAddr net.Addr) string
+}
+
 type noPermissionCheckAuthority struct{}
 
-func (*noPermissionCheckAuthority) CheckPermission(*Frame, []byte) bool { return true }
+func (*noPermissionCheckAuthority) CheckPermission(*Frame, []byte, net.Addr) bool { return true }
 func (*noPermissionCheckAuthority) GetExpirationTime([]byte) time.Time {
 	return time.Now().Add(24 * time.Hour)
 }
@@ -50,8 +95,54 @@ type Option struct {
 	ListenConnectionKeepAlive time.Duration
 	// TLSConfig specifies the TLS setting, if empty, the traffic will not be encrypted.
 	TLSConfig *tls.Config
+	// CertificateKey returns the key of a peer identified by its TLS certificate.
+	// If nil, the signature of the certificate will be used.
+	CertificateKey func(certificate *x509.Certificate) []byte
+	// Debug enables verbose logs, e.g. why requests are denied if TokenAuthority implements PermissionExplainer.
+	Debug bool
 	// ChannelBufferBytes specifies the size of the buffer while bridging the channel.
 	ChannelBufferBytes uint64
+	// BroadcastDelivery specifies how to deliver broadcast messages to slow subscribers.
+	// Can be DropOnSlowSubscriber or BlockOnSlowSubscriber.
+	BroadcastDelivery int
+	// BroadcastBufferSize specifies the number of messages buffered for each subscriber.
+	// Non-positive values fall back to DefaultBroadcastBufferSize.
+	BroadcastBufferSize int
+	// MaxMessageBytes limits the size of a single broadcast message. Zero falls back to DefaultMaxMessageBytes.
+	MaxMessageBytes uint32
+	// BridgeIdleTimeout specifies how long a bridge can stay without traffic in either direction. Zero means no limit.
+	BridgeIdleTimeout time.Duration
+	// BridgeMaxLifetime specifies the maximum duration of a bridge. Zero means no limit besides key expiration.
+	BridgeMaxLifetime time.Duration
+	// TrustedProxies specifies the address ranges of load balancers in front of the router.
+	// Connections from these addresses must start with a PROXY protocol v1/v2 header carrying the real client address.
+	// Only used by ListenAndServe.
+	TrustedProxies []*net.IPNet
+	// Activator, if not nil, starts on-demand services when a dial targets an unregistered channel.
+	Activator Activator
+	// ActivationTimeout specifies how long a dial waits for an activated service to register.
+	ActivationTimeout time.Duration
+	// ActivationIdleTimeout specifies how long an activated service can stay without bridges before being stopped.
+	// Zero means activated services are never stopped.
+	ActivationIdleTimeout time.Duration
+	// HandshakeTimeout limits the time to finish TLS handshake and send the request frame. Zero means no limit.
+	HandshakeTimeout time.Duration
+	// MaxPendingHandshakes limits the number of connections that have not finished the handshake.
+	// Connections beyond the limit are closed immediately. Zero means no limit.
+	MaxPendingHandshakes int
+	// AcceptRatePerIP limits new connections per second from a single IP address. Zero means no limit.
+	AcceptRatePerIP float64
+	// AcceptBurstPerIP specifies the burst size of `AcceptRatePerIP`.
+	AcceptBurstPerIP int
+	// AuthFailureLimit specifies the number of consecutive authentication failures before an IP address is banned.
+	// Only rejected certificates, unknown or expired keys count as failures. Addresses in `TrustedProxies` are never
+	// banned. Zero disables banning.
+	AuthFailureLimit int
+	// AuthFailureBanDuration specifies how long an IP address is banned.
+	AuthFailureBanDuration time.Duration
+	// ChannelReservationTTL binds a channel to the key that registered it. Other keys cannot register the channel
+	// while it is registered, or until the TTL passes after the owner unregisters. Zero disables the binding.
+	ChannelReservationTTL time.Duration
 }
 
 // DefaultRouterOption is a set of parameters in default value.
@@ -60,62 +151,252 @@ var DefaultRouterOption = Option{
 	DialConnectionTimeout:     DefaultDialConnectionTimeout,
 	ListenConnectionKeepAlive: DefaultListenConnectionKeepAlive,
 	ChannelBufferBytes:        DefaultServerBufferBytes,
+	BroadcastDelivery:         DropOnSlowSubscriber,
+	BroadcastBufferSize:       DefaultBroadcastBufferSize,
+	MaxMessageBytes:           DefaultMaxMessageBytes,
+	BridgeIdleTimeout:         DefaultBridgeIdleTimeout,
+	ActivationTimeout:         DefaultActivationTimeout,
+	HandshakeTimeout:          DefaultHandshakeTimeout,
+	MaxPendingHandshakes:      DefaultMaxPendingHandshakes,
+	AuthFailureBanDuration:    DefaultAuthFailureBanDuration,
+}
+
+// watcher stores a subscription to channel presence events.
+type watcher struct {
+	pattern *regexp.Regexp
+	key     []byte
+	// Address of the watcher, for permission checks of the events.
+	remoteAddr net.Addr
+	conn       *routerConnection
+	events     chan Frame
+}
+
+// pendingDial stores a dial request waiting for the listener to bridge.
+type pendingDial struct {
+	dialContext
+	conn    *routerConnection
+	key     []byte
+	channel string // the channel selected for the dial request.
+}
+
+// dialContext stores the options sent along with a dial request.
+type dialContext struct {
+	traceID string
+	// Number of the trace ID if generated by the Router, returned to the dialer. Zero if supplied by the dialer.
+	traceNumber uint64
+	metadata    string // encoded metadata of the dial request.
+}
+
+// channelOwner stores the key bound to a channel.
+type channelOwner struct {
+	keyID  string
+	expire time.Time // zero while the channel is registered.
+}
+
+// receiver stores the control connection of a registered listener.
+type receiver struct {
+	conn  *routerConnection
+	keyID string
 }
 
 // Router proxies requests.
 type Router struct {
 	option           Option
 	mu               sync.RWMutex
-	receiverTable    map[string]*routerConnection // control channel to the receiver.
-	inflightTable    map[uint64]*routerConnection
+	receiverTable    map[string]*receiver // control channel to the receiver.
+	inflightTable    map[uint64]*pendingDial
+	watcherTable     map[uint64]*watcher
+	subscriberTable  map[string]map[uint64]*subscriber // subscribers of each broadcast channel.
+	rewriteRules     []compiledRewriteRule
+	ownerTable       map[string]*channelOwner
+	activationTable  map[string]*activation
+	handshakeSlots   chan struct{}
+	guard            connectionGuard
 	nextConnectionID uint64
 }
 
 // NewRouter creates a Router structure.
 func NewRouter(option Option) *Router {
+	if option.BroadcastBufferSize <= 0 {
+		option.BroadcastBufferSize = DefaultBroadcastBufferSize
+	}
+	if option.MaxMessageBytes == 0 {
+		option.MaxMessageBytes = DefaultMaxMessageBytes
+	}
+	var handshakeSlots chan struct{}
+	if option.MaxPendingHandshakes > 0 {
+		handshakeSlots = make(chan struct{}, option.MaxPendingHandshakes)
+	}
 	return &Router{
 		mu:            sync.RWMutex{},
-		receiverTable: make(map[string]*routerConnection),
-		inflightTable: make(map[uint64]*routerConnection),
+		receiverTable: make(map[string]*receiver),
+		inflightTable: make(map[uint64]*pendingDial),
+		watcherTable:  make(map[uint64]*watcher),
 		option:        option,
+
+		subscriberTable: make(map[string]map[uint64]*subscriber),
+		ownerTable:      make(map[string]*channelOwner),
+		activationTable: make(map[string]*activation),
+		handshakeSlots:  handshakeSlots,
+		guard:           connectionGuard{records: make(map[string]*addressRecord)},
 	}
 }
 
 // NewDefaultRouter creates a router with default option.
 func NewDefaultRouter() *Router {
-	return &Router{
-		mu:            sync.RWMutex{},
-		receiverTable: make(map[string]*routerConnection),
-		option:        DefaultRouterOption,
-		inflightTable: map[uint64]*routerConnection{},
+	return NewRouter(DefaultRouterOption)
+}
+
+// notifyWatchers queues a presence event to all watchers interested in `channel`.
+// Must be called with `router.mu` held so that events are ordered with the receiver table.
+func (router *Router) notifyWatchers(eventType byte, channel string) {
+	for _, w := range router.watcherTable {
+		if !w.pattern.MatchString(channel) {
+			continue
+		}
+		select {
+		case w.events <- Frame{Type: eventType, Payload: channel}:
+		default:
+			log.Printf("dropping watcher %s: too many pending events", w.conn.Connection.RemoteAddr().String())
+			go w.conn.close()
+		}
+	}
+}
+
+// handleWatch streams presence events of channels matching the pattern in `frame`.
+// Only channels that `key` is allowed to invoke are reported.
+// `expiration` is the deadline of `conn`, which is kept by the connection checker.
+func (router *Router) handleWatch(frame *Frame, key []byte, conn net.Conn, expiration time.Time) error {
+	pattern, err := regexp.Compile(frame.Payload)
+	if err != nil {
+		return writeFrame(&Frame{
+			Type:    proto.Close,
+			Payload: fmt.Sprintf("invalid pattern: %v", err),
+		}, conn)
+	}
+	w := &watcher{
+		pattern:    pattern,
+		key:        key,
+		remoteAddr: conn.RemoteAddr(),
+		conn:       newConnWithDeadline(conn, expiration),
+		events:     make(chan Frame, watchEventBufferSize),
 	}
+	// The watcher is registered along with the snapshot, so that later events are queued after the snapshot.
+	router.mu.Lock()
+	watcherID := router.nextConnectionID
+	router.nextConnectionID++
+	router.watcherTable[watcherID] = w
+	snapshot := []string{}
+	for channel := range router.receiverTable {
+		if pattern.MatchString(channel) {
+			snapshot = append(snapshot, channel)
+		}
+	}
+	router.mu.Unlock()
+	sort.Strings(snapshot)
+
+	defer func() {
+		router.mu.Lock()
+		delete(router.watcherTable, watcherID)
+		router.mu.Unlock()
+	}()
+
+	if err := w.conn.writeFrame(&nopFrame); err != nil {
+		return err
+	}
+	// The snapshot is written directly rather than queued, so that it is not limited by `watchEventBufferSize`.
+	for _, channel := range snapshot {
+		if err := router.writeWatchEvent(w, &Frame{Type: proto.Registered, Payload: channel}); err != nil {
+			return err
+		}
+	}
+
+	go func() {
+		for {
+			select {
+			case event := <-w.events:
+				if err := router.writeWatchEvent(w, &event); err != nil {
+					w.conn.close()
+					return
+				}
+			case <-w.conn.Closed:
+				return
+			}
+		}
+	}()
+	w.conn.SpawnConnectionChecker(router.option.ListenConnectionKeepAlive)
+
+	<-w.conn.Closed
+	return nil
+}
+
+// writeWatchEvent sends `event` to the watcher if it is allowed to invoke the channel.
+func (router *Router) writeWatchEvent(w *watcher, event *Frame) error {
+	if !router.option.TokenAuthority.CheckPermission(&Frame{Type: proto.Dial, Payload: event.Payload}, w.key, w.remoteAddr) {
+		return nil
+	}
+	return w.conn.writeFrame(event)
 }
 
 // handleListen handles a listen type of connection.
+// If `takeover` is true, an active listener registered with the same key will be replaced.
+// `expiration` is the deadline of `conn`, which is kept by the connection checker.
 // It is caller's responsibility to close the connection.
-func (router *Router) handleListen(channel string, conn net.Conn) error {
-	controlConnection := newConn(conn)
+func (router *Router) handleListen(channel string, key []byte, conn net.Conn, expiration time.Time, takeover bool) error {
+	controlConnection := newConnWithDeadline(conn, expiration)
+	keyID := keystore.HashKey(key)
 
 	router.mu.Lock()
-	if conn, exists := router.receiverTable[channel]; exists {
-		if conn.probe() {
+	if router.channelReserved(channel, keyID) {
+		router.mu.Unlock()
+		log.Printf("channel `%s` is reserved, rejected registration from token `%s` at address `%s`",
+			channel, keyID, conn.RemoteAddr().String())
+		return writeFrame(&Frame{
+			Type:    proto.Close,
+			Payload: fmt.Sprintf("channel %s is reserved by another key", channel),
+		}, controlConnection.Connection)
+	}
+	handover := false
+	if existing, exists := router.receiverTable[channel]; exists {
+		switch {
+		case takeover && existing.keyID == keyID:
+			handover = true
+			// The previous listener drains its in-flight bridges and leaves by itself.
+			log.Printf("channel `%s` is taken over by address `%s`", channel, conn.RemoteAddr().String())
+			existing.conn.writeFrame(&Frame{Type: proto.Takeover, Payload: channel})
+			existing.conn.close()
+		case existing.conn.probe():
 			// The listening thread is still active.
 			router.mu.Unlock()
 			return writeFrame(&Frame{
 				Type:    proto.Close,
 				Payload: fmt.Sprintf("channel %s is already registered", channel),
 			}, controlConnection.Connection)
+		default:
+			// Listening thread is dead, trigger the cleanup.
+			// Its own cleanup skips the event as the channel is taken over below.
+			existing.conn.close()
+			router.notifyWatchers(proto.Unregistered, channel)
 		}
-		// Listening thread is dead, trigger the cleanup.
-		conn.close()
 	}
-	router.receiverTable[channel] = controlConnection
+	router.claimChannel(channel, keyID)
+	registered := &receiver{conn: controlConnection, keyID: keyID}
+	router.receiverTable[channel] = registered
+	if !handover {
+		router.notifyWatchers(proto.Registered, channel)
+	}
+	router.notifyActivation(channel)
 	router.mu.Unlock()
 
 	defer func() {
 		router.mu.Lock()
-		if controlConnection == router.receiverTable[channel] {
+		if registered == router.receiverTable[channel] {
 			delete(router.receiverTable, channel)
+			router.notifyWatchers(proto.Unregistered, channel)
+			if owner, exists := router.ownerTable[channel]; exists {
+				owner.expire = time.Now().Add(router.option.ChannelReservationTTL)
+				time.AfterFunc(router.option.ChannelReservationTTL, func() { router.releaseChannel(channel, owner) })
+			}
 		}
 		router.mu.Unlock()
 	}()
@@ -130,8 +411,39 @@ func (router *Router) handleListen(channel string, conn net.Conn) error {
 	return nil
 }
 
-// handleDial handles a dial request.
-func (router *Router) handleDial(frame *Frame, conn net.Conn) error {
+// channelReserved returns true if `channel` is bound to a key other than `keyID`.
+// An expired binding is removed. Must be called with `router.mu` held.
+func (router *Router) channelReserved(channel string, keyID string) bool {
+	owner, exists := router.ownerTable[channel]
+	if !exists {
+		return false
+	}
+	if !owner.expire.IsZero() && time.Now().After(owner.expire) {
+		delete(router.ownerTable, channel)
+		return false
+	}
+	return owner.keyID != keyID
+}
+
+// claimChannel binds `channel` to `keyID` if `ChannelReservationTTL` is set.
+// Must be called with `router.mu` held, once the registration is accepted.
+func (router *Router) claimChannel(channel string, keyID string) {
+	if router.option.ChannelReservationTTL > 0 {
+		router.ownerTable[channel] = &channelOwner{keyID: keyID}
+	}
+}
+
+// releaseChannel removes the binding `owner` of `channel` once expired, unless the channel has been claimed again.
+func (router *Router) releaseChannel(channel string, owner *channelOwner) {
+	router.mu.Lock()
+	defer router.mu.Unlock()
+	if router.ownerTable[channel] == owner && time.Now().After(owner.expire) {
+		delete(router.ownerTable, channel)
+	}
+}
+
+// handleDial handles a dial request, the trace ID and metadata in `dial` will be passed to the listener as is.
+func (router *Router) handleDial(frame *Frame, key []byte, dial *dialContext, conn net.Conn) error {
 	dialConnection := newConn(conn)
 	if dialConn, ok := conn.(*net.TCPConn); ok {
 		dialConn.SetKeepAlive(true)
@@ -139,9 +451,33 @@ func (router *Router) handleDial(frame *Frame, conn net.Conn) error {
 	}
 	conn.SetDeadline(time.Now().Add(router.option.DialConnectionTimeout))
 
+	var candidates []string
+	if frame.Type == proto.Anycast {
+		candidates = router.anycastCandidates(frame.Payload, key, conn.RemoteAddr())
+	} else {
+		channel, requireTargetPermission := router.rewriteChannel(frame.Payload)
+		if requireTargetPermission && !router.option.TokenAuthority.CheckPermission(&Frame{Type: proto.Dial, Payload: channel}, key, conn.RemoteAddr()) {
+			log.Printf("%spermission denied: peer token `%s` from address `%s` on rewritten channel `%s`",
+				tracePrefix(dial.traceID), keystore.HashKey(key), conn.RemoteAddr().String(), channel)
+			router.explainDenied(dial.traceID, &Frame{Type: proto.Dial, Payload: channel}, key, conn.RemoteAddr())
+			return writeFrame(&Frame{Type: proto.Close, Payload: "permission denied"}, dialConnection.Connection)
+		}
+		candidates = []string{channel}
+	}
+
+	channel, registered := router.selectReceiver(candidates, frame.ConnectionID)
+	if registered == nil && frame.Type == proto.Dial {
+		router.waitForActivation(candidates[0], dialConnection.Closed)
+		channel, registered = router.selectReceiver(candidates, frame.ConnectionID)
+	}
+	// Probing and activation take time, the dial timeout starts over for the bridge.
+	conn.SetDeadline(time.Now().Add(router.option.DialConnectionTimeout))
 	router.mu.Lock()
-	controlConnection, exist := router.receiverTable[frame.Payload]
-	if !exist {
+	if registered != nil {
+		// The listener may have been replaced while selecting.
+		registered = router.receiverTable[channel]
+	}
+	if registered == nil {
 		router.mu.Unlock()
 		return writeFrame(&Frame{
 			Type:    proto.Close,
@@ -150,17 +486,21 @@ func (router *Router) handleDial(frame *Frame, conn net.Conn) error {
 	}
 	connectionID := router.nextConnectionID
 	router.nextConnectionID++
-	router.inflightTable[connectionID] = dialConnection
+	router.inflightTable[connectionID] = &pendingDial{conn: dialConnection, key: key, channel: channel, dialContext: *dial}
+	controlConnection := registered.conn
+	activated := router.acquireActivation(channel)
 	router.mu.Unlock()
 
 	defer func() {
 		router.mu.Lock()
 		delete(router.inflightTable, connectionID)
 		router.mu.Unlock()
+		router.releaseActivation(channel, activated)
 	}()
 	if err := controlConnection.writeFrame(&Frame{
 		Type:         proto.Bridge,
 		ConnectionID: connectionID,
+		Payload:      dial.traceID,
 	}); err != nil {
 		controlConnection.close()
 		return err
@@ -170,14 +510,37 @@ func (router *Router) handleDial(frame *Frame, conn net.Conn) error {
 	return nil
 }
 
-func (router *Router) handleBridge(frame *Frame, conn net.Conn) error {
-	ctx, cancelFn := context.WithCancel(context.Background())
-	defer cancelFn()
+// explainDenied logs why `frame` is denied in debug mode, if the authority implements PermissionExplainer.
+func (router *Router) explainDenied(traceID string, frame *Frame, key []byte, remoteAddr net.Addr) {
+	if !router.option.Debug {
+		return
+	}
+	if explainer, ok := router.option.TokenAuthority.(PermissionExplainer); ok {
+		log.Printf("%sdebug: %s", tracePrefix(traceID), explainer.ExplainPermission(frame, key, remoteAddr))
+	}
+}
 
+// bridgeLimits returns the idle timeout and maximum lifetime of a bridge between `keys`.
+// The strictest limit among the router option and all keys applies.
+func (router *Router) bridgeLimits(keys ...[]byte) (time.Duration, time.Duration) {
+	idleTimeout, maxLifetime := router.option.BridgeIdleTimeout, router.option.BridgeMaxLifetime
+	authority, ok := router.option.TokenAuthority.(BridgeLimitAuthority)
+	if !ok {
+		return idleTimeout, maxLifetime
+	}
+	for _, key := range keys {
+		keyIdleTimeout, keyMaxLifetime := authority.GetBridgeLimits(key)
+		idleTimeout = common.MinTimeout(idleTimeout, keyIdleTimeout)
+		maxLifetime = common.MinTimeout(maxLifetime, keyMaxLifetime)
+	}
+	return idleTimeout, maxLifetime
+}
+
+func (router *Router) handleBridge(frame *Frame, key []byte, conn net.Conn) error {
 	connection := newConn(conn)
 
 	router.mu.Lock()
-	peerConn, exist := router.inflightTable[frame.ConnectionID]
+	dial, exist := router.inflightTable[frame.ConnectionID]
 	delete(router.inflightTable, frame.ConnectionID)
 	router.mu.Unlock()
 	if !exist {
@@ -186,30 +549,34 @@ func (router *Router) handleBridge(frame *Frame, conn net.Conn) error {
 			Payload: "handshake failed, might be failed due to timeout",
 		}, connection.Connection)
 	}
+	peerConn := dial.conn
 	peerConn.Connection.SetDeadline(time.Time{})
 
 	if err := peerConn.writeFrame(&Frame{
-		Type: proto.Bridge,
+		Type:         proto.Bridge,
+		ConnectionID: dial.traceNumber,
+		Payload:      dial.channel,
 	}); err != nil {
 		return err
 	}
 	if err := connection.writeFrame(&Frame{
-		Type: proto.Bridge,
+		Type:    proto.Bridge,
+		Payload: dial.metadata,
 	}); err != nil {
 		return err
 	}
 
-	go func() {
-		io.Copy(peerConn.Connection, bufio.NewReaderSize(conn, int(router.option.ChannelBufferBytes)))
-		cancelFn()
-	}()
-
-	go func() {
-		io.Copy(conn, bufio.NewReaderSize(peerConn.Connection, int(router.option.ChannelBufferBytes)))
-		cancelFn()
-	}()
-
-	<-ctx.Done()
+	idleTimeout, maxLifetime := router.bridgeLimits(dial.key, key)
+	err := common.Bridge(conn, peerConn.Connection, common.BridgeOption{
+		BufferBytes:      int(router.option.ChannelBufferBytes),
+		HalfCloseTimeout: DefaultHalfCloseTimeout,
+		IdleTimeout:      idleTimeout,
+		MaxLifetime:      maxLifetime,
+	})
+	if err == common.ErrBridgeIdleTimeout || err == common.ErrBridgeLifetimeExceeded {
+		log.Printf("%sbridge %d on channel `%s` between %s and %s is cut: %v", tracePrefix(dial.traceID), frame.ConnectionID, dial.channel,
+			peerConn.Connection.RemoteAddr().String(), conn.RemoteAddr().String(), err)
+	}
 
 	peerConn.close()
 	connection.close()
@@ -221,31 +588,124 @@ func (router *Router) handleConnection(conn net.Conn) error {
 	defer conn.Close()
 	frame := Frame{}
 
-	if err := readFrame(&frame, conn); err != nil {
-		log.Printf("closing connection from %v due to error: %v", conn.RemoteAddr(), err)
-		return writeFrame(&Frame{Type: proto.Close, Payload: "invalid request"}, conn)
+	if router.handshakeSlots != nil {
+		select {
+		case router.handshakeSlots <- struct{}{}:
+		default:
+			return fmt.Errorf("too many pending handshakes, dropping connection from %s", conn.RemoteAddr().String())
+		}
+	}
+	handshaking := true
+	finishHandshake := func() {
+		if handshaking && router.handshakeSlots != nil {
+			<-router.handshakeSlots
+		}
+		handshaking = false
+	}
+	defer finishHandshake()
+	var handshakeDeadline time.Time
+	if router.option.HandshakeTimeout > 0 {
+		handshakeDeadline = time.Now().Add(router.option.HandshakeTimeout)
 	}
+	conn.SetDeadline(handshakeDeadline)
+
+	// RemoteAddr may block on reading a PROXY protocol header, which resets the read deadline afterwards.
+	remoteIP := common.AddrIP(conn.RemoteAddr())
+	conn.SetDeadline(handshakeDeadline)
+	if common.ContainsIP(router.option.TrustedProxies, remoteIP) {
+		// Failures of clients behind the proxy should not ban the proxy itself.
+		remoteIP = nil
+	}
+	if !router.allowConnection(remoteIP) {
+		return nil
+	}
+
 	var key []byte
 	if tlsConn, ok := conn.(*tls.Conn); ok {
 		if err := tlsConn.Handshake(); err != nil {
-			return fmt.Errorf("handshake failed with %s", conn.RemoteAddr().String())
+			if isCredentialError(err) {
+				router.recordAuthResult(remoteIP, false)
+			}
+			return fmt.Errorf("handshake failed with %s: %v", conn.RemoteAddr().String(), err)
 		}
-		key = tlsConn.ConnectionState().PeerCertificates[0].Signature
+		if certificates := tlsConn.ConnectionState().PeerCertificates; len(certificates) > 0 {
+			if router.option.CertificateKey != nil {
+				key = router.option.CertificateKey(certificates[0])
+			} else {
+				key = certificates[0].Signature
+			}
+		}
+	}
+	if err := readFrame(&frame, conn); err != nil {
+		log.Printf("closing connection from %v due to error: %v", conn.RemoteAddr(), err)
+		return writeFrame(&Frame{Type: proto.Close, Payload: "invalid request"}, conn)
 	}
-	if !router.option.TokenAuthority.CheckPermission(&frame, key) {
-		log.Printf("permission denied: peer token `%s` from address `%s`",
-			keystore.HashKey(key), conn.RemoteAddr().String())
+	if frame.Type == proto.Auth {
+		if key != nil {
+			// A connection is identified by either its certificate or a bearer token, never both.
+			return writeFrame(&Frame{Type: proto.Close, Payload: "token is not allowed with a client certificate"}, conn)
+		}
+		token, err := base64.RawStdEncoding.DecodeString(frame.Payload)
+		if err != nil {
+			router.recordAuthResult(remoteIP, false)
+			return writeFrame(&Frame{Type: proto.Close, Payload: "invalid token"}, conn)
+		}
+		key = keystore.TokenKey(token)
+		if err := readFrame(&frame, conn); err != nil {
+			log.Printf("closing connection from %v due to error: %v", conn.RemoteAddr(), err)
+			return writeFrame(&Frame{Type: proto.Close, Payload: "invalid request"}, conn)
+		}
+	}
+	dial := dialContext{}
+	if frame.Type == proto.Trace {
+		dial.traceID = frame.Payload
+		if err := readFrame(&frame, conn); err != nil || validateTraceID(dial.traceID) != nil {
+			log.Printf("closing connection from %v due to invalid request after trace: %v", conn.RemoteAddr(), err)
+			return writeFrame(&Frame{Type: proto.Close, Payload: "invalid request"}, conn)
+		}
+	}
+	if frame.Type == proto.Metadata {
+		dial.metadata = frame.Payload
+		if err := readFrame(&frame, conn); err != nil {
+			log.Printf("closing connection from %v due to invalid request after metadata: %v", conn.RemoteAddr(), err)
+			return writeFrame(&Frame{Type: proto.Close, Payload: "invalid request"}, conn)
+		}
+	}
+	if (len(dial.traceID) > 0 || len(dial.metadata) > 0) && frame.Type != proto.Dial && frame.Type != proto.Anycast {
+		log.Printf("closing connection from %v due to invalid request type %d after dial options", conn.RemoteAddr(), frame.Type)
+		return writeFrame(&Frame{Type: proto.Close, Payload: "invalid request"}, conn)
+	}
+	if (frame.Type == proto.Dial || frame.Type == proto.Anycast) && len(dial.traceID) == 0 {
+		dial.traceNumber = newTraceNumber()
+		dial.traceID = formatTraceID(dial.traceNumber)
+	}
+	expiration := router.option.TokenAuthority.GetExpirationTime(key)
+	// Only unknown or expired keys count as authentication failures, not denied requests of valid keys.
+	router.recordAuthResult(remoteIP, expiration.After(time.Now()))
+	if !router.option.TokenAuthority.CheckPermission(&frame, key, conn.RemoteAddr()) {
+		log.Printf("%spermission denied: peer token `%s` from address `%s`",
+			tracePrefix(dial.traceID), keystore.HashKey(key), conn.RemoteAddr().String())
+		router.explainDenied(dial.traceID, &frame, key, conn.RemoteAddr())
 		return writeFrame(&Frame{Type: proto.Close, Payload: "permission denied"}, conn)
 	}
-	conn.SetDeadline(router.option.TokenAuthority.GetExpirationTime(key))
+	finishHandshake()
+	conn.SetDeadline(expiration)
 
 	switch frame.Type {
 	case proto.Listen:
-		return router.handleListen(frame.Payload, conn)
+		return router.handleListen(frame.Payload, key, conn, expiration, false)
+	case proto.Takeover:
+		return router.handleListen(frame.Payload, key, conn, expiration, true)
 	case proto.Bridge:
-		return router.handleBridge(&frame, conn)
-	case proto.Dial:
-		return router.handleDial(&frame, conn)
+		return router.handleBridge(&frame, key, conn)
+	case proto.Dial, proto.Anycast:
+		return router.handleDial(&frame, key, &dial, conn)
+	case proto.Watch:
+		return router.handleWatch(&frame, key, conn, expiration)
+	case proto.Publish:
+		return router.handlePublish(frame.Payload, conn)
+	case proto.Subscribe:
+		return router.handleSubscribe(frame.Payload, conn, expiration)
 	}
 	return nil
 }
@@ -267,15 +727,16 @@ func (router *Router) Serve(listener net.Listener) error {
 
 // ListenAndServe will try to listen on the specified address.
 func (router *Router) ListenAndServe(Address string) error {
-	var err error
-	var listener net.Listener
-	if router.option.TLSConfig != nil {
-		listener, err = tls.Listen("tcp", Address, router.option.TLSConfig)
-	} else {
-		listener, err = net.Listen("tcp", Address)
-	}
+	listener, err := net.Listen("tcp", Address)
 	if err != nil {
 		return err
 	}
+	// PROXY protocol headers are sent in plain text before the TLS handshake.
+	if len(router.option.TrustedProxies) > 0 {
+		listener = NewProxyProtocolListener(listener, router.option.TrustedProxies, DefaultProxyHeaderTimeout)
+	}
+	if router.option.TLSConfig != nil {
+		listener = tls.NewListener(listener, router.option.TLSConfig)
+	}
 	return router.Serve(listener)
 }
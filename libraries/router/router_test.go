@@ -1,18 +1,24 @@
 package router_test
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/xpy123993/yukino-net/libraries/common"
 	"github.com/xpy123993/yukino-net/libraries/router"
+	"github.com/xpy123993/yukino-net/libraries/router/keystore"
+	"github.com/xpy123993/yukino-net/libraries/router/proto"
 )
 
 func acceptAndEqual(listener net.Listener, message string) error {
@@ -49,12 +55,12 @@ type myTokenAuthrority struct {
 	clientCert *tls.Certificate
 }
 
-func (*permissionDeniedAuthority) CheckPermission(*router.Frame, []byte) bool { return false }
+func (*permissionDeniedAuthority) CheckPermission(*router.Frame, []byte, net.Addr) bool { return false }
 func (*permissionDeniedAuthority) GetExpirationTime([]byte) time.Time {
 	return time.Now().Add(24 * time.Hour)
 }
 
-func (auth *myTokenAuthrority) CheckPermission(frame *router.Frame, token []byte) bool {
+func (auth *myTokenAuthrority) CheckPermission(frame *router.Frame, token []byte, _ net.Addr) bool {
 	if auth.clientCert == nil {
 		return true
 	}
@@ -98,6 +104,41 @@ func TestPermissionDenied(t *testing.T) {
 	listener.Close()
 }
 
+type explainingAuthority struct {
+	permissionDeniedAuthority
+	explained chan *router.Frame
+}
+
+func (auth *explainingAuthority) ExplainPermission(frame *router.Frame, _ []byte, _ net.Addr) string {
+	auth.explained <- frame
+	return "denied for testing"
+}
+
+func TestExplainDenied(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	authority := &explainingAuthority{explained: make(chan *router.Frame, 1)}
+	option := router.DefaultRouterOption
+	option.TokenAuthority = authority
+	option.Debug = true
+	go router.NewRouter(option).Serve(listener)
+
+	if _, err := router.NewListenerWithoutAuth(listener.Addr().String(), "test-channel"); err == nil {
+		t.Fatal("expect an error here")
+	}
+	select {
+	case frame := <-authority.explained:
+		if frame.Type != proto.Listen || frame.Payload != "test-channel" {
+			t.Errorf("unexpected frame explained: %v", frame)
+		}
+	case <-time.After(time.Second):
+		t.Error("expect the denied request to be explained in debug mode")
+	}
+}
+
 func testSuite(t *testing.T, channel string, listener *router.Listener, client *router.Client) {
 	pending := sync.WaitGroup{}
 	testMessage := []byte("hello world")
@@ -256,6 +297,52 @@ func TestCloseListener(t *testing.T) {
 	}
 }
 
+func TestCertificateKey(t *testing.T) {
+	ca, priv, pub, err := common.GenerateTestCertSuite()
+	if err != nil {
+		t.Fatalf("cannot generate test certificates")
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+	cert, err := tls.X509KeyPair(pub, priv)
+	if err != nil {
+		t.Fatalf("invalid certificate received")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyStore := keystore.CreateKeyStore()
+	if err := keyStore.RegisterKey(keystore.SPKIKey(leaf), keystore.SessionKey{
+		Expire: time.Now().Add(time.Hour),
+		Rules:  []keystore.ACLRule{{ListenControl: keystore.Allow, InvokeControl: keystore.Allow, ChannelRegexp: "test"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	option := router.DefaultRouterOption
+	option.TLSConfig = &tls.Config{
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	option.TokenAuthority = &keyStoreAuthority{keyStore: keyStore}
+	option.CertificateKey = keystore.SPKIKey
+	listener, err := tls.Listen("tcp", ":0", option.TLSConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go router.NewRouter(option).Serve(listener)
+
+	tlsConfig := &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}, ServerName: "test"}
+	testListener, err := router.NewListener(listener.Addr().String(), "test", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSuite(t, "test", testListener, router.NewClient(listener.Addr().String(), tlsConfig))
+}
+
 func TestE2EWithTLS(t *testing.T) {
 	ca, priv, pub, err := common.GenerateTestCertSuite()
 	if err != nil {
@@ -298,57 +385,1378 @@ func TestE2EWithTLSAuthFailed(t *testing.T) {
 	tlstestSuite(t, serverPool, nil, &serverCert, nil, false)
 }
 
-func BenchmarkSmallConnection(b *testing.B) {
-	b.SetParallelism(4)
-	listener, err := net.Listen("tcp", ":0")
+func testHalfClose(t *testing.T, listener *router.Listener, client *router.Client) {
+	pending := sync.WaitGroup{}
+	pending.Add(1)
+	go func() {
+		defer pending.Done()
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+		defer conn.Close()
+		request, err := io.ReadAll(conn)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+		// The response is only sent after the request is half-closed by the client.
+		if _, err := conn.Write(append([]byte("echo: "), request...)); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}()
+
+	conn, err := client.Dial("test")
 	if err != nil {
-		b.Fatalf(err.Error())
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := common.CloseWrite(conn); err != nil {
+		t.Fatal(err)
+	}
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != "echo: hello" {
+		t.Errorf("content mismatch, expect `echo: hello`, got `%s`", string(response))
+	}
+	pending.Wait()
+}
+
+func TestHalfClose(t *testing.T) {
+	testListener, testClient := initializeTestSet(t)
+	testHalfClose(t, testListener, testClient)
+}
+
+func TestHalfCloseWithTLS(t *testing.T) {
+	ca, priv, pub, err := common.GenerateTestCertSuite()
+	if err != nil {
+		t.Fatalf("cannot generate test certificates")
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+	cert, err := tls.X509KeyPair(pub, priv)
+	if err != nil {
+		t.Fatalf("invalid certificate received")
+	}
+	option := router.DefaultRouterOption
+	option.TLSConfig = &tls.Config{
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	option.TokenAuthority = &myTokenAuthrority{clientCert: &cert}
+	listener, err := tls.Listen("tcp", ":0", option.TLSConfig)
+	if err != nil {
+		t.Fatal(err)
 	}
 	defer listener.Close()
+	go router.NewRouter(option).Serve(listener)
 
-	pending := sync.WaitGroup{}
-	testRouter := router.NewDefaultRouter()
+	tlsConfig := &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}, ServerName: "test"}
+	testListener, err := router.NewListener(listener.Addr().String(), "test", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testListener.Close()
+	testHalfClose(t, testListener, router.NewClient(listener.Addr().String(), tlsConfig))
+}
+
+type bridgeLimitAuthority struct {
+	idleTimeout time.Duration
+}
+
+func (*bridgeLimitAuthority) CheckPermission(*router.Frame, []byte, net.Addr) bool { return true }
+func (*bridgeLimitAuthority) GetExpirationTime([]byte) time.Time {
+	return time.Now().Add(24 * time.Hour)
+}
+func (auth *bridgeLimitAuthority) GetBridgeLimits([]byte) (time.Duration, time.Duration) {
+	return auth.idleTimeout, 0
+}
+
+func TestBridgeIdleTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	option := router.DefaultRouterOption
+	option.TokenAuthority = &bridgeLimitAuthority{idleTimeout: 100 * time.Millisecond}
+	go router.NewRouter(option).Serve(listener)
 
+	testListener, err := router.NewListenerWithoutAuth(listener.Addr().String(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testListener.Close()
 	go func() {
-		testRouter.Serve(listener)
+		conn, err := testListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.ReadAll(conn)
 	}()
 
-	testListener, err := router.NewListenerWithoutAuth(listener.Addr().String(), "test-channel")
+	conn, err := router.NewClientWithoutAuth(listener.Addr().String()).Dial("test")
 	if err != nil {
-		b.Fatalf(err.Error())
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expect EOF, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("bridge is cut after %v, expect around 100ms", elapsed)
 	}
+}
 
-	testMessage := make([]byte, 8)
+type keyStoreAuthority struct {
+	keyStore *keystore.KeyStore
+}
 
-	b.ResetTimer()
+func (auth *keyStoreAuthority) CheckPermission(frame *router.Frame, key []byte, remoteAddr net.Addr) bool {
+	context := keystore.RequestContext{RemoteIP: common.AddrIP(remoteAddr)}
+	switch frame.Type {
+	case proto.Dial:
+		return auth.keyStore.CheckPermissionWithContext(keystore.InvokeAction, frame.Payload, key, context)
+	case proto.Listen, proto.Bridge, proto.Takeover:
+		return auth.keyStore.CheckPermissionWithContext(keystore.ListenAction, frame.Payload, key, context)
+	}
+	return false
+}
+func (auth *keyStoreAuthority) GetExpirationTime(key []byte) time.Time {
+	return auth.keyStore.GetExpireTime(key)
+}
 
-	go func() {
-		for i := 0; i < b.N; i++ {
-			conn, err := testListener.Accept()
-			if err != nil {
-				b.Fail()
-			}
-			go func(conn net.Conn) {
-				p := make([]byte, 8)
-				if _, err := conn.Read(p); err != nil {
-					b.Error(err)
-				}
-				conn.Close()
-			}(conn)
+func TestTokenAuth(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	keyStore := keystore.CreateKeyStore()
+	token := keyStore.GenerateKeyAndRegister("test", []keystore.ACLRule{
+		{ListenControl: keystore.Allow, InvokeControl: keystore.Allow, ChannelRegexp: "test"},
+	}, time.Hour)
+	option := router.DefaultRouterOption
+	option.TokenAuthority = &keyStoreAuthority{keyStore: keyStore}
+	go router.NewRouter(option).Serve(listener)
+
+	if _, err := router.NewListenerWithoutAuth(listener.Addr().String(), "test"); err == nil {
+		t.Error("expect an error here")
+	}
+	invalidClient := router.NewClientWithOption(listener.Addr().String(), router.ClientOption{Token: "invalid"})
+	if _, err := invalidClient.Dial("test"); err == nil {
+		t.Error("expect an error here")
+	}
+
+	testListener, err := router.NewListenerWithOption(listener.Addr().String(), "test", router.ClientOption{Token: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSuite(t, "test", testListener, router.NewClientWithOption(listener.Addr().String(), router.ClientOption{Token: token}))
+}
+
+func TestTokenNamespace(t *testing.T) {
+	ca, priv, pub, err := common.GenerateTestCertSuite()
+	if err != nil {
+		t.Fatalf("cannot generate test certificates")
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+	cert, err := tls.X509KeyPair(pub, priv)
+	if err != nil {
+		t.Fatalf("invalid certificate received")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyStore := keystore.CreateKeyStore()
+	for id, key := range map[string][]byte{"spki": keystore.SPKIKey(leaf), "signature": keystore.SignatureKey(leaf)} {
+		if err := keyStore.RegisterKey(key, keystore.SessionKey{
+			ID:     id,
+			Expire: time.Now().Add(time.Hour),
+			Rules:  []keystore.ACLRule{{ListenControl: keystore.Allow, InvokeControl: keystore.Allow, ChannelRegexp: "test"}},
+		}); err != nil {
+			t.Fatal(err)
 		}
-		pending.Done()
-	}()
+	}
+	option := router.DefaultRouterOption
+	option.TokenAuthority = &keyStoreAuthority{keyStore: keyStore}
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go router.NewRouter(option).Serve(listener)
+
+	// Tokens equal to certificate keys must not be accepted as the certificate.
+	for _, key := range [][]byte{keystore.SPKIKey(leaf), keystore.SignatureKey(leaf)} {
+		token := base64.RawStdEncoding.EncodeToString(key)
+		if _, err := router.NewListenerWithOption(listener.Addr().String(), "test", router.ClientOption{Token: token}); err == nil {
+			t.Errorf("expect token %s to be denied", token)
+		}
+	}
+
+	option.TLSConfig = &tls.Config{
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	option.CertificateKey = keystore.SPKIKey
+	tlsListener, err := tls.Listen("tcp", ":0", option.TLSConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tlsListener.Close()
+	go router.NewRouter(option).Serve(tlsListener)
+
+	// Connections with a client certificate cannot present a token.
+	tlsConfig := &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}, ServerName: "test"}
+	token := keyStore.GenerateKeyAndRegister("token", []keystore.ACLRule{
+		{ListenControl: keystore.Allow, InvokeControl: keystore.Allow, ChannelRegexp: "test"},
+	}, time.Hour)
+	if _, err := router.NewListenerWithOption(tlsListener.Addr().String(), "test", router.ClientOption{TLSConfig: tlsConfig, Token: token}); err == nil {
+		t.Error("expect a token along with a client certificate to be rejected")
+	}
+}
+
+func TestTokenAuthSourceCondition(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	keyStore := keystore.CreateKeyStore()
+	token := keyStore.GenerateKeyAndRegister("test", []keystore.ACLRule{
+		{ListenControl: keystore.Allow, InvokeControl: keystore.Allow, ChannelRegexp: "test", SourceCIDRs: []string{"127.0.0.0/8"}},
+		{ListenControl: keystore.Allow, InvokeControl: keystore.Allow, ChannelRegexp: "remote", SourceCIDRs: []string{"10.0.0.0/8"}},
+	}, time.Hour)
+	option := router.DefaultRouterOption
+	option.TokenAuthority = &keyStoreAuthority{keyStore: keyStore}
+	go router.NewRouter(option).Serve(listener)
+
+	client := router.NewClientWithOption(listener.Addr().String(), router.ClientOption{Token: token})
+	if _, err := router.NewListenerWithOption(listener.Addr().String(), "remote", router.ClientOption{Token: token}); err == nil {
+		t.Error("expect listening from a mismatched source to be denied")
+	}
+	testListener, err := router.NewListenerWithOption(listener.Addr().String(), "test", router.ClientOption{Token: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSuite(t, "test", testListener, client)
+}
+
+type denyInvokeAuthority struct {
+	channel string
+}
+
+func (auth *denyInvokeAuthority) CheckPermission(frame *router.Frame, _ []byte, _ net.Addr) bool {
+	return !(frame.Type == proto.Dial && frame.Payload == auth.channel)
+}
+func (*denyInvokeAuthority) GetExpirationTime([]byte) time.Time {
+	return time.Now().Add(24 * time.Hour)
+}
+
+func expectEvent(watcher *router.Watcher, channel string, registered bool) error {
+	event, err := watcher.Next()
+	if err != nil {
+		return err
+	}
+	if event.Channel != channel || event.Registered != registered {
+		return fmt.Errorf("unexpected event: %v, expect channel %s registered %v", *event, channel, registered)
+	}
+	return nil
+}
+
+func TestWatch(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	option := router.DefaultRouterOption
+	option.TokenAuthority = &denyInvokeAuthority{channel: "test-secret"}
+	option.ListenConnectionKeepAlive = 100 * time.Millisecond
+	testRouter := router.NewRouter(option)
+	go testRouter.Serve(listener)
+
+	existingListener, err := router.NewListenerWithoutAuth(listener.Addr().String(), "test-existing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer existingListener.Close()
 
 	testClient := router.NewClientWithoutAuth(listener.Addr().String())
+	watcher, err := testClient.Watch("^test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	if err := expectEvent(watcher, "test-existing", true); err != nil {
+		t.Fatal(err)
+	}
 
-	pending.Add(1)
-	for i := 0; i < b.N; i++ {
-		conn, err := testClient.Dial("test-channel")
+	for _, channel := range []string{"unmatched", "test-secret", "test-ok"} {
+		testListener, err := router.NewListenerWithoutAuth(listener.Addr().String(), channel)
 		if err != nil {
-			b.Fail()
+			t.Fatal(err)
 		}
-		conn.Write(testMessage)
-		conn.Close()
+		defer testListener.Close()
+	}
+	if err := expectEvent(watcher, "test-ok", true); err != nil {
+		t.Fatal(err)
+	}
+	existingListener.Close()
+	if err := expectEvent(watcher, "test-existing", false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchSnapshot(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go router.NewDefaultRouter().Serve(listener)
+
+	// More channels than a watcher can buffer.
+	expected := []string{}
+	for i := 0; i < 100; i++ {
+		channel := fmt.Sprintf("test-%03d", i)
+		testListener, err := router.NewListenerWithoutAuth(listener.Addr().String(), channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer testListener.Close()
+		expected = append(expected, channel)
+	}
+
+	watcher, err := router.NewClientWithoutAuth(listener.Addr().String()).Watch("^test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	for _, channel := range expected {
+		if err := expectEvent(watcher, channel, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWatchInvalidPattern(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go router.NewDefaultRouter().Serve(listener)
+
+	if _, err := router.NewClientWithoutAuth(listener.Addr().String()).Watch("("); err == nil {
+		t.Error("expect an error here")
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	option := router.DefaultRouterOption
+	option.BroadcastDelivery = router.BlockOnSlowSubscriber
+	go router.NewRouter(option).Serve(listener)
+	testClient := router.NewClientWithoutAuth(listener.Addr().String())
+
+	subscribers := []*router.Subscriber{}
+	for i := 0; i < 3; i++ {
+		subscriber, err := testClient.Subscribe("test-broadcast")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer subscriber.Close()
+		subscribers = append(subscribers, subscriber)
+	}
+	publisher, err := testClient.Publish("test-broadcast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+
+	messages := []string{"hello", "world"}
+	for _, message := range messages {
+		if err := publisher.Send([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, subscriber := range subscribers {
+		for _, message := range messages {
+			received, err := subscriber.Receive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(received) != message {
+				t.Errorf("content mismatch, expect %s, got %s", message, string(received))
+			}
+		}
+	}
+}
+
+func TestBroadcastDropOnSlowSubscriber(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	option := router.DefaultRouterOption
+	option.BroadcastDelivery = router.DropOnSlowSubscriber
+	// Zero values fall back to the defaults.
+	option.BroadcastBufferSize = 0
+	option.MaxMessageBytes = 0
+	go router.NewRouter(option).Serve(listener)
+	testClient := router.NewClientWithoutAuth(listener.Addr().String())
+
+	subscriber, err := testClient.Subscribe("test-broadcast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	publisher, err := testClient.Publish("test-broadcast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+
+	// The subscriber does not read until all messages are sent, which overflows its buffers.
+	const messageCount = 256
+	message := make([]byte, 32*1024)
+	for i := 0; i < messageCount; i++ {
+		binary.BigEndian.PutUint32(message, uint32(i))
+		if err := publisher.Send(message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	received := make(chan uint32, messageCount)
+	go func() {
+		defer close(received)
+		for {
+			message, err := subscriber.Receive()
+			if err != nil {
+				return
+			}
+			received <- binary.BigEndian.Uint32(message)
+		}
+	}()
+	count, last := 0, -1
+	for done := false; !done; {
+		select {
+		case index := <-received:
+			if int(index) <= last {
+				t.Fatalf("messages out of order: %d after %d", index, last)
+			}
+			count, last = count+1, int(index)
+		case <-time.After(500 * time.Millisecond):
+			done = true
+		}
+	}
+	if count == 0 || count >= messageCount {
+		t.Errorf("expect some messages to be dropped, received %d out of %d", count, messageCount)
+	}
+}
+
+func TestRewriteRules(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	option := router.DefaultRouterOption
+	option.TokenAuthority = &denyInvokeAuthority{channel: "kitchen-pi-2"}
+	testRouter := router.NewRouter(option)
+	if err := testRouter.SetRewriteRules([]router.RewriteRule{{Pattern: "("}}); err == nil {
+		t.Error("expect an error here")
+	}
+	if err := testRouter.SetRewriteRules([]router.RewriteRule{
+		{Channel: "kitchen-pi", Target: "kitchen-pi-2"},
+		{Pattern: `old\.(.*)`, Target: "kitchen-$1"},
+		{Channel: "strict", Target: "kitchen-pi-2", RequireTargetPermission: true},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	go testRouter.Serve(listener)
+
+	testListener, err := router.NewListenerWithoutAuth(listener.Addr().String(), "kitchen-pi-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testListener.Close()
+	testClient := router.NewClientWithoutAuth(listener.Addr().String())
+
+	for _, channel := range []string{"kitchen-pi", "old.pi-2"} {
+		pending := sync.WaitGroup{}
+		pending.Add(1)
+		go func() {
+			defer pending.Done()
+			if err := acceptAndEqual(testListener, channel); err != nil {
+				t.Error(err)
+			}
+		}()
+		if err := dialAndSend(testClient, channel, []byte(channel)); err != nil {
+			t.Errorf("dial %s: %v", channel, err)
+		}
+		pending.Wait()
+	}
+	for _, channel := range []string{"kitchen-pi-2", "strict", "old.unknown"} {
+		if err := dialAndSend(testClient, channel, []byte{}); err == nil {
+			t.Errorf("dial %s: expect an error here", channel)
+		}
+	}
+
+	// Anycast candidates are rewritten as well.
+	go func() {
+		if conn, err := testListener.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, channel, err := testClient.DialAnycast([]string{"strict", "kitchen-pi"}, router.AnycastOrdered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if channel != "kitchen-pi-2" {
+		t.Errorf("expect kitchen-pi-2, got %s", channel)
+	}
+	if _, _, err := testClient.DialAnycast([]string{"strict"}, router.AnycastOrdered); err == nil {
+		t.Error("expect an error here")
+	}
+}
+
+func BenchmarkSmallConnection(b *testing.B) {
+	b.SetParallelism(4)
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		b.Fatalf(err.Error())
+	}
+	defer listener.Close()
+
+	pending := sync.WaitGroup{}
+	testRouter := router.NewDefaultRouter()
+
+	go func() {
+		testRouter.Serve(listener)
+	}()
+
+	testListener, err := router.NewListenerWithoutAuth(listener.Addr().String(), "test-channel")
+	if err != nil {
+		b.Fatalf(err.Error())
+	}
+
+	testMessage := make([]byte, 8)
+
+	b.ResetTimer()
+
+	go func() {
+		for i := 0; i < b.N; i++ {
+			conn, err := testListener.Accept()
+			if err != nil {
+				b.Fail()
+			}
+			go func(conn net.Conn) {
+				p := make([]byte, 8)
+				if _, err := conn.Read(p); err != nil {
+					b.Error(err)
+				}
+				conn.Close()
+			}(conn)
+		}
+		pending.Done()
+	}()
+
+	testClient := router.NewClientWithoutAuth(listener.Addr().String())
+
+	pending.Add(1)
+	for i := 0; i < b.N; i++ {
+		conn, err := testClient.Dial("test-channel")
+		if err != nil {
+			b.Fail()
+		}
+		conn.Write(testMessage)
+		conn.Close()
 	}
 	pending.Wait()
 }
+
+func TestChannelReservation(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	keyStore := keystore.CreateKeyStore()
+	rules := []keystore.ACLRule{{ListenControl: keystore.Allow, ChannelRegexp: "test"}}
+	owner := router.ClientOption{Token: keyStore.GenerateKeyAndRegister("owner", rules, time.Hour)}
+	other := router.ClientOption{Token: keyStore.GenerateKeyAndRegister("other", rules, time.Hour)}
+	option := router.DefaultRouterOption
+	option.TokenAuthority = &keyStoreAuthority{keyStore: keyStore}
+	option.ListenConnectionKeepAlive = 100 * time.Millisecond
+	option.ChannelReservationTTL = 200 * time.Millisecond
+	go router.NewRouter(option).Serve(listener)
+
+	ownerListener, err := router.NewListenerWithOption(listener.Addr().String(), "test", owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := router.NewListenerWithOption(listener.Addr().String(), "test", other); err == nil {
+		t.Error("expect an error here")
+	}
+	ownerListener.Close()
+	if _, err := router.NewListenerWithOption(listener.Addr().String(), "test", other); err == nil {
+		t.Error("expect an error within the reservation TTL")
+	}
+	time.Sleep(500 * time.Millisecond)
+	otherListener, err := router.NewListenerWithOption(listener.Addr().String(), "test", other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherListener.Close()
+}
+
+func TestTakeover(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	keyStore := keystore.CreateKeyStore()
+	rules := []keystore.ACLRule{{ListenControl: keystore.Allow, InvokeControl: keystore.Allow, ChannelRegexp: "test"}}
+	owner := router.ClientOption{Token: keyStore.GenerateKeyAndRegister("owner", rules, time.Hour)}
+	other := router.ClientOption{Token: keyStore.GenerateKeyAndRegister("other", rules, time.Hour)}
+	option := router.DefaultRouterOption
+	option.TokenAuthority = &keyStoreAuthority{keyStore: keyStore}
+	go router.NewRouter(option).Serve(listener)
+	testClient := router.NewClientWithOption(listener.Addr().String(), owner)
+
+	oldListener, err := router.NewListenerWithOption(listener.Addr().String(), "test", owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer oldListener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := oldListener.Accept()
+		if err != nil {
+			t.Error(err)
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	inflightConn, err := testClient.Dial("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inflightConn.Close()
+	oldConn := <-accepted
+	if oldConn == nil {
+		t.FailNow()
+	}
+	defer oldConn.Close()
+
+	if _, err := router.NewTakeoverListenerWithOption(listener.Addr().String(), "test", other); err == nil {
+		t.Error("expect an error here")
+	}
+	newListener, err := router.NewTakeoverListenerWithOption(listener.Addr().String(), "test", owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newListener.Close()
+	testSuite(t, "test", newListener, testClient)
+
+	// The in-flight bridge should survive the handover.
+	if _, err := inflightConn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(oldConn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("unexpected result: %s, %v", string(buf), err)
+	}
+	if _, err := oldListener.Accept(); err != io.EOF {
+		t.Errorf("expect the previous listener to be closed, got %v", err)
+	}
+}
+
+func TestDialMetadata(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go router.NewDefaultRouter().Serve(listener)
+
+	testListener, err := router.NewListenerWithoutAuth(listener.Addr().String(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testListener.Close()
+	testClient := router.NewClientWithoutAuth(listener.Addr().String())
+
+	for _, metadata := range []map[string]string{{"service": "ssh", "port": "22"}, nil} {
+		go func(metadata map[string]string) {
+			conn, err := testClient.DialWithMetadata("test", metadata)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conn.Close()
+		}(metadata)
+		conn, err := testListener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := conn.(*router.Conn).NetConn().(*net.TCPConn); !ok {
+			t.Errorf("expect the underlying connection to be a TCP connection, got %T", conn.(*router.Conn).NetConn())
+		}
+		received := conn.(*router.Conn).Metadata()
+		if len(received) != len(metadata) {
+			t.Errorf("metadata mismatch, expect %v, got %v", metadata, received)
+		}
+		for key, value := range metadata {
+			if received[key] != value {
+				t.Errorf("metadata mismatch, expect %v, got %v", metadata, received)
+			}
+		}
+		conn.Close()
+	}
+
+	if _, err := testClient.DialWithMetadata("test", map[string]string{"key": string(make([]byte, router.MaxChannelNameLength))}); err == nil {
+		t.Error("expect an error here")
+	}
+}
+
+func TestDialAnycast(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	option := router.DefaultRouterOption
+	option.TokenAuthority = &denyInvokeAuthority{channel: "backup-1"}
+	go router.NewRouter(option).Serve(listener)
+
+	for _, channel := range []string{"backup-1", "backup-2", "backup-3"} {
+		testListener, err := router.NewListenerWithoutAuth(listener.Addr().String(), channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer testListener.Close()
+		go func() {
+			for {
+				conn, err := testListener.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+			}
+		}()
+	}
+	testClient := router.NewClientWithoutAuth(listener.Addr().String())
+
+	conn, channel, err := testClient.DialAnycast([]string{"primary", "backup-*"}, router.AnycastOrdered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if channel != "backup-2" {
+		t.Errorf("expect backup-2, got %s", channel)
+	}
+	for i := 0; i < 8; i++ {
+		conn, channel, err := testClient.DialAnycast([]string{"backup-3", "backup-*"}, router.AnycastRandom)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if channel != "backup-2" && channel != "backup-3" {
+			t.Errorf("unexpected channel %s", channel)
+		}
+	}
+	if _, _, err := testClient.DialAnycast([]string{"primary", "backup-1"}, router.AnycastOrdered); err == nil {
+		t.Error("expect an error here")
+	}
+	if _, _, err := testClient.DialAnycast([]string{"a,b"}, router.AnycastOrdered); err == nil {
+		t.Error("expect an error here")
+	}
+}
+
+func TestDialAnycastUnresponsiveListener(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go router.NewDefaultRouter().Serve(listener)
+
+	// Registers `backup-1` with a raw connection which never responds afterwards.
+	unresponsive, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unresponsive.Close()
+	request := bytes.Buffer{}
+	binary.Write(&request, binary.BigEndian, proto.Listen)
+	binary.Write(&request, binary.BigEndian, uint64(0))
+	binary.Write(&request, binary.BigEndian, uint16(len("backup-1")))
+	request.WriteString("backup-1")
+	if _, err := unresponsive.Write(request.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(unresponsive, make([]byte, 11)); err != nil {
+		t.Fatal(err)
+	}
+
+	testListener, err := router.NewListenerWithoutAuth(listener.Addr().String(), "backup-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testListener.Close()
+	go func() {
+		for {
+			conn, err := testListener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	conn, channel, err := router.NewClientWithoutAuth(listener.Addr().String()).DialAnycast([]string{"backup-*"}, router.AnycastOrdered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if channel != "backup-2" {
+		t.Errorf("expect backup-2, got %s", channel)
+	}
+}
+
+type expiringAuthority struct {
+	expiration time.Time
+}
+
+func (*expiringAuthority) CheckPermission(*router.Frame, []byte, net.Addr) bool { return true }
+func (auth *expiringAuthority) GetExpirationTime([]byte) time.Time {
+	return auth.expiration
+}
+
+func TestListenerExpiresWithKeepAlive(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	option := router.DefaultRouterOption
+	option.TokenAuthority = &expiringAuthority{expiration: time.Now().Add(500 * time.Millisecond)}
+	option.ListenConnectionKeepAlive = 50 * time.Millisecond
+	go router.NewRouter(option).Serve(listener)
+
+	// Registers `test` with a raw connection which answers every probe.
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request := bytes.Buffer{}
+	binary.Write(&request, binary.BigEndian, proto.Listen)
+	binary.Write(&request, binary.BigEndian, uint64(0))
+	binary.Write(&request, binary.BigEndian, uint16(len("test")))
+	request.WriteString("test")
+	if _, err := conn.Write(request.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		probe := make([]byte, 11)
+		for {
+			if _, err := io.ReadFull(conn, probe); err != nil {
+				return
+			}
+			if _, err := conn.Write(probe); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Probes must not clear the deadline set by the expiration of the key.
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Error("expect the listener to be dropped once its key expires")
+	}
+}
+
+type listenerActivator struct {
+	routerAddress string
+	listeners     map[string]*router.Listener
+	mu            sync.Mutex
+	deactivated   chan string
+}
+
+func (activator *listenerActivator) Activate(channel string) bool {
+	if channel != "lazy" {
+		return false
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		listener, err := router.NewListenerWithoutAuth(activator.routerAddress, channel)
+		if err != nil {
+			return
+		}
+		activator.mu.Lock()
+		activator.listeners[channel] = listener
+		activator.mu.Unlock()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return true
+}
+
+func (activator *listenerActivator) Deactivate(channel string) {
+	activator.mu.Lock()
+	if listener, exists := activator.listeners[channel]; exists {
+		listener.Close()
+		delete(activator.listeners, channel)
+	}
+	activator.mu.Unlock()
+	activator.deactivated <- channel
+}
+
+func TestActivation(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	activator := &listenerActivator{
+		routerAddress: listener.Addr().String(),
+		listeners:     make(map[string]*router.Listener),
+		deactivated:   make(chan string, 1),
+	}
+	option := router.DefaultRouterOption
+	option.Activator = activator
+	option.ActivationTimeout = 5 * time.Second
+	option.ActivationIdleTimeout = 200 * time.Millisecond
+	go router.NewRouter(option).Serve(listener)
+	testClient := router.NewClientWithoutAuth(listener.Addr().String())
+
+	if _, err := testClient.Dial("unknown"); err == nil {
+		t.Error("expect an error here")
+	}
+	conn, err := testClient.Dial("lazy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	select {
+	case channel := <-activator.deactivated:
+		if channel != "lazy" {
+			t.Errorf("unexpected deactivated channel %s", channel)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("idle service is not deactivated")
+	}
+}
+
+func TestActivationRestart(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	activator := &listenerActivator{
+		routerAddress: listener.Addr().String(),
+		listeners:     make(map[string]*router.Listener),
+		deactivated:   make(chan string, 1),
+	}
+	option := router.DefaultRouterOption
+	option.Activator = activator
+	option.ActivationTimeout = 5 * time.Second
+	option.ListenConnectionKeepAlive = 50 * time.Millisecond
+	go router.NewRouter(option).Serve(listener)
+	testClient := router.NewClientWithoutAuth(listener.Addr().String())
+
+	conn, err := testClient.Dial("lazy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// The service leaves by itself, without being deactivated.
+	activator.mu.Lock()
+	activator.listeners["lazy"].Close()
+	activator.mu.Unlock()
+	time.Sleep(300 * time.Millisecond)
+
+	conn, err = testClient.Dial("lazy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	select {
+	case channel := <-activator.deactivated:
+		if channel != "lazy" {
+			t.Errorf("unexpected deactivated channel %s", channel)
+		}
+	default:
+		t.Error("expect the previous service to be deactivated before activating it again")
+	}
+}
+
+// brokenActivator starts services that never register.
+type brokenActivator struct {
+	activated   int32
+	deactivated int32
+}
+
+func (activator *brokenActivator) Activate(string) bool {
+	atomic.AddInt32(&activator.activated, 1)
+	return true
+}
+
+func (activator *brokenActivator) Deactivate(string) {
+	atomic.AddInt32(&activator.deactivated, 1)
+}
+
+func TestActivationTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	activator := &brokenActivator{}
+	option := router.DefaultRouterOption
+	option.Activator = activator
+	option.ActivationTimeout = 100 * time.Millisecond
+	go router.NewRouter(option).Serve(listener)
+	testClient := router.NewClientWithoutAuth(listener.Addr().String())
+
+	for i := 0; i < 2; i++ {
+		if _, err := testClient.Dial("broken"); err == nil {
+			t.Error("expect an error here")
+		}
+	}
+	if activated := atomic.LoadInt32(&activator.activated); activated != 2 {
+		t.Errorf("expect the service to be activated again after timeout, activated %d times", activated)
+	}
+	if deactivated := atomic.LoadInt32(&activator.deactivated); deactivated != 2 {
+		t.Errorf("expect timed out activations to be stopped, deactivated %d times", deactivated)
+	}
+}
+
+func TestTraceID(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go router.NewDefaultRouter().Serve(listener)
+
+	testListener, err := router.NewListenerWithoutAuth(listener.Addr().String(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testListener.Close()
+	testClient := router.NewClientWithoutAuth(listener.Addr().String())
+
+	for _, anycast := range []bool{false, true} {
+		for _, traceID := range []string{"caller-trace.1_a", ""} {
+			dialed := make(chan string, 1)
+			go func(traceID string) {
+				option := router.DialOption{TraceID: traceID, Metadata: map[string]string{"k": "v"}}
+				var conn net.Conn
+				var err error
+				if anycast {
+					conn, _, err = testClient.DialAnycastWithOption([]string{"te*"}, router.AnycastOrdered, option)
+				} else {
+					conn, err = testClient.DialWithOption("test", option)
+				}
+				if err != nil {
+					t.Error(err)
+					dialed <- ""
+					return
+				}
+				dialed <- conn.(*router.Conn).TraceID()
+				conn.Close()
+			}(traceID)
+			conn, err := testListener.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			received := conn.(*router.Conn)
+			if len(traceID) > 0 && received.TraceID() != traceID {
+				t.Errorf("expect trace ID %s, got %s", traceID, received.TraceID())
+			}
+			if len(received.TraceID()) == 0 {
+				t.Error("trace ID is not generated")
+			}
+			if dialerTraceID := <-dialed; dialerTraceID != received.TraceID() {
+				t.Errorf("trace ID mismatch, dialer got %s, listener got %s", dialerTraceID, received.TraceID())
+			}
+			if received.Metadata()["k"] != "v" {
+				t.Errorf("unexpected metadata: %v", received.Metadata())
+			}
+			conn.Close()
+		}
+	}
+	for _, traceID := range []string{string(make([]byte, router.MaxTraceIDLength+1)), "forged\nlog line", "a b"} {
+		if _, err := testClient.DialWithOption("test", router.DialOption{TraceID: traceID}); err == nil {
+			t.Errorf("expect trace ID %q to be rejected", traceID)
+		}
+	}
+
+	// The Router rejects invalid trace IDs from clients skipping the check as well.
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request := bytes.Buffer{}
+	for _, frame := range []struct {
+		frameType byte
+		payload   string
+	}{{proto.Trace, "forged\nlog line"}, {proto.Dial, "test"}} {
+		binary.Write(&request, binary.BigEndian, frame.frameType)
+		binary.Write(&request, binary.BigEndian, uint64(0))
+		binary.Write(&request, binary.BigEndian, uint16(len(frame.payload)))
+		request.WriteString(frame.payload)
+	}
+	if _, err := conn.Write(request.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	response := make([]byte, 1)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		t.Fatal(err)
+	}
+	if response[0] != proto.Close {
+		t.Errorf("expect the request to be closed, got frame type %d", response[0])
+	}
+}
+
+// expectClosedWithin returns an error if the router does not close `conn` within `timeout`.
+func expectClosedWithin(conn net.Conn, timeout time.Duration) error {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	if _, err := io.ReadAll(conn); err != nil {
+		return fmt.Errorf("connection is not closed in time: %v", err)
+	}
+	return nil
+}
+
+func TestHandshakeLimits(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	option := router.DefaultRouterOption
+	option.HandshakeTimeout = 500 * time.Millisecond
+	option.MaxPendingHandshakes = 1
+	go router.NewRouter(option).Serve(listener)
+
+	idleConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idleConn.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// The only handshake slot is taken by `idleConn`.
+	rejectedConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rejectedConn.Close()
+	if err := expectClosedWithin(rejectedConn, 300*time.Millisecond); err != nil {
+		t.Error(err)
+	}
+	if err := expectClosedWithin(idleConn, 2*time.Second); err != nil {
+		t.Error(err)
+	}
+
+	testListener, err := router.NewListenerWithoutAuth(listener.Addr().String(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSuite(t, "test", testListener, router.NewClientWithoutAuth(listener.Addr().String()))
+}
+
+func TestAuthFailureBan(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	keyStore := keystore.CreateKeyStore()
+	token := keyStore.GenerateKeyAndRegister("test", []keystore.ACLRule{
+		{ListenControl: keystore.Allow, ChannelRegexp: "test"},
+	}, time.Hour)
+	option := router.DefaultRouterOption
+	option.TokenAuthority = &keyStoreAuthority{keyStore: keyStore}
+	option.AuthFailureLimit = 2
+	option.AuthFailureBanDuration = time.Hour
+	go router.NewRouter(option).Serve(listener)
+
+	// Denied requests of a valid key should not count.
+	for i := 0; i < 3; i++ {
+		if _, err := router.NewListenerWithOption(listener.Addr().String(), "other", router.ClientOption{Token: token}); err == nil {
+			t.Error("expect an error here")
+		}
+	}
+	testListener, err := router.NewListenerWithOption(listener.Addr().String(), "test", router.ClientOption{Token: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testListener.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := router.NewListenerWithOption(listener.Addr().String(), "test", router.ClientOption{Token: "invalid"}); err == nil {
+			t.Error("expect an error here")
+		}
+	}
+	if _, err := router.NewListenerWithOption(listener.Addr().String(), "test", router.ClientOption{Token: token}); err == nil {
+		t.Error("expect the address to be banned")
+	}
+}
+
+func TestAuthFailureBanTrustedProxy(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	trustedProxies, err := common.ParseCIDRs([]string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyStore := keystore.CreateKeyStore()
+	token := keyStore.GenerateKeyAndRegister("test", []keystore.ACLRule{
+		{ListenControl: keystore.Allow, ChannelRegexp: "test"},
+	}, time.Hour)
+	option := router.DefaultRouterOption
+	option.TokenAuthority = &keyStoreAuthority{keyStore: keyStore}
+	option.AuthFailureLimit = 1
+	option.AuthFailureBanDuration = time.Hour
+	option.TrustedProxies = trustedProxies
+	go router.NewRouter(option).Serve(listener)
+
+	for i := 0; i < 2; i++ {
+		if _, err := router.NewListenerWithOption(listener.Addr().String(), "test", router.ClientOption{Token: "invalid"}); err == nil {
+			t.Error("expect an error here")
+		}
+	}
+	testListener, err := router.NewListenerWithOption(listener.Addr().String(), "test", router.ClientOption{Token: token})
+	if err != nil {
+		t.Fatalf("trusted proxies should not be banned: %v", err)
+	}
+	testListener.Close()
+}
+
+func TestAuthFailureBanTLS(t *testing.T) {
+	serverCA, serverPriv, serverPub, err := common.GenerateTestCertSuite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCA, otherPriv, otherPub, err := common.GenerateTestCertSuite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverPool, otherPool := x509.NewCertPool(), x509.NewCertPool()
+	serverPool.AppendCertsFromPEM(serverCA)
+	otherPool.AppendCertsFromPEM(otherCA)
+	serverCert, err := tls.X509KeyPair(serverPub, serverPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCert, err := tls.X509KeyPair(otherPub, otherPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	option := router.DefaultRouterOption
+	option.TLSConfig = &tls.Config{
+		ClientCAs:    serverPool,
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	option.AuthFailureLimit = 2
+	option.AuthFailureBanDuration = time.Hour
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", option.TLSConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go router.NewRouter(option).Serve(listener)
+
+	validConfig := &tls.Config{RootCAs: serverPool, Certificates: []tls.Certificate{serverCert}, ServerName: "test"}
+	untrustedConfig := &tls.Config{RootCAs: serverPool, Certificates: []tls.Certificate{otherCert}, ServerName: "test"}
+
+	// Connections closed before finishing the handshake should not count.
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	testListener, err := router.NewListener(listener.Addr().String(), "test", validConfig)
+	if err != nil {
+		t.Fatalf("closed connections should not count as failures: %v", err)
+	}
+	testListener.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := router.NewListener(listener.Addr().String(), "test", untrustedConfig); err == nil {
+			t.Error("expect an error here")
+		}
+	}
+	// The failure is recorded after the client finishes its side of the handshake.
+	time.Sleep(100 * time.Millisecond)
+	if _, err := router.NewListener(listener.Addr().String(), "test", validConfig); err == nil {
+		t.Error("expect the address to be banned")
+	}
+}
+
+func TestAcceptRatePerIP(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	option := router.DefaultRouterOption
+	option.AcceptRatePerIP = 0.001
+	option.AcceptBurstPerIP = 1
+	go router.NewRouter(option).Serve(listener)
+
+	testListener, err := router.NewListenerWithoutAuth(listener.Addr().String(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testListener.Close()
+	if _, err := router.NewClientWithoutAuth(listener.Addr().String()).Dial("test"); err == nil {
+		t.Error("expect an error here")
+	}
+}
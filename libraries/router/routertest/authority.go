@@ -0,0 +1,108 @@
+package routertest
+
+import (
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xpy123993/yukino-net/libraries/router"
+	"github.com/xpy123993/yukino-net/libraries/router/keystore"
+	"github.com/xpy123993/yukino-net/libraries/router/proto"
+)
+
+// AnyIdentity grants permissions to all identities.
+const AnyIdentity = "*"
+
+type grant struct {
+	frameType byte
+	channel   *regexp.Regexp
+}
+
+// Authority is a fake router.Authority granting permissions by identity.
+// All requests are denied unless granted.
+type Authority struct {
+	mu          sync.RWMutex
+	grants      map[string][]grant
+	expirations map[string]time.Time
+}
+
+// NewAuthority creates an Authority without any grant.
+func NewAuthority() *Authority {
+	return &Authority{
+		grants:      make(map[string][]grant),
+		expirations: make(map[string]time.Time),
+	}
+}
+
+// Grant allows `identity` to send frames of `frameTypes` on channels matching `channelRegexp`.
+// Frame types are defined in the proto package, e.g. proto.Dial and proto.Listen.
+func (authority *Authority) Grant(identity string, channelRegexp string, frameTypes ...byte) error {
+	pattern, err := regexp.Compile(channelRegexp)
+	if err != nil {
+		return err
+	}
+	authority.mu.Lock()
+	defer authority.mu.Unlock()
+	for _, frameType := range frameTypes {
+		authority.grants[identity] = append(authority.grants[identity], grant{frameType: frameType, channel: pattern})
+	}
+	return nil
+}
+
+// AllowListen allows `identity` to listen on channels matching `channelRegexp`.
+func (authority *Authority) AllowListen(identity string, channelRegexp string) error {
+	return authority.Grant(identity, channelRegexp, proto.Listen, proto.Bridge, proto.Takeover)
+}
+
+// AllowDial allows `identity` to dial channels matching `channelRegexp`.
+func (authority *Authority) AllowDial(identity string, channelRegexp string) error {
+	return authority.Grant(identity, channelRegexp, proto.Dial)
+}
+
+// Revoke removes all grants of `identity`.
+func (authority *Authority) Revoke(identity string) {
+	authority.mu.Lock()
+	delete(authority.grants, identity)
+	authority.mu.Unlock()
+}
+
+// SetExpiration sets the expiration time of `identity`, which is one day later by default.
+func (authority *Authority) SetExpiration(identity string, expiration time.Time) {
+	authority.mu.Lock()
+	authority.expirations[identity] = expiration
+	authority.mu.Unlock()
+}
+
+// identityOf returns the identity presented as the bearer token `key`.
+func identityOf(key []byte) string {
+	return strings.TrimPrefix(string(key), keystore.TokenKeyPrefix)
+}
+
+// CheckPermission implements router.Authority.
+func (authority *Authority) CheckPermission(frame *router.Frame, key []byte, _ net.Addr) bool {
+	authority.mu.RLock()
+	defer authority.mu.RUnlock()
+	if expiration, exists := authority.expirations[identityOf(key)]; exists && time.Now().After(expiration) {
+		return false
+	}
+	for _, identity := range []string{identityOf(key), AnyIdentity} {
+		for _, grant := range authority.grants[identity] {
+			if grant.frameType == frame.Type && grant.channel.MatchString(frame.Payload) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GetExpirationTime implements router.Authority.
+func (authority *Authority) GetExpirationTime(key []byte) time.Time {
+	authority.mu.RLock()
+	defer authority.mu.RUnlock()
+	if expiration, exists := authority.expirations[identityOf(key)]; exists {
+		return expiration
+	}
+	return time.Now().Add(24 * time.Hour)
+}
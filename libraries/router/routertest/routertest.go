@@ -0,0 +1,218 @@
+// Package routertest runs a Router over in-memory connections for tests.
+//
+// Clients and listeners created by a Harness connect to the Router through net.Pipe, and present a fake identity
+// as the bearer token. Faults like latency, dropped frames and abrupt closes can be injected into new connections.
+package routertest
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/xpy123993/yukino-net/libraries/router"
+)
+
+// Address is the Router address used by clients of a Harness.
+const Address = "routertest:0"
+
+// Faults specifies faults injected into connections to the Router.
+// Faults apply to individual Write calls rather than frames: a frame may span several writes, so dropping or
+// closing in the middle of it corrupts the frame stream as a real broken link would.
+type Faults struct {
+	// Latency delays every write.
+	Latency time.Duration
+	// DropRate is the probability to silently drop a write, in the range of [0, 1].
+	// Use 1 to lose all requests to the Router, partial drops usually desynchronize the frame stream.
+	DropRate float64
+	// CloseAfterWrites abruptly closes the connection after this number of writes if positive.
+	CloseAfterWrites int
+}
+
+// Harness runs a Router over in-memory connections.
+type Harness struct {
+	// Router is the Router under test.
+	Router *router.Router
+	// Authority is the authority used by the Router if the option passed to `New` does not specify one.
+	Authority *Authority
+
+	listener *pipeListener
+
+	mu     sync.Mutex
+	faults Faults
+	conns  map[net.Conn]struct{}
+}
+
+// New starts a Router with `option` over in-memory connections.
+// If `option.TokenAuthority` is nil, `Harness.Authority` will be used.
+func New(option router.Option) *Harness {
+	harness := &Harness{
+		Authority: NewAuthority(),
+		listener:  newPipeListener(),
+		conns:     make(map[net.Conn]struct{}),
+	}
+	if option.TokenAuthority == nil {
+		option.TokenAuthority = harness.Authority
+	}
+	harness.Router = router.NewRouter(option)
+	go harness.Router.Serve(harness.listener)
+	return harness
+}
+
+// NewDefault starts a Router with `router.DefaultRouterOption` using `Harness.Authority`.
+func NewDefault() *Harness {
+	option := router.DefaultRouterOption
+	option.TokenAuthority = nil
+	return New(option)
+}
+
+// Close stops the Router and closes all connections.
+func (harness *Harness) Close() {
+	harness.listener.Close()
+	harness.BreakConnections()
+}
+
+// SetFaults injects `faults` into connections created afterwards.
+func (harness *Harness) SetFaults(faults Faults) {
+	harness.mu.Lock()
+	harness.faults = faults
+	harness.mu.Unlock()
+}
+
+// BreakConnections abruptly closes all established connections to the Router.
+func (harness *Harness) BreakConnections() {
+	harness.mu.Lock()
+	conns := harness.conns
+	harness.conns = make(map[net.Conn]struct{})
+	harness.mu.Unlock()
+	for conn := range conns {
+		conn.Close()
+	}
+}
+
+// Dial creates an in-memory connection to the Router, can be used as `router.ClientOption.Dialer`.
+func (harness *Harness) Dial(network, address string) (net.Conn, error) {
+	clientSide, serverSide := net.Pipe()
+	if err := harness.listener.push(serverSide); err != nil {
+		clientSide.Close()
+		return nil, err
+	}
+	harness.mu.Lock()
+	conn := &faultConn{Conn: clientSide, faults: harness.faults, harness: harness}
+	harness.conns[conn] = struct{}{}
+	harness.mu.Unlock()
+	return conn, nil
+}
+
+// ClientOption returns an option to connect to the Router with `identity`.
+// The Router sees `identity` as the key of the connection. An empty identity connects without a key.
+func (harness *Harness) ClientOption(identity string) router.ClientOption {
+	return router.ClientOption{
+		Token:  base64.RawStdEncoding.EncodeToString([]byte(identity)),
+		Dialer: harness.Dial,
+	}
+}
+
+// NewClient creates a client with `identity`.
+func (harness *Harness) NewClient(identity string) *router.Client {
+	return router.NewClientWithOption(Address, harness.ClientOption(identity))
+}
+
+// NewListener creates a listener on `channel` with `identity`.
+func (harness *Harness) NewListener(identity string, channel string) (*router.Listener, error) {
+	return router.NewListenerWithOption(Address, channel, harness.ClientOption(identity))
+}
+
+func (harness *Harness) forget(conn net.Conn) {
+	harness.mu.Lock()
+	delete(harness.conns, conn)
+	harness.mu.Unlock()
+}
+
+// faultConn injects faults into writes of a connection.
+type faultConn struct {
+	net.Conn
+	faults  Faults
+	harness *Harness
+
+	mu     sync.Mutex
+	writes int
+}
+
+// Write implements net.Conn.
+func (conn *faultConn) Write(p []byte) (int, error) {
+	if conn.faults.Latency > 0 {
+		time.Sleep(conn.faults.Latency)
+	}
+	conn.mu.Lock()
+	conn.writes++
+	writes := conn.writes
+	conn.mu.Unlock()
+	if conn.faults.CloseAfterWrites > 0 && writes > conn.faults.CloseAfterWrites {
+		conn.Close()
+		return 0, io.ErrClosedPipe
+	}
+	if conn.faults.DropRate > 0 && rand.Float64() < conn.faults.DropRate {
+		return len(p), nil
+	}
+	return conn.Conn.Write(p)
+}
+
+// Close implements net.Conn.
+func (conn *faultConn) Close() error {
+	conn.harness.forget(conn)
+	return conn.Conn.Close()
+}
+
+// pipeAddr is the address of in-memory connections.
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return Address }
+
+// pipeListener accepts in-memory connections.
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (listener *pipeListener) push(conn net.Conn) error {
+	select {
+	case listener.conns <- conn:
+		return nil
+	case <-listener.closed:
+		return fmt.Errorf("router is closed")
+	}
+}
+
+// Accept implements net.Listener.
+func (listener *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.conns:
+		return conn, nil
+	case <-listener.closed:
+		return nil, io.EOF
+	}
+}
+
+// Close implements net.Listener.
+func (listener *pipeListener) Close() error {
+	listener.once.Do(func() { close(listener.closed) })
+	return nil
+}
+
+// Addr implements net.Listener.
+func (listener *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
@@ -0,0 +1,151 @@
+package routertest_test
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/xpy123993/yukino-net/libraries/router"
+	"github.com/xpy123993/yukino-net/libraries/router/routertest"
+)
+
+func newHarness(t *testing.T) *routertest.Harness {
+	harness := routertest.NewDefault()
+	t.Cleanup(harness.Close)
+	if err := harness.Authority.AllowListen("device", "^test$"); err != nil {
+		t.Fatal(err)
+	}
+	if err := harness.Authority.AllowDial("user", "^test$"); err != nil {
+		t.Fatal(err)
+	}
+	return harness
+}
+
+func echoOnce(listener *router.Listener) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	io.Copy(conn, conn)
+}
+
+func expectEcho(client *router.Client, message string) error {
+	conn, err := client.Dial("test")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(message)); err != nil {
+		return err
+	}
+	buf := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if string(buf) != message {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func TestDialAndListen(t *testing.T) {
+	harness := newHarness(t)
+	listener, err := harness.NewListener("device", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go echoOnce(listener)
+	if err := expectEcho(harness.NewClient("user"), "hello"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestIdentities(t *testing.T) {
+	harness := newHarness(t)
+	if _, err := harness.NewListener("user", "test"); err == nil {
+		t.Error("expect an error here")
+	}
+	listener, err := harness.NewListener("device", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if _, err := harness.NewClient("device").Dial("test"); err == nil {
+		t.Error("expect an error here")
+	}
+	harness.Authority.SetExpiration("user", time.Now().Add(-time.Second))
+	if _, err := harness.NewClient("user").Dial("test"); err == nil {
+		t.Error("expect an error here")
+	}
+}
+
+func TestLatency(t *testing.T) {
+	harness := newHarness(t)
+	listener, err := harness.NewListener("device", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go echoOnce(listener)
+
+	harness.SetFaults(routertest.Faults{Latency: 20 * time.Millisecond})
+	start := time.Now()
+	if err := expectEcho(harness.NewClient("user"), "hello"); err != nil {
+		t.Error(err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("latency is not injected, elapsed %v", elapsed)
+	}
+}
+
+func TestDroppedFrames(t *testing.T) {
+	option := router.DefaultRouterOption
+	option.TokenAuthority = nil
+	option.HandshakeTimeout = 100 * time.Millisecond
+	harness := routertest.New(option)
+	defer harness.Close()
+	harness.Authority.AllowListen("device", "^test$")
+	harness.Authority.AllowDial("user", "^test$")
+
+	listener, err := harness.NewListener("device", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go echoOnce(listener)
+
+	// Requests to the Router are lost, the dial should fail by the handshake deadline instead of hanging.
+	harness.SetFaults(routertest.Faults{DropRate: 1})
+	done := make(chan error, 1)
+	go func() {
+		_, err := harness.NewClient("user").Dial("test")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expect an error here")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("dial does not fail in time")
+	}
+}
+
+func TestBreakConnections(t *testing.T) {
+	harness := newHarness(t)
+	listener, err := harness.NewListener("device", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	harness.BreakConnections()
+	if _, err := listener.Accept(); err != io.EOF {
+		t.Errorf("expect the listener to be closed, got %v", err)
+	}
+
+	harness.SetFaults(routertest.Faults{CloseAfterWrites: 1})
+	if _, err := harness.NewListener("device", "test"); err == nil {
+		t.Error("expect an error here")
+	}
+}
@@ -0,0 +1,55 @@
+package router
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+)
+
+// MaxTraceIDLength limits the length of a trace ID supplied by the dialer.
+const MaxTraceIDLength = 64
+
+// NewTraceID generates a random trace ID to correlate logs of a dial across the dialer, the Router and the listener.
+func NewTraceID() string {
+	return formatTraceID(newTraceNumber())
+}
+
+// newTraceNumber returns a random non-zero number identifying a trace.
+// The Router returns the number of a generated trace ID to the dialer in the Bridge response.
+func newTraceNumber() uint64 {
+	p := make([]byte, 8)
+	if _, err := rand.Read(p); err != nil {
+		return 1
+	}
+	if number := binary.BigEndian.Uint64(p); number != 0 {
+		return number
+	}
+	return 1
+}
+
+// formatTraceID returns the trace ID of a number generated by newTraceNumber.
+func formatTraceID(number uint64) string {
+	return fmt.Sprintf("%016x", number)
+}
+
+// validateTraceID returns an error if the trace ID supplied by the dialer is too long or contains characters
+// other than letters, digits, `.`, `_` and `-`, so that it cannot forge log lines.
+func validateTraceID(traceID string) error {
+	if len(traceID) > MaxTraceIDLength {
+		return fmt.Errorf("trace ID too long: %d > %d", len(traceID), MaxTraceIDLength)
+	}
+	for _, c := range traceID {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return fmt.Errorf("invalid character %q in trace ID", c)
+		}
+	}
+	return nil
+}
+
+// tracePrefix returns a log prefix carrying `traceID`, or an empty string if `traceID` is empty.
+func tracePrefix(traceID string) string {
+	if len(traceID) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("[trace %s] ", traceID)
+}
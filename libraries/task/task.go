@@ -95,6 +95,8 @@ type Request struct {
 	SenderPubKey string `json:"sender"`
 	// (ed25519) The signature of the data
 	SenderSign string `json:"sign"`
+	// TraceID correlates logs of this request across the caller, the router and the server. Not signed.
+	TraceID string `json:"trace,omitempty"`
 }
 
 // DoneFunction is a callback with TaskResponse as its parameter.
@@ -1,17 +1,32 @@
 package util
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/xpy123993/yukino-net/libraries/common"
 	"github.com/xpy123993/yukino-net/libraries/router"
 	"github.com/xpy123993/yukino-net/libraries/router/keystore"
+	"golang.org/x/term"
 )
 
+// OnDemandService specifies how the Router starts and stops a service on demand.
+type OnDemandService struct {
+	// Start is the command to start the service, `YUKINO_CHANNEL` is set in its environment.
+	Start string `json:"start"`
+	// Stop is the command to stop the service. If empty, the process started by `Start` will be killed.
+	Stop string `json:"stop,omitempty"`
+}
+
 // ClientConfig stores the configuration to connect to the Router network.
 type ClientConfig struct {
 	// RouterAddress is the network address of the Router.
@@ -23,6 +38,10 @@ type ClientConfig struct {
 	// CaCert stores the filename to load a PEM CA cert. Used for server authentication.
 	CaCert string `json:"ca-file"`
 
+	// CRLFile stores the filename of a CRL signed by `CaCert`, peers with revoked certificates will be rejected.
+	// The file is reloaded once modified.
+	CRLFile string `json:"crl-file,omitempty"`
+
 	// ServerNameOverride overrides the server name used for the client to authenticate the Router if not empty.
 	ServerNameOverride string `json:"server-name"`
 
@@ -32,8 +51,97 @@ type ClientConfig struct {
 	// KeyFile stores the filename to the client's key file in PEM format.
 	KeyFile string `json:"key-file"`
 
+	// Token, if not empty, will be presented to the Router as a bearer token for authentication.
+	// Can be used instead of client certificates.
+	Token string `json:"token,omitempty"`
+
 	// TokenFile provides the Router extra ACL control in application layer.
+	// Files ending with `.db` are embedded databases updated in place, others are JSON files, see OpenTokenStorage.
 	TokenFile string `json:"token-file"`
+	// TokenFileSecret specifies where to read the secret if `TokenFile` is encrypted:
+	// `env:NAME`, `file:PATH` or `prompt`. Defaults to `YUKINO_TOKEN_SECRET` if set, or prompt.
+	// If a secret is configured, an unencrypted `TokenFile` is refused, including embedded databases which cannot be encrypted.
+	TokenFileSecret string `json:"token-file-secret,omitempty"`
+
+	// BroadcastDelivery specifies how the Router delivers broadcast messages to slow subscribers.
+	// Can be `drop` (default) or `block`. Only used by the Router.
+	BroadcastDelivery string `json:"broadcast-delivery,omitempty"`
+
+	// BroadcastBufferSize specifies the number of messages buffered for each subscriber. Only used by the Router.
+	BroadcastBufferSize int `json:"broadcast-buffer-size,omitempty"`
+
+	// BridgeIdleTimeout specifies how long a bridge can stay without traffic, e.g. `30m`. `0` means no limit. Only used by the Router.
+	BridgeIdleTimeout string `json:"bridge-idle-timeout,omitempty"`
+
+	// BridgeMaxLifetime specifies the maximum duration of a bridge, e.g. `24h`. Only used by the Router.
+	BridgeMaxLifetime string `json:"bridge-max-lifetime,omitempty"`
+
+	// TrustedProxies lists the IP addresses or CIDR ranges of load balancers sending PROXY protocol headers.
+	// Only used by the Router.
+	TrustedProxies []string `json:"trusted-proxies,omitempty"`
+
+	// ChannelReservationTTL binds channels to the key that registered them, e.g. `10m`.
+	// Other keys cannot register the channel until the TTL passes after the owner leaves. Only used by the Router.
+	ChannelReservationTTL string `json:"channel-reservation-ttl,omitempty"`
+
+	// OnDemandServices maps channels to services started when the channel is dialed but not registered.
+	// Only used by the Router.
+	OnDemandServices map[string]OnDemandService `json:"on-demand-services,omitempty"`
+
+	// ActivationTimeout specifies how long a dial waits for an on-demand service to register, e.g. `30s`.
+	// Only used by the Router.
+	ActivationTimeout string `json:"activation-timeout,omitempty"`
+
+	// ActivationIdleTimeout specifies how long an on-demand service can stay idle before being stopped, e.g. `10m`.
+	// `0` or empty keeps services running. Only used by the Router.
+	ActivationIdleTimeout string `json:"activation-idle-timeout,omitempty"`
+
+	// HandshakeTimeout limits the time for a connection to finish TLS handshake and send its request, e.g. `10s`.
+	// Only used by the Router.
+	HandshakeTimeout string `json:"handshake-timeout,omitempty"`
+
+	// MaxPendingHandshakes limits the number of unauthenticated connections. Only used by the Router.
+	MaxPendingHandshakes int `json:"max-pending-handshakes,omitempty"`
+
+	// AcceptRatePerIP limits new connections per second from a single IP address, `0` means no limit.
+	// Only used by the Router.
+	AcceptRatePerIP float64 `json:"accept-rate-per-ip,omitempty"`
+
+	// AcceptBurstPerIP specifies the burst size of `AcceptRatePerIP`. Only used by the Router.
+	AcceptBurstPerIP int `json:"accept-burst-per-ip,omitempty"`
+
+	// AuthFailureLimit specifies the number of consecutive authentication failures before banning an IP address.
+	// Banning is disabled if zero. Only used by the Router.
+	AuthFailureLimit int `json:"auth-failure-limit,omitempty"`
+
+	// AuthFailureBanDuration specifies how long an IP address is banned, e.g. `10m`. Only used by the Router.
+	AuthFailureBanDuration string `json:"auth-failure-ban-duration,omitempty"`
+
+	// IdentityOrder specifies how peers with TLS certificates are looked up in the token file, the first
+	// registered one takes effect. Can be `spki` and `signature`, defaults to both in this order. Only used by the Router.
+	IdentityOrder []string `json:"identity-order,omitempty"`
+
+	// TokenCheckInterval specifies how often the Router reloads `TokenFile`, removes expired keys and reports
+	// expiring keys, e.g. `1h`, defaults to one hour. Only used by the Router.
+	TokenCheckInterval string `json:"token-check-interval,omitempty"`
+	// TokenCleanUp removes expired keys from `TokenFile` periodically. Only used by the Router.
+	TokenCleanUp bool `json:"token-cleanup,omitempty"`
+	// TokenExpiryWarning reports keys expiring within this duration, e.g. `30d`. Disabled if empty. Only used by the Router.
+	TokenExpiryWarning string `json:"token-expiry-warning,omitempty"`
+	// TokenExpiryHook is a command run for each expiring key, with `YUKINO_KEY_ID`, `YUKINO_KEY_HASH` and
+	// `YUKINO_KEY_EXPIRE` in the environment. Only used by the Router.
+	TokenExpiryHook string `json:"token-expiry-hook,omitempty"`
+	// TokenExpiryWebhook is a URL receiving the expiring keys in a JSON POST request. Only used by the Router.
+	TokenExpiryWebhook string `json:"token-expiry-webhook,omitempty"`
+	// MetricsAddress, if not empty, serves metrics of the Router in JSON on http://[address]/metrics.
+	// Only used by the Router.
+	MetricsAddress string `json:"metrics-address,omitempty"`
+
+	// Debug logs the reasons of denied requests, including the token file rules matching them. Only used by the Router.
+	Debug bool `json:"debug,omitempty"`
+
+	// RewriteRules maps requested channel names to actual channels. Reloaded on SIGHUP. Only used by the Router.
+	RewriteRules []router.RewriteRule `json:"rewrite-rules,omitempty"`
 }
 
 func parseCAAndCertificate(config *ClientConfig) (*x509.CertPool, *tls.Certificate, error) {
@@ -53,6 +161,26 @@ func parseCAAndCertificate(config *ClientConfig) (*x509.CertPool, *tls.Certifica
 	return caPool, &certificate, err
 }
 
+// loadCRLChecker returns the CRL checker of `config`, or nil if `CRLFile` is not set.
+func loadCRLChecker(config *ClientConfig) (*common.CRLChecker, error) {
+	if len(config.CRLFile) == 0 {
+		return nil, nil
+	}
+	data, err := os.ReadFile(config.CaCert)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("cannot decode %s", config.CaCert)
+	}
+	issuer, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return common.NewCRLChecker(config.CRLFile, issuer)
+}
+
 func createClientTLSConfig(config *ClientConfig) (*tls.Config, error) {
 	if !config.EnableTLS {
 		return nil, nil
@@ -61,11 +189,19 @@ func createClientTLSConfig(config *ClientConfig) (*tls.Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &tls.Config{
+	tlsConfig := &tls.Config{
 		Certificates: []tls.Certificate{*certificate},
 		RootCAs:      caPool,
 		ServerName:   config.ServerNameOverride,
-	}, nil
+	}
+	checker, err := loadCRLChecker(config)
+	if err != nil {
+		return nil, err
+	}
+	if checker != nil {
+		tlsConfig.VerifyConnection = checker.VerifyConnection
+	}
+	return tlsConfig, nil
 }
 
 // LoadRouterTLSConfig returns the tls config used by a router.
@@ -78,12 +214,20 @@ func LoadRouterTLSConfig(config *ClientConfig) (*tls.Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &tls.Config{
+	tlsConfig := &tls.Config{
 		RootCAs:      caPool,
 		ClientCAs:    caPool,
 		ClientAuth:   tls.RequireAndVerifyClientCert,
 		Certificates: []tls.Certificate{*certificate},
-	}, nil
+	}
+	checker, err := loadCRLChecker(config)
+	if err != nil {
+		return nil, err
+	}
+	if checker != nil {
+		tlsConfig.VerifyConnection = checker.VerifyConnection
+	}
+	return tlsConfig, nil
 }
 
 // LoadClientConfig loads client configuration from `ConfigFile`, returns any error encountered.
@@ -109,50 +253,203 @@ func LoadClientConfig(ConfigFile []string) (*ClientConfig, error) {
 
 // LoadClientTLSConfig returns only the RouterAddress and TLSConfig part from `ConfigFile`.
 func LoadClientTLSConfig(ConfigFile []string) (string, *tls.Config, error) {
-	rawConfig, err := LoadClientConfig(ConfigFile)
+	address, option, err := LoadClientOption(ConfigFile)
 	if err != nil {
 		return "", nil, err
 	}
+	return address, option.TLSConfig, nil
+}
+
+// LoadClientOption returns the RouterAddress and the options to connect to the Router from `ConfigFile`.
+func LoadClientOption(ConfigFile []string) (string, router.ClientOption, error) {
+	rawConfig, err := LoadClientConfig(ConfigFile)
+	if err != nil {
+		return "", router.ClientOption{}, err
+	}
 	tlsConfig, err := createClientTLSConfig(rawConfig)
 	if err != nil {
-		return "", nil, err
+		return "", router.ClientOption{}, err
 	}
-	return rawConfig.RouterAddress, tlsConfig, nil
+	return rawConfig.RouterAddress, router.ClientOption{
+		TLSConfig: tlsConfig,
+		Token:     rawConfig.Token,
+	}, nil
 }
 
 // CreateListenerFromConfig creates a listener on `ListenChannel` from `ConfigFile`.
 func CreateListenerFromConfig(ConfigFile []string, ListenChannel string) (*router.Listener, error) {
-	address, tlsConfig, err := LoadClientTLSConfig(ConfigFile)
+	address, option, err := LoadClientOption(ConfigFile)
 	if err != nil {
 		return nil, fmt.Errorf("error while loading certificate: %v", err)
 	}
-	return router.NewListener(address, ListenChannel, tlsConfig)
+	return router.NewListenerWithOption(address, ListenChannel, option)
+}
+
+// CreateTakeoverListenerFromConfig creates a listener on `ListenChannel` from `ConfigFile`, replacing the active
+// listener registered with the same identity.
+func CreateTakeoverListenerFromConfig(ConfigFile []string, ListenChannel string) (*router.Listener, error) {
+	address, option, err := LoadClientOption(ConfigFile)
+	if err != nil {
+		return nil, fmt.Errorf("error while loading certificate: %v", err)
+	}
+	return router.NewTakeoverListenerWithOption(address, ListenChannel, option)
 }
 
 // CreateClientFromConfig creates a client from `ConfigFile`.
 func CreateClientFromConfig(ConfigFile []string) (*router.Client, error) {
-	address, tlsConfig, err := LoadClientTLSConfig(ConfigFile)
+	address, option, err := LoadClientOption(ConfigFile)
 	if err != nil {
 		return nil, fmt.Errorf("error while loading certificate: %v", err)
 	}
-	return router.NewClient(address, tlsConfig), nil
+	return router.NewClientWithOption(address, option), nil
+}
+
+// TokenSecretEnv is the environment variable to read the secret of an encrypted token file by default.
+const TokenSecretEnv = "YUKINO_TOKEN_SECRET"
+
+// PromptSecret reads a secret from the terminal without echo, `prompt` is printed to stderr.
+func PromptSecret(prompt string) ([]byte, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, fmt.Errorf("cannot prompt for the secret: stdin is not a terminal")
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	defer fmt.Fprintln(os.Stderr)
+	return term.ReadPassword(int(os.Stdin.Fd()))
+}
+
+// ReadSecret returns the secret from `source`, which can be `env:NAME`, `file:PATH` or `prompt`.
+// An empty source reads the environment variable TokenSecretEnv if set, or prompts otherwise.
+func ReadSecret(source string) ([]byte, error) {
+	if len(source) == 0 {
+		if _, ok := os.LookupEnv(TokenSecretEnv); ok {
+			source = "env:" + TokenSecretEnv
+		} else {
+			source = "prompt"
+		}
+	}
+	var secret []byte
+	switch {
+	case strings.HasPrefix(source, "env:"):
+		value, ok := os.LookupEnv(strings.TrimPrefix(source, "env:"))
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", strings.TrimPrefix(source, "env:"))
+		}
+		secret = []byte(value)
+	case strings.HasPrefix(source, "file:"):
+		data, err := os.ReadFile(strings.TrimPrefix(source, "file:"))
+		if err != nil {
+			return nil, err
+		}
+		secret = bytes.TrimRight(data, "\r\n")
+	case source == "prompt":
+		data, err := PromptSecret("Secret of the token file: ")
+		if err != nil {
+			return nil, err
+		}
+		secret = data
+	default:
+		return nil, fmt.Errorf("invalid secret source %q, expect env:NAME, file:PATH or prompt", source)
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("the secret from %s is empty", source)
+	}
+	return secret, nil
+}
+
+// BoltTokenFileExt is the extension of token files stored in an embedded database.
+const BoltTokenFileExt = ".db"
+
+// IsBoltTokenFile returns whether `tokenFile` is stored in an embedded database rather than a JSON file.
+func IsBoltTokenFile(tokenFile string) bool {
+	return strings.HasSuffix(tokenFile, BoltTokenFileExt)
+}
+
+// hasSecretSource returns whether a secret is configured by `source` or TokenSecretEnv.
+func hasSecretSource(source string) bool {
+	if len(source) > 0 {
+		return true
+	}
+	_, ok := os.LookupEnv(TokenSecretEnv)
+	return ok
+}
+
+// OpenTokenStorage returns the storage of `tokenFile` and the secret to decrypt it, the secret is nil if not encrypted.
+// If the file is encrypted, it will be unlocked with the secret from `secretSource`, see ReadSecret.
+// If a secret is configured by `secretSource` or TokenSecretEnv, an unencrypted file is refused,
+// and the file is created encrypted if it does not exist.
+// Embedded databases cannot be encrypted, so they are refused if a secret is configured.
+func OpenTokenStorage(tokenFile string, secretSource string) (keystore.Storage, []byte, error) {
+	if IsBoltTokenFile(tokenFile) {
+		if hasSecretSource(secretSource) {
+			return nil, nil, fmt.Errorf("%s is an embedded database which cannot be encrypted, but a secret is configured", tokenFile)
+		}
+		return keystore.NewBoltStorage(tokenFile), nil, nil
+	}
+	encrypted, err := keystore.IsEncrypted(tokenFile)
+	exists := !os.IsNotExist(err)
+	if err != nil && exists {
+		return nil, nil, err
+	}
+	if !encrypted && hasSecretSource(secretSource) {
+		if exists {
+			return nil, nil, fmt.Errorf("%s is not encrypted but a secret is configured, encrypt it with `encrypt-tokens` first", tokenFile)
+		}
+		encrypted = true
+	}
+	if !encrypted {
+		return keystore.NewFileStorage(tokenFile, nil), nil, nil
+	}
+	secret, err := ReadSecret(secretSource)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot unlock %s: %v", tokenFile, err)
+	}
+	return keystore.NewFileStorage(tokenFile, secret), secret, nil
 }
 
 // CreateOrLoadKeyStore loads a KeyStore from `tokenFile`. If this file does not exist, a new config will be generated.
-func CreateOrLoadKeyStore(tokenFile string) (*keystore.KeyStore, error) {
+// If the file is encrypted, it will be unlocked with the secret from `secretSource`, see ReadSecret.
+// Changes to the returned KeyStore are written to `tokenFile` immediately.
+func CreateOrLoadKeyStore(tokenFile string, secretSource string) (*keystore.KeyStore, error) {
 	if len(tokenFile) == 0 {
 		return nil, nil
 	}
-	keyStore, err := keystore.LoadKeyStore(tokenFile)
+	storage, secret, err := OpenTokenStorage(tokenFile, secretSource)
 	if err != nil {
-		if os.IsNotExist(err) {
-			keyStore := keystore.CreateKeyStore()
-			if err := keyStore.Save(tokenFile); err != nil {
-				return nil, err
-			}
-		} else {
+		return nil, err
+	}
+	if _, err := os.Stat(tokenFile); os.IsNotExist(err) {
+		if err := storage.Update(func(tx keystore.StorageTx) error { return nil }); err != nil {
 			return nil, err
 		}
 	}
+	keyStore, err := keystore.OpenKeyStore(storage)
+	if err != nil {
+		return nil, err
+	}
+	keyStore.SetSecret(secret)
 	return keyStore, nil
 }
+
+// LoadKeyStore is CreateOrLoadKeyStore for reading an existing token file. Returns error if `tokenFile` does not exist,
+// so that a mistyped path is not taken as an empty token file.
+func LoadKeyStore(tokenFile string, secretSource string) (*keystore.KeyStore, error) {
+	if len(tokenFile) == 0 {
+		return nil, fmt.Errorf("token file is not specified")
+	}
+	if _, err := os.Stat(tokenFile); err != nil {
+		return nil, err
+	}
+	return CreateOrLoadKeyStore(tokenFile, secretSource)
+}
+
+// ParseDuration is time.ParseDuration that also accepts a number of days, e.g. `30d`.
+func ParseDuration(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(value, "d"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(value)
+}
@@ -0,0 +1,36 @@
+package util_test
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/xpy123993/yukino-net/libraries/util"
+)
+
+func TestOpenTokenStorageRefusesEncryptedDatabase(t *testing.T) {
+	tokenFile := path.Join(t.TempDir(), "tokens.db")
+	if _, _, err := util.OpenTokenStorage(tokenFile, "env:TEST_TOKEN_SECRET"); err == nil {
+		t.Error("expect an embedded database to be refused with a secret source")
+	}
+	t.Setenv(util.TokenSecretEnv, "secret")
+	if _, _, err := util.OpenTokenStorage(tokenFile, ""); err == nil {
+		t.Errorf("expect an embedded database to be refused with %s set", util.TokenSecretEnv)
+	}
+}
+
+func TestLoadKeyStoreRequiresExistingFile(t *testing.T) {
+	tokenFile := path.Join(t.TempDir(), "tokens.json")
+	if _, err := util.LoadKeyStore(tokenFile, ""); err == nil {
+		t.Error("expect an error loading a missing token file")
+	}
+	if _, err := os.Stat(tokenFile); !os.IsNotExist(err) {
+		t.Errorf("expect the missing token file not to be created, got %v", err)
+	}
+	if _, err := util.CreateOrLoadKeyStore(tokenFile, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := util.LoadKeyStore(tokenFile, ""); err != nil {
+		t.Errorf("expect an existing token file to be loaded, got %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/google/shlex"
+	"github.com/xpy123993/yukino-net/libraries/router/keystore"
+)
+
+// ExpiryStats is the result of a check made by ExpiryMonitor.
+type ExpiryStats struct {
+	// Number of keys in the token file.
+	Keys int
+	// Number of keys expiring within the warning horizon.
+	ExpiringKeys int
+	// Number of expired keys removed from the token file.
+	RemovedKeys int
+}
+
+// deliveries stores the expiration times of expiring keys delivered to a receiver, indexed by hashed keys.
+type deliveries map[string]time.Time
+
+// pending returns `keys` not delivered yet, or delivered with a different expiration time.
+func (delivered deliveries) pending(keys []keystore.ExpiringKey) []keystore.ExpiringKey {
+	result := []keystore.ExpiringKey{}
+	for _, key := range keys {
+		if expire, ok := delivered[key.Key]; !ok || !expire.Equal(key.Expire) {
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
+// retain forgets keys not in `keys`, e.g. extended or removed, so that they are delivered again once expiring.
+func (delivered deliveries) retain(keys []keystore.ExpiringKey) {
+	expiring := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		expiring[key.Key] = true
+	}
+	for hashKey := range delivered {
+		if !expiring[hashKey] {
+			delete(delivered, hashKey)
+		}
+	}
+}
+
+// ExpiryMonitor removes expired keys and reports keys expiring soon in a KeyStore.
+// Each expiring key is reported once until extended. Deliveries to the hook or the webhook that fail are retried on the next check.
+type ExpiryMonitor struct {
+	keyStore *keystore.KeyStore
+	// Whether to remove expired keys.
+	cleanUp bool
+	// Keys expiring within `horizon` are reported, disabled if zero.
+	horizon time.Duration
+	// Command run for each expiring key.
+	hook string
+	// URL receiving the expiring keys in a POST request.
+	webhook string
+
+	logged, hooked, posted deliveries
+}
+
+// NewExpiryMonitor creates a monitor of `keyStore`. Expired keys are removed if `cleanUp` is true.
+// Keys expiring within `horizon` are logged, passed to `hook` and posted to `webhook` if not empty.
+func NewExpiryMonitor(keyStore *keystore.KeyStore, cleanUp bool, horizon time.Duration, hook, webhook string) *ExpiryMonitor {
+	return &ExpiryMonitor{
+		keyStore: keyStore,
+		cleanUp:  cleanUp,
+		horizon:  horizon,
+		hook:     hook,
+		webhook:  webhook,
+		logged:   make(deliveries),
+		hooked:   make(deliveries),
+		posted:   make(deliveries),
+	}
+}
+
+// Check reloads the KeyStore, removes expired keys and reports keys expiring soon.
+func (monitor *ExpiryMonitor) Check() ExpiryStats {
+	stats := ExpiryStats{}
+	// Picks up keys extended by other processes.
+	if err := monitor.keyStore.Reload(); err != nil {
+		log.Printf("failed to reload token file: %v", err)
+	}
+	if monitor.cleanUp {
+		removed, err := monitor.keyStore.CleanUp()
+		if err != nil {
+			log.Printf("failed to remove expired keys: %v", err)
+		}
+		for _, id := range removed {
+			log.Printf("Removed expired key `%s`", id)
+		}
+		stats.RemovedKeys = len(removed)
+	}
+	stats.Keys = monitor.keyStore.Size()
+	if monitor.horizon <= 0 {
+		return stats
+	}
+	expiring := monitor.keyStore.ExpiringKeys(monitor.horizon)
+	stats.ExpiringKeys = len(expiring)
+	for _, receiver := range []deliveries{monitor.logged, monitor.hooked, monitor.posted} {
+		receiver.retain(expiring)
+	}
+
+	for _, key := range monitor.logged.pending(expiring) {
+		log.Printf("Warning: key `%s` expires at %s", key.ID, key.Expire.Format(time.RFC3339))
+		monitor.logged[key.Key] = key.Expire
+	}
+	if len(monitor.hook) > 0 {
+		for _, key := range monitor.hooked.pending(expiring) {
+			if err := RunExpiryHook(monitor.hook, key); err != nil {
+				log.Printf("Expiry hook returns error on key `%s`, will retry: %v", key.ID, err)
+				continue
+			}
+			monitor.hooked[key.Key] = key.Expire
+		}
+	}
+	if pending := monitor.posted.pending(expiring); len(monitor.webhook) > 0 && len(pending) > 0 {
+		if err := PostExpiringKeys(monitor.webhook, pending); err != nil {
+			log.Printf("Expiry webhook returns error, will retry: %v", err)
+		} else {
+			for _, key := range pending {
+				monitor.posted[key.Key] = key.Expire
+			}
+		}
+	}
+	return stats
+}
+
+// RunExpiryHook runs `Hook` for the expiring `key`, with YUKINO_KEY_ID, YUKINO_KEY_HASH and YUKINO_KEY_EXPIRE set in its environment.
+func RunExpiryHook(Hook string, key keystore.ExpiringKey) error {
+	commandSeq, err := shlex.Split(Hook)
+	if err != nil {
+		return err
+	}
+	if len(commandSeq) == 0 {
+		return fmt.Errorf("empty hook command")
+	}
+	cmd := exec.Command(commandSeq[0], commandSeq[1:]...)
+	cmd.Env = append(os.Environ(), "YUKINO_KEY_ID="+key.ID, "YUKINO_KEY_HASH="+key.Key, "YUKINO_KEY_EXPIRE="+key.Expire.Format(time.RFC3339))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// PostExpiringKeys sends `keys` to `URL` in the format of {"expiring": [...]}.
+func PostExpiringKeys(URL string, keys []keystore.ExpiringKey) error {
+	data, err := json.Marshal(struct {
+		Expiring []keystore.ExpiringKey `json:"expiring"`
+	}{keys})
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package util_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xpy123993/yukino-net/libraries/router/keystore"
+	"github.com/xpy123993/yukino-net/libraries/util"
+)
+
+func createExpiringKeyStore(t *testing.T) *keystore.KeyStore {
+	keyStore := keystore.CreateKeyStore()
+	for id, expire := range map[string]time.Duration{"expired": -time.Hour, "soon": time.Hour, "later": 30 * 24 * time.Hour} {
+		if err := keyStore.RegisterKey([]byte(id), keystore.SessionKey{ID: id, Expire: time.Now().Add(expire)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return keyStore
+}
+
+func TestExpiryMonitorStats(t *testing.T) {
+	stats := util.NewExpiryMonitor(createExpiringKeyStore(t), true, 24*time.Hour, "", "").Check()
+	if stats != (util.ExpiryStats{Keys: 2, ExpiringKeys: 1, RemovedKeys: 1}) {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestExpiryHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook is tested with sh")
+	}
+	folder := t.TempDir()
+	output, failure := path.Join(folder, "output"), path.Join(folder, "failure")
+	if err := os.WriteFile(failure, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Records the key, then fails as long as `failure` exists.
+	hook := fmt.Sprintf(`sh -c 'echo "$YUKINO_KEY_ID" >> %s; test ! -e %s'`, output, failure)
+	monitor := util.NewExpiryMonitor(createExpiringKeyStore(t), false, 24*time.Hour, hook, "")
+
+	readOutput := func() []string {
+		data, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Fields(string(data))
+	}
+	monitor.Check()
+	monitor.Check()
+	if calls := readOutput(); len(calls) != 2 || calls[0] != "soon" || calls[1] != "soon" {
+		t.Errorf("expect the failed hook to be retried, got %v", calls)
+	}
+	if err := os.Remove(failure); err != nil {
+		t.Fatal(err)
+	}
+	monitor.Check()
+	monitor.Check()
+	if calls := readOutput(); len(calls) != 3 {
+		t.Errorf("expect the key to be reported once after the hook succeeds, got %v", calls)
+	}
+}
+
+func TestExpiryWebhook(t *testing.T) {
+	requests := []string{}
+	status := http.StatusInternalServerError
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := struct {
+			Expiring []keystore.ExpiringKey `json:"expiring"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+		for _, key := range payload.Expiring {
+			requests = append(requests, key.ID)
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	keyStore := createExpiringKeyStore(t)
+	monitor := util.NewExpiryMonitor(keyStore, false, 24*time.Hour, "", server.URL)
+	monitor.Check()
+	monitor.Check()
+	if len(requests) != 2 || requests[0] != "soon" || requests[1] != "soon" {
+		t.Errorf("expect the failed webhook to be retried, got %v", requests)
+	}
+	status = http.StatusOK
+	monitor.Check()
+	monitor.Check()
+	if len(requests) != 3 {
+		t.Errorf("expect the key to be posted once after the webhook succeeds, got %v", requests)
+	}
+
+	// A key extended and expiring again is reported again.
+	if err := keyStore.UpdateKey([]byte("soon"), keystore.SessionKey{ID: "soon", Expire: time.Now().Add(2 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	monitor.Check()
+	if len(requests) != 4 {
+		t.Errorf("expect the extended key to be posted again, got %v", requests)
+	}
+}